@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, config.Redacted())
+}
+
+// flushHandler starts a flush of the pending queue in the background. If a flush is
+// already running, it responds with 429 and that flush's progress, so that cron jobs
+// can call it as often as they like. Handles POST /v1/flush.
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isDraining() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// Claim the flush before responding, so that concurrent requests can't both start one.
+	if !tryStartFlush() {
+		progress, _ := currentFlush()
+		w.Header().Set("Retry-After", strconv.Itoa(FlushRetryAfterSeconds))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		writeJSON(w, progress)
+		return
+	}
+	audit(r, "flush", "pending", nil)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runFlush()
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"status": "started"})
+}
+
+// pauseHandler pauses or resumes all delivery, for incidents upstream. Calls are
+// still answered and recorded while paused, but voicemails are queued as pending.
+// Handles POST /v1/pause and POST /v1/resume.
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paused := r.URL.Path == "/v1/pause"
+	err := setPaused(paused)
+	audit(r, strings.TrimPrefix(r.URL.Path, "/v1/"), "delivery", err)
+	if err != nil {
+		log.Printf("Failed to set delivery pause to %t: %v", paused, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Delivery paused: %t", paused)
+	writeJSON(w, map[string]bool{"paused": paused})
+}
+
+// testSMSHandler sends a test message to the given number, to check the Twilio setup
+// of a deployment. Handles POST /v1/test-sms with a "to" number.
+func testSMSHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	to, err := normalizeNumber(r.Form.Get("to"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid number: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !testSMSLimiter.Allow() {
+		http.Error(w, "Too many test messages, try again later", http.StatusTooManyRequests)
+		return
+	}
+	log.Printf("Sending test SMS to %s", to)
+	sid, err := sendSMS(to, "test", TestSMSText)
+	audit(r, "test_sms", to, err)
+	if err != nil {
+		log.Printf("Failed to send test SMS to %s: %v", to, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if sid == "" {
+		writeJSON(w, map[string]string{"to": to, "status": "not sent (opted out or local dev)"})
+		return
+	}
+	writeJSON(w, map[string]string{"to": to, "status": "sent", "sid": sid})
+}
+
+// replayHandler re-delivers a recording, e.g. after an outage lost the pending queue.
+// It calls deliverVoicemail directly, so the callback dedup window doesn't apply.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isDraining() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	sid := r.Form.Get("RecordingSid")
+	from, to, audioURL := r.Form.Get("from"), r.Form.Get("to"), r.Form.Get("audio_url")
+	if sid == "" || to == "" || audioURL == "" {
+		http.Error(w, "RecordingSid, to and audio_url are required", http.StatusBadRequest)
+		return
+	}
+	// Normalize the numbers the same way as for a recording from Twilio.
+	if number, err := normalizeNumber(to); err == nil {
+		to = number
+	}
+	if number, err := normalizeNumber(from); err == nil {
+		from = number
+	}
+	if identity, ok := config.NumberMap[to]; ok {
+		to = identity
+	}
+	log.Printf("Replaying recording %s: %s -> %s (%s)", sid, from, to, audioURL)
+	err := deliverVoicemail(PendingVoicemail{From: from, To: to, AudioURL: audioURL}, false)
+	audit(r, "replay", sid, err)
+	if _, ok := err.(*queuedError); ok {
+		log.Printf("Queued replayed recording %s: %v", sid, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]string{"RecordingSid": sid, "status": "queued"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to replay recording %s: %v", sid, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]string{"RecordingSid": sid, "status": "delivered"})
+}
+
+// pendingAudioHandler proxies the audio of a pending voicemail from Twilio, which
+// requires our credentials, so that support staff can listen to it.
+// Handles GET /v1/pending/{id}/audio.
+func pendingAudioHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/pending/"), "/")
+	if len(parts) != 2 || parts[1] != "audio" {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	voicemail, err := pendingStore.Get(id)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get pending voicemail %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequest("GET", voicemail.AudioURL, nil)
+	if err != nil {
+		http.Error(w, "Invalid audio URL", http.StatusInternalServerError)
+		return
+	}
+	// The URL may have been rewritten or replayed from elsewhere, so only Twilio gets
+	// the Twilio credentials.
+	if isTwilioURL(req.URL) {
+		req.SetBasicAuth(TwilioKeySid, TwilioKeySecret)
+	}
+	// Pass on range requests so that players can seek.
+	if value := r.Header.Get("Range"); value != "" {
+		req.Header.Set("Range", value)
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to fetch audio for pending voicemail %d: %v", id, err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		log.Printf("Failed to fetch audio for pending voicemail %d: %v", id, twilioStatusError(req.URL.Path, resp))
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	for _, header := range []string{"Content-Length", "Content-Range", "Accept-Ranges"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if contentType := correctAudioContentType(voicemail.AudioURL, resp.Header.Get("Content-Type")); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// redact masks a secret, keeping only a short prefix for identification.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return secret[:4] + "****"
+}
+
+// redactURL masks the password in a URL, if it has one.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "****")
+	}
+	return u.String()
+}
+
+// requireAdmin wraps a handler so that it's only reachable with the configured admin
+// token. If no admin token is configured, admin endpoints are disabled.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			log.Printf("Rejected unauthorized %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode response (json.MarshalIndent: %v)", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-token-0123456789"
+
+// adminRequest calls an admin handler through requireAdmin, with the admin token.
+func adminRequest(handler http.HandlerFunc, method, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rec := httptest.NewRecorder()
+	requireAdmin(handler)(rec, req)
+	return rec
+}
+
+func TestConfigHandlerRedactsSecrets(t *testing.T) {
+	secrets := []string{
+		"roger-access-token-0123456789",
+		testAdminToken,
+		"twilio-auth-token-0123456789",
+		"backend-access-token-0123456789",
+		"recipient-token-0123456789",
+		"https://hooks.slack.com/services/T000/B000/secret0123456789",
+		"proxy-password-0123456789",
+	}
+	setConfig(t, func(c *Config) {
+		c.AccessToken = secrets[0]
+		c.AdminToken = secrets[1]
+		c.TwilioAuthToken = secrets[2]
+		c.Backends = map[string]Backend{"+44": {APIBaseURL: "https://api.example.com/v1/", AccessToken: secrets[3]}}
+		c.RecipientTokens = map[string]string{"+14155550100": secrets[4]}
+		c.SlackWebhooks = map[string]string{"+14155550100": secrets[5]}
+		c.AlertWebhookURL = secrets[5]
+		c.OutboundProxyURL = "http://proxy:" + secrets[6] + "@proxy.internal:3128"
+	})
+	rec := adminRequest(configHandler, "GET", "/v1/config", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /v1/config returned %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, secret := range secrets {
+		if strings.Contains(body, secret) {
+			t.Errorf("GET /v1/config leaks %q", secret)
+		}
+	}
+	if !strings.Contains(body, `"AccessToken": "roge****"`) {
+		t.Errorf("GET /v1/config doesn't show the masked AccessToken: %s", body)
+	}
+	if !strings.Contains(body, "proxy.internal:3128") {
+		t.Errorf("GET /v1/config doesn't show the proxy host: %s", body)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	for _, token := range []string{"", "wrong", "Bearer wrong"} {
+		req := httptest.NewRequest("GET", "/v1/config", nil)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		requireAdmin(configHandler)(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("GET /v1/config with %q returned %d, want 403", token, rec.Code)
+		}
+	}
+	if rec := adminRequest(configHandler, "GET", "/v1/config", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /v1/config with the admin token returned %d", rec.Code)
+	}
+}
+
+func replayForm(sid, from, to string) string {
+	return url.Values{
+		"RecordingSid": {sid},
+		"from":         {from},
+		"to":           {to},
+		"audio_url":    {"https://api.twilio.com/recordings/" + sid},
+	}.Encode()
+}
+
+func TestReplayBypassesDuplicateCheck(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	putIdentity(t, "+14155550100", 42)
+	if _, err := claimRecording("RE1"); err != nil {
+		t.Fatal(err)
+	}
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	rec := adminRequest(replayHandler, "POST", "/v1/replay", replayForm("RE1", "(415) 555-0101", "415-555-0100"))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"delivered"`) {
+		t.Fatalf("Replay of a claimed recording returned %d: %s", rec.Code, rec.Body)
+	}
+	streams := fake.RequestsTo("/streams")
+	if len(streams) == 0 || streams[0].URL.Query().Get("on_behalf_of") != "42" {
+		t.Fatalf("Replay wasn't delivered on behalf of the recipient: %v", streams)
+	}
+	if participant := streams[0].Form().Get("participant"); participant != "+14155550101" {
+		t.Errorf("Replay created a stream with %q, want the normalized sender", participant)
+	}
+}
+
+func TestReplayUsesNumberMap(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+		c.NumberMap = map[string]string{"+14155550100": "alice@example.com"}
+	})
+	putIdentity(t, "alice@example.com", 42)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	rec := adminRequest(replayHandler, "POST", "/v1/replay", replayForm("RE1", "+14155550101", "+14155550100"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Replay returned %d: %s", rec.Code, rec.Body)
+	}
+	streams := fake.RequestsTo("/streams")
+	if len(streams) == 0 || streams[0].URL.Query().Get("on_behalf_of") != "42" {
+		t.Errorf("Replay wasn't delivered to the mapped identity: %v", streams)
+	}
+}
+
+func TestReplayQueued(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	interceptHTTP(t, streamHandler(7))
+	rec := adminRequest(replayHandler, "POST", "/v1/replay", replayForm("RE1", "+14155550101", "+14155550100"))
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"queued"`) {
+		t.Errorf("Replay for a recipient without an account returned %d: %s", rec.Code, rec.Body)
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("Replay queued %d voicemails, want 1", count)
+	}
+}
+
+func TestReplayRequiresRecording(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	rec := adminRequest(replayHandler, "POST", "/v1/replay", url.Values{"RecordingSid": {"RE1"}, "to": {"+14155550100"}}.Encode())
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Replay without audio_url returned %d, want 400", rec.Code)
+	}
+}
+
+// twilioRecordings serves recordings like Twilio does, with basic auth and range
+// requests, and returns the URL to fetch the named recording from.
+func twilioRecordings(t *testing.T, recordings map[string][]byte) string {
+	t.Helper()
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != TwilioKeySid || password != TwilioKeySecret {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		audio, ok := recordings[path.Base(r.URL.Path)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code": 20404, "message": "The requested resource was not found", "status": 404}`)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(audio))
+	})
+	return "https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/"
+}
+
+func TestPendingAudioHandler(t *testing.T) {
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	audio := []byte("ID3 not really an mp3, but close enough")
+	baseURL := twilioRecordings(t, map[string][]byte{"RE1.mp3": audio})
+	voicemail := &PendingVoicemail{To: "+14155550100", AudioURL: baseURL + "RE1.mp3"}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/v1/pending/%d/audio", voicemail.ID)
+	rec := adminRequest(pendingAudioHandler, "GET", target, "")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), audio) {
+		t.Fatalf("GET %s returned %d: %q", target, rec.Code, rec.Body)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "audio/mpeg" {
+		t.Errorf("GET %s returned Content-Type %q, want audio/mpeg", target, contentType)
+	}
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Range", "bytes=4-6")
+	rec = httptest.NewRecorder()
+	requireAdmin(pendingAudioHandler)(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "not" {
+		t.Errorf("GET %s for bytes 4-6 returned %d: %q", target, rec.Code, rec.Body)
+	}
+	if contentRange := rec.Header().Get("Content-Range"); contentRange != fmt.Sprintf("bytes 4-6/%d", len(audio)) {
+		t.Errorf("GET %s for bytes 4-6 returned Content-Range %q", target, contentRange)
+	}
+}
+
+func TestPendingAudioHandlerMissingRecording(t *testing.T) {
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	baseURL := twilioRecordings(t, nil)
+	voicemail := &PendingVoicemail{To: "+14155550100", AudioURL: baseURL + "RE1.mp3"}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	if rec := adminRequest(pendingAudioHandler, "GET", fmt.Sprintf("/v1/pending/%d/audio", voicemail.ID), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Audio of a deleted recording returned %d, want 404", rec.Code)
+	}
+	for _, target := range []string{"/v1/pending/999/audio", "/v1/pending/abc/audio", fmt.Sprintf("/v1/pending/%d/video", voicemail.ID)} {
+		if rec := adminRequest(pendingAudioHandler, "GET", target, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s returned %d, want 404", target, rec.Code)
+		}
+	}
+}
+
+func TestPendingAudioHandlerOtherHost(t *testing.T) {
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		io.WriteString(w, "ID3")
+	})
+	// Recordings can be rewritten to, or replayed from, hosts other than Twilio.
+	voicemail := &PendingVoicemail{To: "+14155550100", AudioURL: "https://cdn.example.com/RE1.mp3"}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	if rec := adminRequest(pendingAudioHandler, "GET", fmt.Sprintf("/v1/pending/%d/audio", voicemail.ID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("Audio from another host returned %d: %s", rec.Code, rec.Body)
+	}
+	sent := fake.RequestsTo("/RE1.mp3")
+	if len(sent) != 1 {
+		t.Fatalf("Fetched the audio %d times, want once", len(sent))
+	}
+	if auth := sent[0].Header.Get("Authorization"); auth != "" {
+		t.Errorf("Sent Authorization %q to %s, want the Twilio credentials kept to Twilio", auth, sent[0].URL.Host)
+	}
+}
+
+func useTestSMSLimiter(t *testing.T, burst int) {
+	saved := testSMSLimiter
+	testSMSLimiter = newRateLimiter(1.0/60, burst)
+	t.Cleanup(func() {
+		testSMSLimiter = saved
+	})
+}
+
+func TestTestSMSHandler(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	useTestSMSLimiter(t, 5)
+	twilio := new(smsTimes)
+	fake := interceptHTTP(t, twilio.ServeHTTP)
+	captureLog(t)
+	rec := adminRequest(testSMSHandler, "POST", "/v1/test-sms", url.Values{"to": {"(415) 555-0100"}}.Encode())
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"sid": "SM1"`) {
+		t.Fatalf("Test SMS returned %d: %s", rec.Code, rec.Body)
+	}
+	requests := fake.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Twilio got %d requests, want 1", len(requests))
+	}
+	if form := requests[0].Form(); form.Get("To") != "+14155550100" || form.Get("Body") != TestSMSText {
+		t.Errorf("Twilio got %v, want the test message to the normalized number", form)
+	}
+}
+
+func TestTestSMSHandlerTwilioError(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	useTestSMSLimiter(t, 5)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"code": 20003, "message": "Authenticate", "status": 401}`)
+	})
+	captureLog(t)
+	rec := adminRequest(testSMSHandler, "POST", "/v1/test-sms", url.Values{"to": {"+14155550100"}}.Encode())
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "20003") {
+		t.Errorf("Test SMS with bad credentials returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTestSMSHandlerRateLimited(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	useTestSMSLimiter(t, 2)
+	fake := interceptHTTP(t, new(smsTimes).ServeHTTP)
+	captureLog(t)
+	var codes []int
+	for i := 0; i < 3; i++ {
+		rec := adminRequest(testSMSHandler, "POST", "/v1/test-sms", url.Values{"to": {"+14155550100"}}.Encode())
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Three test messages returned %v, want the third rate limited", codes)
+	}
+	if n := len(fake.Requests()); n != 2 {
+		t.Errorf("Twilio got %d requests, want 2", n)
+	}
+}
+
+func TestTestSMSHandlerInvalidNumber(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	useTestSMSLimiter(t, 5)
+	rec := adminRequest(testSMSHandler, "POST", "/v1/test-sms", url.Values{"to": {"not a number"}}.Encode())
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Test SMS to an invalid number returned %d, want 400", rec.Code)
+	}
+}
+
+// useBlockedFlush queues a voicemail whose delivery blocks until the returned
+// function is called, and waits for it to be claimed at the end of the test.
+func useBlockedFlush(t *testing.T) (fake *fakeHTTP, unblock func()) {
+	t.Helper()
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) { c.AdminToken = testAdminToken })
+	putIdentity(t, "+14155550100", 42)
+	captureLog(t)
+	queuePending(t, 1)
+	blocked := make(chan struct{})
+	var once sync.Once
+	unblock = func() { once.Do(func() { close(blocked) }) }
+	fake = interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+		streamHandler(7, 99)(w, r)
+	})
+	t.Cleanup(func() {
+		unblock()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		waitForBackground(ctx)
+	})
+	return fake, unblock
+}
+
+func TestFlushHandlerStartsFlush(t *testing.T) {
+	fake, unblock := useBlockedFlush(t)
+	unblock()
+	rec := adminRequest(flushHandler, "POST", "/v1/flush", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Flush returned %d: %s", rec.Code, rec.Body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitForBackground(ctx) {
+		t.Fatal("Flush didn't finish")
+	}
+	if chunks := fake.RequestsTo("/chunks"); len(chunks) != 1 {
+		t.Errorf("Flush delivered %d voicemails, want 1", len(chunks))
+	}
+}
+
+func TestConcurrentFlushRejected(t *testing.T) {
+	useBlockedFlush(t)
+	if rec := adminRequest(flushHandler, "POST", "/v1/flush", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("Flush returned %d: %s", rec.Code, rec.Body)
+	}
+	// The first flush is claimed before it responds, so this can't start another.
+	rec := adminRequest(flushHandler, "POST", "/v1/flush", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Flush during a flush returned %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != fmt.Sprint(FlushRetryAfterSeconds) {
+		t.Errorf("Retry-After = %q, want %d", got, FlushRetryAfterSeconds)
+	}
+	var progress FlushProgress
+	if err := json.Unmarshal(rec.Body.Bytes(), &progress); err != nil {
+		t.Fatalf("Flush during a flush returned %s: %v", rec.Body, err)
+	}
+	if progress.StartedAt.IsZero() {
+		t.Errorf("Progress %+v is missing when the running flush started", progress)
+	}
+}
+
+func TestSimultaneousFlushesStartOne(t *testing.T) {
+	useBlockedFlush(t)
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- adminRequest(flushHandler, "POST", "/v1/flush", "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	started := 0
+	for code := range codes {
+		switch code {
+		case http.StatusAccepted:
+			started++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("Flush returned %d", code)
+		}
+	}
+	if started != 1 {
+		t.Errorf("%d flushes started, want 1", started)
+	}
+}
+
+func TestShutdownWaitsForFlush(t *testing.T) {
+	fake, unblock := useBlockedFlush(t)
+	if rec := adminRequest(flushHandler, "POST", "/v1/flush", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("Flush returned %d: %s", rec.Code, rec.Body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if waitForBackground(ctx) {
+		t.Fatal("waitForBackground() returned while the flush was still delivering")
+	}
+	unblock()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitForBackground(ctx) {
+		t.Fatal("waitForBackground() gave up on a flush that finished")
+	}
+	if chunks := fake.RequestsTo("/chunks"); len(chunks) != 1 {
+		t.Errorf("Flush delivered %d voicemails before shutdown, want 1", len(chunks))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// alerts tracks the state behind ops alerts, so that each kind of alert fires once
+// when its threshold is crossed and then at most once per AlertCooldownSeconds.
+var alerts struct {
+	sync.Mutex
+	consecutiveFailures int
+	lastSent            map[string]time.Time
+}
+
+// checkQueueDepth alerts if the pending queue has grown beyond AlertQueueDepth.
+func checkQueueDepth(depth int) {
+	if config.AlertQueueDepth <= 0 || depth < config.AlertQueueDepth {
+		return
+	}
+	alert("queue_depth", fmt.Sprintf("There are %d pending voicemails (threshold %d).", depth, config.AlertQueueDepth))
+}
+
+// recordDeliveryResult counts consecutive failed deliveries, and alerts once there
+// have been AlertConsecutiveFailures of them. Queued voicemails don't count.
+func recordDeliveryResult(err error) {
+	if config.AlertConsecutiveFailures <= 0 {
+		return
+	}
+	if _, ok := err.(*queuedError); ok {
+		return
+	}
+	alerts.Lock()
+	if err == nil {
+		alerts.consecutiveFailures = 0
+		alerts.Unlock()
+		return
+	}
+	alerts.consecutiveFailures++
+	failures := alerts.consecutiveFailures
+	alerts.Unlock()
+	if failures >= config.AlertConsecutiveFailures {
+		alert("delivery_failures", fmt.Sprintf("%d voicemail deliveries in a row have failed. Last error: %v", failures, err))
+	}
+}
+
+// alert posts a message to AlertWebhookURL, unless an alert of the same kind was
+// sent within the cooldown. The message is sent in the background.
+func alert(kind, message string) {
+	if config.AlertWebhookURL == "" {
+		return
+	}
+	alerts.Lock()
+	if alerts.lastSent == nil {
+		alerts.lastSent = make(map[string]time.Time)
+	}
+	cooldown := time.Duration(config.AlertCooldownSeconds) * time.Second
+	if last, ok := alerts.lastSent[kind]; ok && time.Since(last) < cooldown {
+		alerts.Unlock()
+		return
+	}
+	alerts.lastSent[kind] = time.Now()
+	alerts.Unlock()
+	log.Printf("Alert (%s): %s", kind, message)
+	go func() {
+		if err := postSlack(config.AlertWebhookURL, "Voicemail: "+message); err != nil {
+			log.Printf("Failed to send %s alert: %v", kind, err)
+		}
+	}()
+}
+
+// postSlack sends a message to a Slack-compatible incoming webhook.
+func postSlack(webhookURL, message string) error {
+	body, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAlerts sends alerts to a fake webhook for the test, and returns the messages
+// it receives.
+func useAlerts(t *testing.T, update func(c *Config)) chan string {
+	t.Helper()
+	setConfig(t, func(c *Config) {
+		c.AlertWebhookURL = "https://hooks.slack.com/services/T1/B1/abc"
+		update(c)
+	})
+	resetAlerts := func() {
+		alerts.Lock()
+		alerts.consecutiveFailures, alerts.lastSent = 0, nil
+		alerts.Unlock()
+	}
+	resetAlerts()
+	t.Cleanup(resetAlerts)
+	messages := make(chan string, 10)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&body)
+		messages <- body.Text
+	})
+	captureLog(t)
+	return messages
+}
+
+// receivedAlerts waits briefly for alerts to be sent in the background and returns
+// them.
+func receivedAlerts(messages chan string) (received []string) {
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case message := <-messages:
+			received = append(received, message)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestQueueDepthAlert(t *testing.T) {
+	messages := useAlerts(t, func(c *Config) {
+		c.AlertQueueDepth, c.AlertCooldownSeconds = 5, 3600
+	})
+	checkQueueDepth(4)
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Errorf("Alerted %v below the threshold", received)
+	}
+	checkQueueDepth(5)
+	received := receivedAlerts(messages)
+	if len(received) != 1 || !strings.Contains(received[0], "There are 5 pending voicemails") {
+		t.Fatalf("Alerted %v at the threshold, want one alert", received)
+	}
+	checkQueueDepth(8)
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Errorf("Alerted %v again within the cooldown", received)
+	}
+}
+
+func TestQueueDepthAlertAfterCooldown(t *testing.T) {
+	messages := useAlerts(t, func(c *Config) {
+		c.AlertQueueDepth, c.AlertCooldownSeconds = 5, 3600
+	})
+	checkQueueDepth(5)
+	receivedAlerts(messages)
+	alerts.Lock()
+	alerts.lastSent["queue_depth"] = time.Now().Add(-time.Hour)
+	alerts.Unlock()
+	checkQueueDepth(6)
+	if received := receivedAlerts(messages); len(received) != 1 {
+		t.Errorf("Alerted %v after the cooldown, want one alert", received)
+	}
+}
+
+func TestConsecutiveFailuresAlert(t *testing.T) {
+	messages := useAlerts(t, func(c *Config) {
+		c.AlertConsecutiveFailures, c.AlertCooldownSeconds = 3, 3600
+	})
+	failure := errors.New("roger api returned 500")
+	recordDeliveryResult(failure)
+	recordDeliveryResult(failure)
+	// A success starts the count again.
+	recordDeliveryResult(nil)
+	recordDeliveryResult(failure)
+	recordDeliveryResult(failure)
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Fatalf("Alerted %v before 3 failures in a row", received)
+	}
+	recordDeliveryResult(failure)
+	received := receivedAlerts(messages)
+	if len(received) != 1 || !strings.Contains(received[0], "3 voicemail deliveries in a row have failed") {
+		t.Fatalf("Alerted %v after 3 failures in a row, want one alert", received)
+	}
+	recordDeliveryResult(failure)
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Errorf("Alerted %v again within the cooldown", received)
+	}
+}
+
+func TestQueuedDeliveryNotAFailure(t *testing.T) {
+	messages := useAlerts(t, func(c *Config) {
+		c.AlertConsecutiveFailures = 1
+	})
+	recordDeliveryResult(&queuedError{"recipient has no account"})
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Errorf("Alerted %v for a queued voicemail", received)
+	}
+}
+
+func TestNoAlertsWithoutWebhook(t *testing.T) {
+	messages := useAlerts(t, func(c *Config) {
+		c.AlertWebhookURL, c.AlertQueueDepth = "", 1
+	})
+	checkQueueDepth(10)
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Errorf("Alerted %v without AlertWebhookURL", received)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// audioContentTypes maps audio file extensions to the Content-Type players expect.
+var audioContentTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+}
+
+// audioContentType returns the Content-Type for an audio file name or URL, based on
+// its extension. Returns an empty string for unknown formats.
+func audioContentType(name string) string {
+	if u, err := url.Parse(name); err == nil && u.Path != "" {
+		name = u.Path
+	}
+	return audioContentTypes[strings.ToLower(path.Ext(name))]
+}
+
+// correctAudioContentType returns the Content-Type to serve audio with. The given
+// type is kept unless it's missing or generic, in which case the type is derived
+// from the name.
+func correctAudioContentType(name, contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && strings.HasPrefix(mediaType, "audio/") {
+		return contentType
+	}
+	if derived := audioContentType(name); derived != "" {
+		return derived
+	}
+	return contentType
+}
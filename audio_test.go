@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioContentType(t *testing.T) {
+	tests := map[string]string{
+		"recording.mp3":       "audio/mpeg",
+		"recording.wav":       "audio/wav",
+		"recording.WAV":       "audio/wav",
+		"recording.ogg":       "audio/ogg",
+		"note.opus":           "audio/ogg",
+		"note.m4a":            "audio/mp4",
+		"note.aac":            "audio/aac",
+		"/tmp/segment000.mp3": "audio/mpeg",
+		"https://api.twilio.com/recordings/RE1.wav?a=b.mp3": "audio/wav",
+		"https://api.twilio.com/recordings/RE1":             "",
+		"notes.txt":                                         "",
+	}
+	for name, want := range tests {
+		if got := audioContentType(name); got != want {
+			t.Errorf("audioContentType(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCorrectAudioContentType(t *testing.T) {
+	tests := []struct {
+		name, contentType, want string
+	}{
+		{"RE1.mp3", "audio/mpeg", "audio/mpeg"},
+		{"RE1.mp3", "", "audio/mpeg"},
+		{"RE1.mp3", "application/octet-stream", "audio/mpeg"},
+		{"RE1.wav", "binary/octet-stream", "audio/wav"},
+		// Specific audio types from the server are kept.
+		{"RE1.mp3", "audio/mp3", "audio/mp3"},
+		{"RE1.wav", "audio/x-wav; charset=binary", "audio/x-wav; charset=binary"},
+		{"RE1", "application/octet-stream", "application/octet-stream"},
+		{"RE1", "", ""},
+	}
+	for _, test := range tests {
+		if got := correctAudioContentType(test.name, test.contentType); got != test.want {
+			t.Errorf("correctAudioContentType(%q, %q) = %q, want %q", test.name, test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestPostAudioFileContentType(t *testing.T) {
+	for _, format := range []struct{ extension, want string }{{".mp3", "audio/mpeg"}, {".wav", "audio/wav"}} {
+		filename := filepath.Join(t.TempDir(), "segment000"+format.extension)
+		if err := ioutil.WriteFile(filename, []byte("audio"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fake := interceptHTTP(t, streamHandler(7))
+		if err := postAudioFile(Backend{AccessToken: "token", apiURL: apiURL}, 42, 7, filename, url.Values{}); err != nil {
+			t.Fatal(err)
+		}
+		chunks := fake.RequestsTo("/streams/7/chunks")
+		if len(chunks) != 1 {
+			t.Fatalf("postAudioFile() made %d chunk requests, want 1", len(chunks))
+		}
+		_, params, err := mime.ParseMediaType(chunks[0].Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := multipart.NewReader(bytes.NewReader(chunks[0].Body), params["boundary"]).NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType := part.Header.Get("Content-Type"); contentType != format.want {
+			t.Errorf("Uploaded %s file has Content-Type %q, want %q", format.extension, contentType, format.want)
+		}
+	}
+}
+
+func TestDefaultAudioURLRewrite(t *testing.T) {
+	tests := map[string]string{
+		"https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1":     "https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1.mp3",
+		"https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1.wav": "https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1.mp3",
+		"https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1.mp3": "https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1.mp3",
+		"https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1?x=1": "https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1?x=1",
+	}
+	for audioURL, want := range tests {
+		if got := rewriteAudioURL(audioURL); got != want {
+			t.Errorf("rewriteAudioURL(%q) = %q, want %q", audioURL, got, want)
+		}
+	}
+}
+
+func TestAudioURLRewritesInOrder(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AudioURLRewrites = []RewriteRule{
+			{Pattern: `^https://api\.twilio\.com/2010-04-01/Accounts/[^/]+/Recordings/`, Replacement: "https://cdn.example.com/recordings/"},
+			{Pattern: `^(https://cdn\.example\.com/recordings/RE[0-9a-f]+)$`, Replacement: "${1}.mp3"},
+			{Pattern: `\.mp3$`, Replacement: ".mp3?source=voicemail"},
+		}
+	})
+	got := rewriteAudioURL("https://api.twilio.com/2010-04-01/Accounts/AC1/Recordings/RE1a")
+	if want := "https://cdn.example.com/recordings/RE1a.mp3?source=voicemail"; got != want {
+		t.Errorf("rewriteAudioURL() = %q, want %q", got, want)
+	}
+	if got := rewriteAudioURL("https://other.example.com/audio.ogg"); got != "https://other.example.com/audio.ogg" {
+		t.Errorf("rewriteAudioURL() changed a URL none of the rules match to %q", got)
+	}
+}
+
+func TestNoAudioURLRewrites(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AudioURLRewrites = nil
+	})
+	if got := rewriteAudioURL("https://api.twilio.com/recordings/RE1"); got != "https://api.twilio.com/recordings/RE1" {
+		t.Errorf("rewriteAudioURL() without rules = %q, want it unchanged", got)
+	}
+}
+
+func TestAudioURLRewritesValidated(t *testing.T) {
+	c := config
+	c.AudioURLRewrites = []RewriteRule{{Pattern: `(unclosed`, Replacement: "x"}}
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() accepted an invalid AudioURLRewrites pattern")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// AuditLog records an action taken through the admin endpoints.
+type AuditLog struct {
+	Actor     string    `datastore:"actor"`
+	Action    string    `datastore:"action"`
+	Target    string    `datastore:"target"`
+	Result    string    `datastore:"result,noindex"`
+	CreatedAt time.Time `datastore:"created_at"`
+}
+
+// audit logs the result of an admin action, and stores it as an AuditLog entity if
+// AuditToDatastore is enabled. The actor comes from AuditActorHeader, since all
+// admins share the same token.
+func audit(r *http.Request, action, target string, err error) {
+	entry := AuditLog{
+		Actor:     "admin",
+		Action:    action,
+		Target:    target,
+		Result:    "ok",
+		CreatedAt: time.Now(),
+	}
+	if config.AuditActorHeader != "" {
+		if actor := r.Header.Get(config.AuditActorHeader); actor != "" {
+			entry.Actor = actor
+		}
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	log.Printf("Audit: actor=%q action=%q target=%q result=%q", entry.Actor, entry.Action, entry.Target, entry.Result)
+	if !config.AuditToDatastore {
+		return
+	}
+	if _, err := store.Put(ctx, incompleteKey("AuditLog"), &entry); err != nil {
+		log.Printf("Failed to store audit log for %s %s: %v", action, target, err)
+	}
+}
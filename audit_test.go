@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useAudit(t *testing.T, update func(c *Config)) {
+	t.Helper()
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+		update(c)
+	})
+}
+
+// storedAuditLogs returns the AuditLog entities, oldest first.
+func storedAuditLogs(t *testing.T) []AuditLog {
+	t.Helper()
+	var entries []AuditLog
+	if _, err := store.GetAll(ctx, newQuery("AuditLog").Order("created_at"), &entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAuditPause(t *testing.T) {
+	useAudit(t, func(c *Config) {})
+	logs := captureLog(t)
+	adminRequest(pauseHandler, "POST", "/v1/pause", "")
+	adminRequest(pauseHandler, "POST", "/v1/resume", "")
+	expirePauseCache()
+	for _, want := range []string{
+		`Audit: actor="admin" action="pause" target="delivery" result="ok"`,
+		`Audit: actor="admin" action="resume" target="delivery" result="ok"`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Log = %q, want %q", logs.String(), want)
+		}
+	}
+}
+
+func TestAuditFlush(t *testing.T) {
+	useAudit(t, func(c *Config) {})
+	usePendingStore(t)
+	logs := captureLog(t)
+	if rec := adminRequest(flushHandler, "POST", "/v1/flush", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("Flush returned %d: %s", rec.Code, rec.Body)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, running := currentFlush(); !running {
+			break
+		}
+	}
+	if !strings.Contains(logs.String(), `action="flush" target="pending" result="ok"`) {
+		t.Errorf("Log = %q, want the flush audited", logs.String())
+	}
+}
+
+func TestAuditFailedReplay(t *testing.T) {
+	useAudit(t, func(c *Config) {})
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	})
+	logs := captureLog(t)
+	adminRequest(replayHandler, "POST", "/v1/replay", replayForm("RE1", "+14155550101", "+14155550100"))
+	if !strings.Contains(logs.String(), `action="replay" target="RE1" result="`) || strings.Contains(logs.String(), `target="RE1" result="ok"`) {
+		t.Errorf("Log = %q, want the replay audited with its error", logs.String())
+	}
+}
+
+func TestAuditActorHeader(t *testing.T) {
+	useAudit(t, func(c *Config) {
+		c.AuditActorHeader = "X-Goog-Authenticated-User-Email"
+	})
+	logs := captureLog(t)
+	req := httptest.NewRequest("POST", "/v1/pause", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("X-Goog-Authenticated-User-Email", "ops@example.com")
+	requireAdmin(pauseHandler)(httptest.NewRecorder(), req)
+	adminRequest(pauseHandler, "POST", "/v1/resume", "")
+	expirePauseCache()
+	if !strings.Contains(logs.String(), `actor="ops@example.com" action="pause"`) {
+		t.Errorf("Log = %q, want the actor from the header", logs.String())
+	}
+	if !strings.Contains(logs.String(), `actor="admin" action="resume"`) {
+		t.Errorf("Log = %q, want the default actor without the header", logs.String())
+	}
+}
+
+func TestAuditToDatastore(t *testing.T) {
+	useAudit(t, func(c *Config) {
+		c.AuditToDatastore = true
+	})
+	captureLog(t)
+	adminRequest(pauseHandler, "POST", "/v1/pause", "")
+	adminRequest(pauseHandler, "POST", "/v1/resume", "")
+	expirePauseCache()
+	entries := storedAuditLogs(t)
+	if len(entries) != 2 {
+		t.Fatalf("Stored %d audit logs, want 2", len(entries))
+	}
+	if entry := entries[0]; entry.Actor != "admin" || entry.Action != "pause" || entry.Target != "delivery" || entry.Result != "ok" || entry.CreatedAt.IsZero() {
+		t.Errorf("Stored %+v, want the pause", entry)
+	}
+}
+
+func TestAuditNotStoredByDefault(t *testing.T) {
+	useAudit(t, func(c *Config) {})
+	captureLog(t)
+	adminRequest(pauseHandler, "POST", "/v1/pause", "")
+	adminRequest(pauseHandler, "POST", "/v1/resume", "")
+	expirePauseCache()
+	if entries := storedAuditLogs(t); len(entries) != 0 {
+		t.Errorf("Stored %d audit logs without AuditToDatastore, want none", len(entries))
+	}
+}
+
+func TestReadOnlyAdminRequestsNotAudited(t *testing.T) {
+	useAudit(t, func(c *Config) {})
+	logs := captureLog(t)
+	adminRequest(configHandler, "GET", "/v1/config", "")
+	if strings.Contains(logs.String(), "Audit:") {
+		t.Errorf("Log = %q, want reading the config left out of the audit log", logs.String())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// callLogsHandler lists the CallLogs from or to a number, newest first. Handles GET
+// /v1/calls with a "number" and optionally a "since" and "until" date or time.
+func callLogsHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	number := query.Get("number")
+	if number == "" {
+		http.Error(w, "A number is required", http.StatusBadRequest)
+		return
+	}
+	if normalized, err := normalizeNumber(number); err == nil {
+		number = normalized
+	}
+	since, err := parseTimeParam(query.Get("since"))
+	if err != nil {
+		http.Error(w, "Invalid since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTimeParam(query.Get("until"))
+	if err != nil {
+		http.Error(w, "Invalid until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if raw := query.Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	type callLogEntry struct {
+		CallSid string
+		CallLog
+	}
+	var entries []callLogEntry
+	// Datastore can't query for either number, so query each side.
+	for _, field := range []string{"from", "to"} {
+		q := newQuery("CallLog").Filter(field+" =", number)
+		if !since.IsZero() {
+			q = q.Filter("created_at >=", since)
+		}
+		if !until.IsZero() {
+			q = q.Filter("created_at <", until)
+		}
+		var logs []CallLog
+		keys, err := store.GetAll(ctx, q.Order("-created_at").Limit(limit), &logs)
+		if err != nil {
+			log.Printf("Failed to query call logs for %s: %v", number, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for i, key := range keys {
+			if field == "to" && logs[i].From == number {
+				// Already found as a call from the number.
+				continue
+			}
+			entries = append(entries, callLogEntry{key.Name, logs[i]})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	writeJSON(w, entries)
+}
+
+// logCall records what happened on a request for a call in its CallLog.
+func logCall(form url.Values, outcome string) {
+	sid := form.Get("CallSid")
+	if sid == "" {
+		return
+	}
+	err := updateCallLog(sid, func(callLog *CallLog) {
+		if from := form.Get(config.FromField); from != "" {
+			callLog.From = from
+		}
+		if to := form.Get(config.ToField); to != "" {
+			callLog.To = to
+		}
+		if recordingSid := form.Get("RecordingSid"); recordingSid != "" {
+			callLog.RecordingSid = recordingSid
+			callLog.RecordingURL = form.Get("RecordingUrl")
+			callLog.RecordingDuration, _ = strconv.Atoi(form.Get("RecordingDuration"))
+		}
+		callLog.Outcome = outcome
+	})
+	if err != nil {
+		log.Printf("Failed to store call log for %s: %v", sid, err)
+	}
+}
+
+// parseTimeParam parses a date ("2006-01-02") or RFC 3339 time. An empty value is
+// the zero time.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// updateCallLog applies update to the call's CallLog, creating it if needed. Each
+// webhook for a call only knows part of its story, so they all add to the same entity.
+func updateCallLog(sid string, update func(callLog *CallLog)) error {
+	key := nameKey("CallLog", sid)
+	return runInTransaction(store, func(tx *datastore.Transaction) error {
+		var callLog CallLog
+		if err := tx.Get(key, &callLog); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		update(&callLog)
+		callLog.UpdatedAt = time.Now()
+		if callLog.CreatedAt.IsZero() {
+			callLog.CreatedAt = callLog.UpdatedAt
+		}
+		_, err := tx.Put(key, &callLog)
+		return err
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func useCallLogs(t *testing.T) {
+	t.Helper()
+	useDatastore(t)
+	setConfig(t, func(c *Config) { c.LogCalls = true })
+}
+
+// waitForCallLog waits for the call's CallLog to have the outcome, since it's
+// stored in the background after responding.
+func waitForCallLog(t *testing.T, sid, outcome string) CallLog {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		var callLog CallLog
+		err := store.Get(ctx, nameKey("CallLog", sid), &callLog)
+		if err == nil && callLog.Outcome == outcome {
+			return callLog
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Call log for %s is %+v (%v), want outcome %q", sid, callLog, err, outcome)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCallLogWrittenOnCall(t *testing.T) {
+	useCallLogs(t)
+	getCall(url.Values{"CallSid": {"CA1"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}})
+	callLog := waitForCallLog(t, "CA1", "answered")
+	if callLog.From != "+14155550101" || callLog.To != "+14155550100" {
+		t.Errorf("Call log is from %q to %q, want +14155550101 to +14155550100", callLog.From, callLog.To)
+	}
+	if callLog.CreatedAt.IsZero() || callLog.UpdatedAt.IsZero() {
+		t.Error("Call log is missing its timestamps")
+	}
+}
+
+func TestCallLogWrittenOnRecording(t *testing.T) {
+	useCallLogs(t)
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, streamHandler(7))
+	getCall(url.Values{"CallSid": {"CA1"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}})
+	waitForCallLog(t, "CA1", "answered")
+	postForm(callHandler, "/v1/call", url.Values{
+		"CallSid":           {"CA1"},
+		"From":              {"+14155550101"},
+		"ForwardedFrom":     {"+14155550100"},
+		"RecordingUrl":      {"https://api.twilio.com/recordings/RE1"},
+		"RecordingSid":      {"RE1"},
+		"RecordingDuration": {"12"},
+	})
+	callLog := waitForCallLog(t, "CA1", "delivered")
+	if callLog.RecordingSid != "RE1" || callLog.RecordingURL != "https://api.twilio.com/recordings/RE1" || callLog.RecordingDuration != 12 {
+		t.Errorf("Call log has recording %q at %q (%ds), want RE1 (12s)", callLog.RecordingSid, callLog.RecordingURL, callLog.RecordingDuration)
+	}
+	if callLog.From != "+14155550101" || callLog.To != "+14155550100" {
+		t.Errorf("Call log is from %q to %q after the recording", callLog.From, callLog.To)
+	}
+}
+
+func TestCallLogOffByDefault(t *testing.T) {
+	useDatastore(t)
+	getCall(url.Values{"CallSid": {"CA1"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}})
+	time.Sleep(20 * time.Millisecond)
+	var callLog CallLog
+	if err := store.Get(ctx, nameKey("CallLog", "CA1"), &callLog); err == nil {
+		t.Errorf("Call log %+v was stored without LogCalls", callLog)
+	}
+}
+
+// putCallLog stores a CallLog created at the given time.
+func putCallLog(t *testing.T, sid, from, to string, createdAt time.Time) {
+	t.Helper()
+	callLog := CallLog{From: from, To: to, Outcome: "answered", CreatedAt: createdAt, UpdatedAt: createdAt}
+	if _, err := store.Put(ctx, nameKey("CallLog", sid), &callLog); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queryCallLogs returns the CallSids listed by GET /v1/calls with the query.
+func queryCallLogs(t *testing.T, query string) []string {
+	t.Helper()
+	rec := adminRequest(callLogsHandler, "GET", "/v1/calls?"+query, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /v1/calls?%s got %d: %s", query, rec.Code, rec.Body)
+	}
+	var entries []struct{ CallSid string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	var sids []string
+	for _, entry := range entries {
+		sids = append(sids, entry.CallSid)
+	}
+	return sids
+}
+
+func TestCallLogsQuery(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) { c.AdminToken = testAdminToken })
+	day := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	putCallLog(t, "CA1", "+14155550101", "+14155550100", day.AddDate(0, 0, -2))
+	putCallLog(t, "CA2", "+14155550100", "+14155550102", day.AddDate(0, 0, -1))
+	putCallLog(t, "CA3", "+14155550103", "+14155550100", day)
+	putCallLog(t, "CA4", "+14155550103", "+14155550104", day)
+	if got := queryCallLogs(t, "number=%2B14155550100"); !reflect.DeepEqual(got, []string{"CA3", "CA2", "CA1"}) {
+		t.Errorf("Calls for +14155550100 are %v, want [CA3 CA2 CA1] from either side, newest first", got)
+	}
+	if got := queryCallLogs(t, "number=%2B14155550100&since=2026-10-13&until=2026-10-14"); !reflect.DeepEqual(got, []string{"CA2"}) {
+		t.Errorf("Calls for +14155550100 on 2026-10-13 are %v, want [CA2]", got)
+	}
+	if got := queryCallLogs(t, "number=%2B14155550100&limit=1"); !reflect.DeepEqual(got, []string{"CA3"}) {
+		t.Errorf("Limited calls for +14155550100 are %v, want [CA3]", got)
+	}
+}
+
+func TestCallLogsQueryValidated(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) { c.AdminToken = testAdminToken })
+	for _, query := range []string{"", "number=%2B14155550100&since=yesterday", "number=%2B14155550100&limit=0"} {
+		if rec := adminRequest(callLogsHandler, "GET", "/v1/calls?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /v1/calls?%s got %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
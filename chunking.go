@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// processesAudio reports whether recordings are transcoded or split before delivery,
+// which means downloading them first.
+func processesAudio() bool {
+	return transcodingEnabled() || (config.ChunkRecordings && config.RecordMaxLength > config.ChunkSeconds)
+}
+
+// postAudio adds the recording to the stream, transcoded if transcoding is enabled
+// or split into several chunks if chunking is enabled. Both need the recording
+// downloaded to source first, so neither is done if source is empty. Falls back to
+// the original recording in a single chunk if either fails. Any extra fields are
+// included with every chunk.
+func postAudio(backend Backend, accountId, streamId int64, audioURL, source string, extra url.Values) (err error) {
+	if source != "" && transcodingEnabled() {
+		err = postTranscodedAudio(backend, accountId, streamId, source, extra)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to transcode %s, posting the original: %v", audioURL, err)
+	}
+	if source != "" && config.ChunkRecordings && config.RecordMaxLength > config.ChunkSeconds {
+		err = postAudioChunks(backend, accountId, streamId, source, extra)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to post %s in chunks, posting it whole: %v", audioURL, err)
+	}
+	fields := url.Values{
+		"audio_url": {audioURL},
+	}
+	for key, values := range extra {
+		fields[key] = values
+	}
+	_, err = postStream(backend, accountId, streamId, fields)
+	return
+}
+
+func postAudioChunks(backend Backend, accountId, streamId int64, source string, extra url.Values) error {
+	dir, err := ioutil.TempDir("", "voicemail")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	segments, err := segmentAudio(source, dir, config.ChunkSeconds)
+	if err != nil {
+		return err
+	}
+	if len(segments) < 2 {
+		return fmt.Errorf("recording is too short to split")
+	}
+	for i, segment := range segments {
+		if err := postAudioFile(backend, accountId, streamId, segment, extra); err != nil {
+			return fmt.Errorf("failed to post chunk %d of %d: %v", i+1, len(segments), err)
+		}
+	}
+	return nil
+}
+
+// postAudioFile uploads a local audio file as a chunk in the stream. Like downloads,
+// uploads of whole recordings get the download timeout.
+func postAudioFile(backend Backend, accountId, streamId int64, filename string, extra url.Values) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, values := range extra {
+		for _, value := range values {
+			if err := writer.WriteField(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="audio"; filename="%s"`, filepath.Base(filename)))
+	header.Set("Content-Type", correctAudioContentType(filename, ""))
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	_, err = postStreamBody(downloadClient, backend, accountId, streamId, body.Bytes(), writer.FormDataContentType())
+	return err
+}
+
+// downloadRecording downloads the recording to a temporary file. Call cleanup to
+// remove it once done.
+func downloadRecording(audioURL string) (source string, cleanup func(), err error) {
+	dir, err := ioutil.TempDir("", "voicemail")
+	if err != nil {
+		return "", nil, err
+	}
+	source = filepath.Join(dir, "source.mp3")
+	if err := downloadFile(audioURL, source); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return source, func() { os.RemoveAll(dir) }, nil
+}
+
+// downloadFile saves fileURL to filename, failing if it's bigger than MaxAudioBytes.
+// Downloads have their own timeout and concurrency limit, so that slow downloads
+// don't hold up other deliveries.
+func downloadFile(fileURL, filename string) error {
+	if downloadLimiter != nil {
+		release := downloadLimiter.Acquire(true)
+		defer release()
+	}
+	resp, err := downloadClient.Get(fileURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		// Recordings are usually served by Twilio.
+		return twilioStatusError(fileURL, resp)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if config.MaxAudioBytes <= 0 {
+		_, err = io.Copy(file, resp.Body)
+		return err
+	}
+	n, err := io.Copy(file, io.LimitReader(resp.Body, config.MaxAudioBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > config.MaxAudioBytes {
+		log.Printf("%s is larger than MaxAudioBytes (%d bytes)", fileURL, config.MaxAudioBytes)
+		return fmt.Errorf("%s exceeds %d bytes", fileURL, config.MaxAudioBytes)
+	}
+	return nil
+}
+
+// segmentAudio splits an MP3 into segments of the given length using ffmpeg and
+// returns the segment files in order.
+func segmentAudio(source, dir string, seconds int) ([]string, error) {
+	pattern := filepath.Join(dir, "segment%03d.mp3")
+	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-i", source,
+		"-f", "segment", "-segment_time", fmt.Sprint(seconds), "-c", "copy", pattern)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v (%s)", err, bytes.TrimSpace(output))
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "segment*.mp3"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
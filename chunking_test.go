@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileTwilioError(t *testing.T) {
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"code": 20404, "message": "The requested resource was not found", "more_info": "https://www.twilio.com/docs/errors/20404", "status": 404}`)
+	})
+	err := downloadFile("https://api.twilio.com/recordings/RE1.mp3", filepath.Join(t.TempDir(), "source.mp3"))
+	if err == nil || !strings.Contains(err.Error(), "20404") {
+		t.Errorf("downloadFile() error = %v, want the Twilio error", err)
+	}
+}
+
+// requireFFmpeg skips the test if ffmpeg isn't installed.
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg isn't installed")
+	}
+}
+
+// silentMP3 creates an MP3 of silence of the given length.
+func silentMP3(t *testing.T, filename string, seconds int) {
+	t.Helper()
+	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-f", "lavfi", "-i", "anullsrc=r=8000:cl=mono",
+		"-t", fmt.Sprint(seconds), "-c:a", "libmp3lame", filename)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create %s: %v (%s)", filename, err, output)
+	}
+}
+
+func TestSegmentAudio(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.mp3")
+	silentMP3(t, source, 75)
+	segments, err := segmentAudio(source, dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"segment000.mp3", "segment001.mp3", "segment002.mp3"}
+	if len(segments) != len(want) {
+		t.Fatalf("segmentAudio() = %v, want %d segments", segments, len(want))
+	}
+	for i, segment := range segments {
+		if filepath.Base(segment) != want[i] {
+			t.Errorf("Segment %d is %s, want %s", i, filepath.Base(segment), want[i])
+		}
+	}
+}
+
+// postRecording posts the recording to stream 7, downloading it first if it's going
+// to be transcoded or split, as delivery does.
+func postRecording(t *testing.T, audioURL string, extra url.Values) error {
+	t.Helper()
+	var source string
+	if processesAudio() {
+		if file, cleanup, err := downloadRecording(audioURL); err == nil {
+			defer cleanup()
+			source = file
+		}
+	}
+	return postAudio(Backend{AccessToken: "token", apiURL: apiURL}, 42, 7, audioURL, source, extra)
+}
+
+func TestPostAudioChunks(t *testing.T) {
+	requireFFmpeg(t)
+	setConfig(t, func(c *Config) {
+		c.ChunkRecordings, c.RecordMaxLength, c.ChunkSeconds = true, 120, 30
+	})
+	source := filepath.Join(t.TempDir(), "source.mp3")
+	silentMP3(t, source, 75)
+	audio, err := ioutil.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write(audio)
+			return
+		}
+		streamHandler(7)(w, r)
+	})
+	err = postRecording(t, "https://api.twilio.com/recordings/RE1.mp3", url.Values{"metadata": {`{"a":"b"}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := fake.RequestsTo("/streams/7/chunks")
+	if len(chunks) != 3 {
+		t.Fatalf("postAudio() posted %d chunks, want 3", len(chunks))
+	}
+	for i, chunk := range chunks {
+		_, params, err := mime.ParseMediaType(chunk.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		form, err := multipart.NewReader(bytes.NewReader(chunk.Body), params["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(form.File["audio"]) != 1 || form.Value["metadata"][0] != `{"a":"b"}` {
+			t.Errorf("Chunk %d has fields %v and files %v, want audio and metadata", i, form.Value, form.File)
+		}
+	}
+}
+
+func TestPostAudioFallsBackToWholeRecording(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ChunkRecordings, c.RecordMaxLength, c.ChunkSeconds = true, 120, 30
+	})
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		streamHandler(7)(w, r)
+	})
+	err := postRecording(t, "https://api.twilio.com/recordings/RE1.mp3", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := fake.RequestsTo("/streams/7/chunks")
+	if len(chunks) != 1 || chunks[0].Form().Get("audio_url") != "https://api.twilio.com/recordings/RE1.mp3" {
+		t.Errorf("postAudio() posted %v, want the whole recording by URL", chunks)
+	}
+}
+
+func TestDownloadFileTooLarge(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAudioBytes = 1024 })
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{0}, 4096))
+	})
+	logs := captureLog(t)
+	err := downloadFile("https://api.twilio.com/recordings/RE1.mp3", filepath.Join(t.TempDir(), "source.mp3"))
+	if err == nil || !strings.Contains(err.Error(), "exceeds 1024 bytes") {
+		t.Errorf("downloadFile() error = %v, want the size limit error", err)
+	}
+	if !strings.Contains(logs.String(), "larger than MaxAudioBytes") {
+		t.Errorf("Log = %q, want the size limit logged", logs.String())
+	}
+}
+
+func TestDownloadFileWithinLimit(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAudioBytes = 1024 })
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{0}, 1024))
+	})
+	filename := filepath.Join(t.TempDir(), "source.mp3")
+	if err := downloadFile("https://api.twilio.com/recordings/RE1.mp3", filename); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filename); err != nil || len(data) != 1024 {
+		t.Errorf("Downloaded %d bytes (%v), want 1024", len(data), err)
+	}
+}
+
+func TestPostAudioFallsBackWhenTooLarge(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.ChunkRecordings, c.RecordMaxLength, c.ChunkSeconds = true, 120, 30
+		c.MaxAudioBytes = 1024
+	})
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write(bytes.Repeat([]byte{0}, 4096))
+			return
+		}
+		streamHandler(7)(w, r)
+	})
+	captureLog(t)
+	err := postRecording(t, "https://api.twilio.com/recordings/RE1.mp3", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := fake.RequestsTo("/streams/7/chunks")
+	if len(chunks) != 1 || chunks[0].Form().Get("audio_url") != "https://api.twilio.com/recordings/RE1.mp3" {
+		t.Errorf("postAudio() posted %v, want the whole recording by URL", chunks)
+	}
+}
+
+// useDownloadLimits sets the download timeout and how many downloads may run at once.
+func useDownloadLimits(t *testing.T, timeout time.Duration, max int) {
+	t.Helper()
+	savedTimeout, savedLimiter := downloadClient.Timeout, downloadLimiter
+	downloadClient.Timeout, downloadLimiter = timeout, nil
+	if max > 0 {
+		downloadLimiter = newConcurrencyLimiter(max)
+	}
+	t.Cleanup(func() {
+		downloadClient.Timeout, downloadLimiter = savedTimeout, savedLimiter
+	})
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	useDownloadLimits(t, 50*time.Millisecond, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+	start := time.Now()
+	err := downloadFile(server.URL+"/recordings/RE1.mp3", filepath.Join(t.TempDir(), "source.mp3"))
+	if err == nil {
+		t.Fatal("downloadFile() succeeded, want it to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("downloadFile() took %s, want it to give up after 50ms", elapsed)
+	}
+}
+
+func TestDownloadsBounded(t *testing.T) {
+	useDownloadLimits(t, time.Minute, 2)
+	var running, most int32
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			seen := atomic.LoadInt32(&most)
+			if n <= seen || atomic.CompareAndSwapInt32(&most, seen, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("audio"))
+	})
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := downloadFile("https://api.twilio.com/recordings/RE1.mp3", filepath.Join(dir, fmt.Sprintf("source%d.mp3", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Errorf("Up to %d downloads ran at once, want 2", most)
+	}
+}
+
+func TestUploadUsesDownloadClient(t *testing.T) {
+	interceptHTTP(t, streamHandler(7))
+	uploads := &fakeHTTP{handler: streamHandler(7)}
+	saved := downloadClient.Transport
+	downloadClient.Transport = uploads
+	t.Cleanup(func() {
+		downloadClient.Transport = saved
+	})
+	filename := filepath.Join(t.TempDir(), "segment000.mp3")
+	if err := ioutil.WriteFile(filename, []byte("audio"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := postAudioFile(Backend{AccessToken: "token", apiURL: apiURL}, 42, 7, filename, url.Values{}); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := uploads.RequestsTo("/streams/7/chunks"); len(chunks) != 1 {
+		t.Errorf("Upload made %d chunk requests with the download timeout, want 1", len(chunks))
+	}
+}
+
+func TestDownloadOutsideDeliverySlot(t *testing.T) {
+	useDeliveryLimiter(t, 1)
+	useDownloadLimits(t, time.Minute, 0)
+	setConfig(t, func(c *Config) {
+		c.StreamMap = map[string]StreamTarget{"+14155550100": {StreamId: 7, AccountId: 42}}
+		c.TranscodeURL = "https://transcoder.example.com/opus"
+	})
+	captureLog(t)
+	downloading, unblock := make(chan struct{}), make(chan struct{})
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/RE1") {
+			close(downloading)
+			<-unblock
+		}
+		transcodeAPI(w, r)
+	})
+	slow := make(chan error, 1)
+	go func() {
+		slow <- deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, false)
+	}()
+	<-downloading
+	fast := make(chan error, 1)
+	go func() {
+		fast <- deliverVoicemail(PendingVoicemail{From: "+14155550102", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE2"}, false)
+	}()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Errorf("deliverVoicemail() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("A slow download held up another delivery")
+	}
+	close(unblock)
+	if err := <-slow; err != nil {
+		t.Errorf("deliverVoicemail() = %v", err)
+	}
+}
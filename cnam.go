@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// callerNames caches caller name lookups, since each one costs money.
+var callerNames *lruCache
+
+// lruCache is a bounded map of strings that expire after a fixed time. Once full, the
+// least recently used entry is evicted first.
+type lruCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key, value string
+	expires    time.Time
+}
+
+func newLRUCache(ttl time.Duration, max int) *lruCache {
+	return &lruCache{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the cached value for the key, if it hasn't expired.
+func (c *lruCache) Get(key string) (value string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// Set caches the value for the key, evicting the least recently used entry if the
+// cache is full.
+func (c *lruCache) Set(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	for c.order.Len() >= c.max && c.order.Len() > 0 {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value, expires})
+}
+
+// lookupCallerName returns the caller name registered for the number, or an empty
+// string if none is known. Results (including unknown names) are cached.
+func lookupCallerName(number string) (string, error) {
+	if name, ok := callerNames.Get(number); ok {
+		callerNameLookups.Add("hit", 1)
+		return name, nil
+	}
+	callerNameLookups.Add("miss", 1)
+	if config.LocalDev {
+		return "", nil
+	}
+	req, err := http.NewRequest("GET", "https://lookups.twilio.com/v1/PhoneNumbers/"+url.PathEscape(number)+"?Type=caller-name", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(TwilioKeySid, TwilioKeySecret)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", twilioStatusError("caller name lookup", resp)
+	}
+	var result struct {
+		CallerName struct {
+			CallerName string `json:"caller_name"`
+		} `json:"caller_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	name := callerName(result.CallerName.CallerName)
+	callerNames.Set(number, name)
+	return name, nil
+}
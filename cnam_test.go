@@ -0,0 +1,146 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLookupCallerNameTwilioError(t *testing.T) {
+	callerNames = newLRUCache(time.Minute, 10)
+	defer func() { callerNames = nil }()
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"code": 20404, "message": "The requested resource was not found", "more_info": "https://www.twilio.com/docs/errors/20404", "status": 404}`)
+	})
+	_, err := lookupCallerName("+14155550100")
+	if err == nil || !strings.Contains(err.Error(), "20404") {
+		t.Errorf("lookupCallerName() error = %v, want the Twilio error", err)
+	}
+}
+
+func TestLRUCacheHitAndMiss(t *testing.T) {
+	cache := newLRUCache(time.Minute, 10)
+	if _, ok := cache.Get("+14155550100"); ok {
+		t.Error("Get() of a number never set hit")
+	}
+	cache.Set("+14155550100", "JANE DOE")
+	cache.Set("+14155550101", "")
+	if name, ok := cache.Get("+14155550100"); !ok || name != "JANE DOE" {
+		t.Errorf("Get() = %q, %t, want JANE DOE", name, ok)
+	}
+	// Unknown names are cached too, so they aren't looked up again.
+	if name, ok := cache.Get("+14155550101"); !ok || name != "" {
+		t.Errorf("Get() of an unknown name = %q, %t, want a hit", name, ok)
+	}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	cache := newLRUCache(time.Minute, 2)
+	cache.Set("a", "1")
+	cache.Set("b", "2")
+	// Using a makes b the least recently used.
+	cache.Get("a")
+	cache.Set("c", "3")
+	if _, ok := cache.Get("b"); ok {
+		t.Error("b is still cached, want it evicted as the least recently used")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%s was evicted, want it kept", key)
+		}
+	}
+	// Updating an entry doesn't evict anything.
+	cache.Set("a", "4")
+	if value, ok := cache.Get("a"); !ok || value != "4" {
+		t.Errorf("Get(a) = %q, %t, want the new value", value, ok)
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Error("Updating a evicted c")
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	cache := newLRUCache(20*time.Millisecond, 10)
+	cache.Set("+14155550100", "JANE DOE")
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.Get("+14155550100"); ok {
+		t.Error("Get() hit after the TTL passed")
+	}
+	if len(cache.entries) != 0 || cache.order.Len() != 0 {
+		t.Errorf("Cache holds %d entries after expiry, want none", len(cache.entries))
+	}
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	cache := newLRUCache(time.Minute, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprint((i * j) % 80)
+				cache.Set(key, key)
+				if value, ok := cache.Get(key); ok && value != key {
+					t.Errorf("Get(%s) = %q", key, value)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(cache.entries) > 50 || cache.order.Len() != len(cache.entries) {
+		t.Errorf("Cache holds %d entries (%d in order), want at most 50", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestLookupCallerNameCached(t *testing.T) {
+	callerNames = newLRUCache(time.Minute, 10)
+	defer func() { callerNames = nil }()
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"caller_name": {"caller_name": "JANE DOE", "caller_type": "CONSUMER"}}`)
+	})
+	hits, misses := lookupCount("hit"), lookupCount("miss")
+	for i := 0; i < 3; i++ {
+		name, err := lookupCallerName("+14155550101")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "" {
+			t.Error("lookupCallerName() returned no name")
+		}
+	}
+	if lookups := fake.RequestsTo("/PhoneNumbers/"); len(lookups) != 1 {
+		t.Errorf("Made %d paid lookups, want 1", len(lookups))
+	}
+	if got := lookupCount("miss") - misses; got != 1 {
+		t.Errorf("Counted %d misses, want 1", got)
+	}
+	if got := lookupCount("hit") - hits; got != 2 {
+		t.Errorf("Counted %d hits, want 2", got)
+	}
+}
+
+func TestLookupCallerNameErrorNotCached(t *testing.T) {
+	callerNames = newLRUCache(time.Minute, 10)
+	defer func() { callerNames = nil }()
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	})
+	lookupCallerName("+14155550101")
+	if _, ok := callerNames.Get("+14155550101"); ok {
+		t.Error("A failed lookup was cached")
+	}
+}
+
+func lookupCount(kind string) int64 {
+	count, ok := callerNameLookups.Get(kind).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
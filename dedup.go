@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentSet remembers recently seen strings for a fixed window. It is bounded in
+// size; once full, the oldest entries are forgotten first.
+type recentSet struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	max   int
+	seen  map[string]time.Time
+	order []string
+}
+
+func newRecentSet(ttl time.Duration, max int) *recentSet {
+	return &recentSet{
+		ttl:  ttl,
+		max:  max,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// CheckAndAdd returns true if key was already seen within the window. Otherwise it
+// records the key and returns false.
+func (s *recentSet) CheckAndAdd(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(now)
+	if _, ok := s.seen[key]; ok {
+		return true
+	}
+	for len(s.order) >= s.max && len(s.order) > 0 {
+		s.evictOldest()
+	}
+	s.seen[key] = now
+	s.order = append(s.order, key)
+	return false
+}
+
+// Remove forgets key, so that it's no longer considered seen.
+func (s *recentSet) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[key]; !ok {
+		return
+	}
+	delete(s.seen, key)
+	for i, candidate := range s.order {
+		if candidate == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// expire drops entries older than the window. Entries are appended in time order so
+// only the front of the queue needs to be inspected.
+func (s *recentSet) expire(now time.Time) {
+	for len(s.order) > 0 {
+		key := s.order[0]
+		if now.Sub(s.seen[key]) < s.ttl {
+			return
+		}
+		s.evictOldest()
+	}
+}
+
+func (s *recentSet) evictOldest() {
+	key := s.order[0]
+	s.order = s.order[1:]
+	delete(s.seen, key)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecentSetSuppressesDuplicates(t *testing.T) {
+	s := newRecentSet(time.Minute, 100)
+	if s.CheckAndAdd("RE1") {
+		t.Error("CheckAndAdd(RE1) = true the first time")
+	}
+	if !s.CheckAndAdd("RE1") {
+		t.Error("CheckAndAdd(RE1) = false for a duplicate within the window")
+	}
+	if s.CheckAndAdd("RE2") {
+		t.Error("CheckAndAdd(RE2) = true for another SID")
+	}
+}
+
+func TestRecentSetExpires(t *testing.T) {
+	s := newRecentSet(10*time.Millisecond, 100)
+	s.CheckAndAdd("RE1")
+	time.Sleep(20 * time.Millisecond)
+	if s.CheckAndAdd("RE1") {
+		t.Error("CheckAndAdd(RE1) = true after the window passed")
+	}
+}
+
+func TestRecentSetIsBounded(t *testing.T) {
+	s := newRecentSet(time.Minute, 2)
+	s.CheckAndAdd("RE1")
+	s.CheckAndAdd("RE2")
+	s.CheckAndAdd("RE3")
+	if len(s.seen) != 2 || len(s.order) != 2 {
+		t.Errorf("recentSet holds %d entries, want 2", len(s.seen))
+	}
+	if s.CheckAndAdd("RE1") {
+		t.Error("CheckAndAdd(RE1) = true after it was evicted")
+	}
+	if !s.CheckAndAdd("RE3") {
+		t.Error("CheckAndAdd(RE3) = false for the newest entry")
+	}
+}
+
+func TestRecentSetConcurrentDuplicates(t *testing.T) {
+	s := newRecentSet(time.Minute, 100)
+	var firsts int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !s.CheckAndAdd("RE1") {
+				atomic.AddInt32(&firsts, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if firsts != 1 {
+		t.Errorf("%d concurrent callbacks were let through, want 1", firsts)
+	}
+}
+
+func TestRecentSetRemove(t *testing.T) {
+	s := newRecentSet(time.Minute, 10)
+	s.CheckAndAdd("RE1")
+	s.CheckAndAdd("RE2")
+	s.Remove("RE1")
+	s.Remove("RE3")
+	if s.CheckAndAdd("RE1") {
+		t.Error("RE1 is still seen after Remove()")
+	}
+	if !s.CheckAndAdd("RE2") {
+		t.Error("RE2 was forgotten after removing RE1")
+	}
+	if len(s.order) != len(s.seen) {
+		t.Errorf("Set has %d entries in order but %d seen", len(s.order), len(s.seen))
+	}
+}
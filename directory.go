@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"text/template"
+)
+
+var directoryTemplate = template.Must(template.New("directory").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Gather finishOnKey="#" timeout="5" method="GET" action="{{xml .Action}}">
+		<Say>{{xml .Prompt}}</Say>
+	</Gather>
+	<Redirect method="GET">{{xml .Action}}</Redirect>
+</Response>`))
+
+// directoryResponse asks the caller for the extension of the person they're calling.
+// The answer comes back to path as a GET request with the Digits parameter set.
+func directoryResponse(path string) []byte {
+	var buf bytes.Buffer
+	err := directoryTemplate.Execute(&buf, struct{ Action, Prompt string }{
+		Action: path + "?directory=1",
+		Prompt: config.DirectoryPrompt,
+	})
+	if err != nil {
+		log.Printf("Failed to render directory response: %v", err)
+		return response
+	}
+	return buf.Bytes()
+}
+
+// directoryRecipient returns the identity to deliver to for the extension the caller
+// entered, falling back to DirectoryDefault (or the number they called) if there's no
+// such extension.
+func directoryRecipient(extension, to string) string {
+	if identity, ok := config.Directory[extension]; ok {
+		return identity
+	}
+	if config.DirectoryDefault != "" {
+		return config.DirectoryDefault
+	}
+	return to
+}
+
+// recordActionURL returns the <Record> action for a call to the extension, so that
+// the recording is delivered to the right person.
+func recordActionURL(path, extension string) string {
+	action := config.RecordAction
+	if action == "" {
+		action = path
+	}
+	return addQuery(action, "extension", extension)
+}
+
+// addQuery sets a query parameter on a URL, returning the URL unchanged if it's
+// invalid.
+func addQuery(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var recordActionPattern = regexp.MustCompile(`<Record[^>]* action="([^"]*)"`)
+
+// recordAction returns the action of the <Record> element in the TwiML.
+func recordAction(t *testing.T, twiml string) string {
+	t.Helper()
+	match := recordActionPattern.FindStringSubmatch(twiml)
+	if match == nil {
+		t.Fatalf("TwiML has no <Record> action: %s", twiml)
+	}
+	return html.UnescapeString(match[1])
+}
+
+func useDirectory(t *testing.T, update func(c *Config)) *fakeHTTP {
+	t.Helper()
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.Directory = map[string]string{"101": "+14155550111", "102": "+14155550112"}
+		update(c)
+	})
+	putIdentity(t, "+14155550100", 42)
+	putIdentity(t, "+14155550111", 43)
+	putIdentity(t, "+14155550112", 44)
+	putIdentity(t, "+14155550199", 45)
+	captureLog(t)
+	return interceptHTTP(t, streamHandler(7, 99))
+}
+
+// recordThroughDirectory calls in, enters the extension and posts a recording to the
+// <Record> action. It returns the account the voicemail was delivered on behalf of.
+func recordThroughDirectory(t *testing.T, fake *fakeHTTP, extension string) string {
+	t.Helper()
+	call := url.Values{"CallSid": {"CA1"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}
+	query := url.Values{"directory": {"1"}, "Digits": {extension}}
+	for key, values := range call {
+		query[key] = values
+	}
+	action := recordAction(t, getCall(query).Body.String())
+	form := url.Values{"RecordingUrl": {"https://api.twilio.com/recordings/RE1"}, "RecordingSid": {"RE1"}}
+	for key, values := range call {
+		form[key] = values
+	}
+	postForm(callHandler, action, form)
+	streams := fake.RequestsTo("/streams")
+	if len(streams) == 0 {
+		t.Fatal("Voicemail wasn't delivered")
+	}
+	return streams[0].URL.Query().Get("on_behalf_of")
+}
+
+func TestDirectoryPrompt(t *testing.T) {
+	useDirectory(t, func(c *Config) {})
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if !strings.Contains(body, `<Gather finishOnKey="#"`) || !strings.Contains(body, `action="/v1/call?directory=1"`) {
+		t.Errorf("Call got %s, want the directory prompt", body)
+	}
+	if strings.Contains(body, "<Record") {
+		t.Errorf("Call was recorded before the caller entered an extension: %s", body)
+	}
+}
+
+func TestDirectoryValidExtension(t *testing.T) {
+	fake := useDirectory(t, func(c *Config) {})
+	if account := recordThroughDirectory(t, fake, "102"); account != "44" {
+		t.Errorf("Voicemail for extension 102 was delivered to account %s, want 44", account)
+	}
+}
+
+func TestDirectoryInvalidExtension(t *testing.T) {
+	fake := useDirectory(t, func(c *Config) {
+		c.DirectoryDefault = "+14155550199"
+	})
+	if account := recordThroughDirectory(t, fake, "999"); account != "45" {
+		t.Errorf("Voicemail for an unknown extension was delivered to account %s, want the default 45", account)
+	}
+}
+
+func TestDirectoryInvalidExtensionWithoutDefault(t *testing.T) {
+	fake := useDirectory(t, func(c *Config) {})
+	if account := recordThroughDirectory(t, fake, ""); account != "42" {
+		t.Errorf("Voicemail without an extension was delivered to account %s, want the number called", account)
+	}
+}
+
+func TestDirectoryValidated(t *testing.T) {
+	for _, directory := range []map[string]string{{"": "+14155550111"}, {"101": ""}} {
+		c := config
+		c.Directory = directory
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() accepted Directory %v", directory)
+		}
+	}
+	c := config
+	c.Directory, c.DirectoryPrompt = map[string]string{"101": "+14155550111"}, ""
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() accepted a Directory without a DirectoryPrompt")
+	}
+}
+
+var gatherActionPattern = regexp.MustCompile(`<Gather[^>]* action="([^"]*)"`)
+
+func TestRerecordKeepsExtension(t *testing.T) {
+	fake := useDirectory(t, func(c *Config) {
+		c.AllowRerecord = true
+	})
+	call := url.Values{"CallSid": {"CA1"}, "CallStatus": {"in-progress"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}
+	query := url.Values{"directory": {"1"}, "Digits": {"102"}}
+	for key, values := range call {
+		query[key] = values
+	}
+	action := recordAction(t, getCall(query).Body.String())
+	record := func(action, sid string) string {
+		form := url.Values{"RecordingUrl": {"https://api.twilio.com/recordings/" + sid}, "RecordingSid": {sid}}
+		for key, values := range call {
+			form[key] = values
+		}
+		body := postForm(callHandler, action, form).Body.String()
+		match := gatherActionPattern.FindStringSubmatch(body)
+		if match == nil {
+			t.Fatalf("Recording got %s, want the caller asked to confirm", body)
+		}
+		return html.UnescapeString(match[1])
+	}
+	confirm := func(action, digits string) string {
+		form := url.Values{"Digits": {digits}}
+		for key, values := range call {
+			form[key] = values
+		}
+		return postForm(callHandler, action, form).Body.String()
+	}
+	confirmAction := record(action, "RE1")
+	if !strings.Contains(confirmAction, "extension=102") || !strings.Contains(confirmAction, "confirm=1") {
+		t.Fatalf("Confirm action %q lost the extension", confirmAction)
+	}
+	action = recordAction(t, confirm(confirmAction, "2"))
+	if !strings.Contains(action, "extension=102") {
+		t.Fatalf("Record action %q for recording again lost the extension", action)
+	}
+	confirm(record(action, "RE2"), "1")
+	streams := fake.RequestsTo("/streams")
+	if len(streams) == 0 {
+		t.Fatal("Voicemail wasn't delivered")
+	}
+	if account := streams[0].URL.Query().Get("on_behalf_of"); account != "44" {
+		t.Errorf("Recorded again voicemail for extension 102 was delivered to account %s, want 44", account)
+	}
+}
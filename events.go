@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events buffered for each subscriber before further events are dropped for it.
+const EventBufferSize = 64
+
+// Event is a step in a voicemail's delivery, sent to /v1/events subscribers.
+type Event struct {
+	Type string `json:"type"`
+	// Outcome is the detailed outcome of a delivery, e.g. "shed" for a failure.
+	Outcome  string    `json:"outcome,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Duration int       `json:"duration,omitempty"`
+	Pending  int64     `json:"pending_id,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var events = struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+}{subscribers: make(map[chan Event]struct{})}
+
+// publishEvent sends an event to every subscriber. Subscribers that aren't keeping
+// up miss the event rather than holding up delivery.
+func publishEvent(event Event) {
+	event.Time = time.Now()
+	events.Lock()
+	defer events.Unlock()
+	for ch := range events.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func subscribeEvents() chan Event {
+	ch := make(chan Event, EventBufferSize)
+	events.Lock()
+	events.subscribers[ch] = struct{}{}
+	events.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan Event) {
+	events.Lock()
+	delete(events.subscribers, ch)
+	events.Unlock()
+}
+
+// closeEventStreams closes every subscriber's channel, which ends their streams, so
+// that they don't hold up shutdown.
+func closeEventStreams() {
+	events.Lock()
+	defer events.Unlock()
+	for ch := range events.subscribers {
+		delete(events.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler streams delivery events as server-sent events until the client
+// disconnects or the service shuts down.
+// Handles GET /v1/events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if isDraining() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	log.Printf("Events subscriber connected from %s", r.RemoteAddr)
+	// Comments keep proxies from closing the connection.
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				// The service is shutting down.
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			log.Printf("Events subscriber from %s disconnected", r.RemoteAddr)
+			return
+		}
+		flusher.Flush()
+	}
+}
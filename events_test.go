@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func subscriberCount() int {
+	events.Lock()
+	defer events.Unlock()
+	return len(events.subscribers)
+}
+
+// subscribe connects to /v1/events and returns the events it receives. The client
+// is subscribed once this returns.
+func subscribe(t *testing.T) (received chan Event, disconnect func()) {
+	t.Helper()
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	server := httptest.NewServer(requireAdmin(eventsHandler))
+	t.Cleanup(server.Close)
+	reqCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequest("GET", server.URL+"/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(reqCtx)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /v1/events returned %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	received = make(chan Event, 10)
+	go func() {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		var kind string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				kind = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				var event Event
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil || event.Type != kind {
+					t.Errorf("Received malformed event %q (%v)", line, err)
+				}
+				received <- event
+			}
+		}
+	}()
+	return received, cancel
+}
+
+func nextEvent(t *testing.T, received chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-received:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("No event received")
+		return Event{}
+	}
+}
+
+func TestEventsReceived(t *testing.T) {
+	captureLog(t)
+	received, _ := subscribe(t)
+	publishEvent(Event{Type: "queued", From: "+14155550101", To: "+14155550100", Pending: 7})
+	if event := nextEvent(t, received); event.Type != "queued" || event.To != "+14155550100" || event.Pending != 7 || event.Time.IsZero() {
+		t.Errorf("Received %+v, want the queued event", event)
+	}
+}
+
+func TestEventsForDelivery(t *testing.T) {
+	useDatastore(t)
+	putIdentity(t, "+14155550100", 42)
+	captureLog(t)
+	received, _ := subscribe(t)
+	interceptHTTP(t, streamHandler(7, 99))
+	postRecordingAction("RE1")
+	if event := nextEvent(t, received); event.Type != "received" || event.From != "+14155550101" {
+		t.Errorf("First event is %+v, want the recording received", event)
+	}
+	if event := nextEvent(t, received); event.Type != "delivered" || event.To != "+14155550100" {
+		t.Errorf("Second event is %+v, want the voicemail delivered", event)
+	}
+}
+
+func TestEventsDroppedForSlowSubscribers(t *testing.T) {
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < EventBufferSize*2; i++ {
+			publishEvent(Event{Type: "failed"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishEvent() blocked on a subscriber that isn't reading")
+	}
+	if len(ch) != EventBufferSize {
+		t.Errorf("Subscriber has %d events buffered, want %d", len(ch), EventBufferSize)
+	}
+}
+
+func TestEventsUnsubscribeOnDisconnect(t *testing.T) {
+	captureLog(t)
+	before := subscriberCount()
+	_, disconnect := subscribe(t)
+	if subscriberCount() != before+1 {
+		t.Fatalf("%d subscribers after connecting, want %d", subscriberCount(), before+1)
+	}
+	disconnect()
+	for deadline := time.Now().Add(time.Second); subscriberCount() != before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers after disconnecting, want %d", subscriberCount(), before)
+		}
+	}
+}
+
+func TestEventsHandlerMethod(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	if rec := adminRequest(eventsHandler, "POST", "/v1/events", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /v1/events returned %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
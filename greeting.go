@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Greeting is a recipient's voicemail greeting, as configured in the Roger app.
+type Greeting struct {
+	AudioURL string `json:"audio_url"`
+	Text     string `json:"text"`
+}
+
+var (
+	// Caches greetings as JSON by recipient. Recipients without a greeting are cached
+	// as an empty string.
+	greetings *lruCache
+	// Remembers whether greeting audio URLs are too long to play, by URL.
+	greetingLengths = newLRUCache(time.Hour, 1000)
+)
+
+// getGreeting returns the recipient's greeting, or nil if they don't have one (or
+// don't have an account). Results are cached briefly.
+func getGreeting(to string) (*Greeting, error) {
+	if cached, ok := greetings.Get(to); ok {
+		if cached == "" {
+			return nil, nil
+		}
+		greeting := new(Greeting)
+		if err := json.Unmarshal([]byte(cached), greeting); err == nil {
+			return greeting, nil
+		}
+	}
+	greeting, err := fetchGreeting(to)
+	if err != nil {
+		return nil, err
+	}
+	var cached string
+	if greeting != nil {
+		data, err := json.Marshal(greeting)
+		if err != nil {
+			return nil, err
+		}
+		cached = string(data)
+	}
+	greetings.Set(to, cached)
+	return greeting, nil
+}
+
+func fetchGreeting(to string) (*Greeting, error) {
+	if config.LocalDev {
+		return nil, nil
+	}
+	// Unlike getIdentityPair, report Datastore failures so that they get logged before
+	// falling back to the default greeting.
+	toIdentity, err := getIdentity(to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %v", to, err)
+	}
+	if toIdentity == nil || toIdentity.Available {
+		return nil, nil
+	}
+	ref, err := url.Parse(config.GreetingPath)
+	if err != nil {
+		return nil, err
+	}
+	backend := backendFor(to)
+	greetingURL := backend.apiURL.ResolveReference(ref)
+	greetingURL.RawQuery = url.Values{
+		"on_behalf_of": {strconv.FormatInt(toIdentity.Account.ID, 10)},
+	}.Encode()
+	req, err := http.NewRequest("GET", greetingURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", backend.AccessToken))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s (on behalf of %d) returned %s", req.URL.Path, toIdentity.Account.ID, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	greeting := new(Greeting)
+	if err := json.Unmarshal(body, greeting); err != nil {
+		return nil, fmt.Errorf("%s returned invalid JSON (%v): %q", req.URL.Path, err, snippet(body))
+	}
+	if greeting.AudioURL != "" && config.MaxGreetingSeconds > 0 && isGreetingTooLong(greeting.AudioURL) {
+		log.Printf("Not playing greeting of %s, it's longer than %ds: %s", to, config.MaxGreetingSeconds, greeting.AudioURL)
+		greeting.AudioURL = ""
+	}
+	if greeting.AudioURL == "" && greeting.Text == "" {
+		return nil, nil
+	}
+	return greeting, nil
+}
+
+// isGreetingTooLong estimates the length of the greeting audio from its size. Audio
+// of unknown size is assumed to be short enough.
+func isGreetingTooLong(audioURL string) bool {
+	if result, ok := greetingLengths.Get(audioURL); ok {
+		return result == "long"
+	}
+	resp, err := httpClient.Head(audioURL)
+	if err != nil {
+		log.Printf("Failed to check greeting length of %s: %v", audioURL, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength < 0 {
+		return false
+	}
+	seconds := resp.ContentLength / int64(config.GreetingBytesPerSecond)
+	result := "ok"
+	if seconds > int64(config.MaxGreetingSeconds) {
+		result = "long"
+	}
+	greetingLengths.Set(audioURL, result)
+	return result == "long"
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useGreetings enables FetchGreetings with an empty greeting cache of the given size.
+func useGreetings(t *testing.T, size int) {
+	t.Helper()
+	setConfig(t, func(c *Config) {
+		c.FetchGreetings, c.GreetingPath, c.GreetingCacheSize = true, "greeting", size
+	})
+	saved := greetings
+	greetings = newLRUCache(time.Duration(config.GreetingCacheSeconds)*time.Second, size)
+	t.Cleanup(func() {
+		greetings = saved
+	})
+}
+
+// greetingHandler serves the greeting JSON for GET /greeting and streams otherwise.
+func greetingHandler(greeting string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/greeting") {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, greeting)
+			return
+		}
+		streamHandler(7)(w, r)
+	}
+}
+
+func TestGreetingFromAPI(t *testing.T) {
+	useDatastore(t)
+	useGreetings(t, 10)
+	putIdentity(t, "+14155550100", 42)
+	fake := interceptHTTP(t, greetingHandler(`{"audio_url": "https://cdn.example.com/greeting.mp3?a=1&b=2"}`))
+	query := url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}
+	body := getCall(query).Body.String()
+	if !strings.Contains(body, "<Play>https://cdn.example.com/greeting.mp3?a=1&amp;b=2</Play>") {
+		t.Errorf("Call got %q, want the recipient's greeting", body)
+	}
+	requests := fake.RequestsTo("/greeting")
+	if len(requests) != 1 || requests[0].URL.Query().Get("on_behalf_of") != "42" {
+		t.Fatalf("Greeting requests %v, want one on behalf of 42", requests)
+	}
+	// The greeting is cached.
+	getCall(query)
+	if requests := fake.RequestsTo("/greeting"); len(requests) != 1 {
+		t.Errorf("Greeting was fetched %d times, want once", len(requests))
+	}
+}
+
+func TestTextGreetingFromAPI(t *testing.T) {
+	useDatastore(t)
+	useGreetings(t, 10)
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, greetingHandler(`{"text": "Hi, it's Alice & Bob."}`))
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if !strings.Contains(body, "<Say>Hi, it&#39;s Alice &amp; Bob.</Say>") {
+		t.Errorf("Call got %q, want the recipient's text greeting", body)
+	}
+}
+
+func TestGreetingFallsBackToDefault(t *testing.T) {
+	useDatastore(t)
+	useGreetings(t, 10)
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	})
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if !strings.Contains(body, "<Say>Please leave a message after the tone.</Say>") {
+		t.Errorf("Call got %q while the API is down, want the default greeting", body)
+	}
+	// Recipients without an account don't have a greeting.
+	body = getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550102"}}).Body.String()
+	if !strings.Contains(body, "<Say>Please leave a message after the tone.</Say>") {
+		t.Errorf("Call for a recipient without an account got %q, want the default greeting", body)
+	}
+}
+
+func TestGreetingCacheBounded(t *testing.T) {
+	useDatastore(t)
+	useGreetings(t, 2)
+	for _, number := range []string{"+14155550100", "+14155550101", "+14155550102"} {
+		putIdentity(t, number, 42)
+	}
+	fake := interceptHTTP(t, greetingHandler(`{"text": "Hello"}`))
+	for _, number := range []string{"+14155550100", "+14155550101", "+14155550102", "+14155550100"} {
+		if _, err := getGreeting(number); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first recipient was evicted to make room for the third.
+	if requests := fake.RequestsTo("/greeting"); len(requests) != 4 {
+		t.Errorf("Greetings were fetched %d times, want 4", len(requests))
+	}
+	if n := len(greetings.entries); n > 2 {
+		t.Errorf("Greeting cache has %d entries, want at most 2", n)
+	}
+}
+
+func TestGreetingDatastoreFailure(t *testing.T) {
+	useDatastore(t)
+	useGreetings(t, 10)
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, greetingHandler(`{"text": "Hello"}`))
+	logs := captureLog(t)
+	failDatastore(t)
+	rec := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("Call got %d while Datastore is down, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "<Say>Please leave a message after the tone.</Say>") || !strings.Contains(body, "<Record") {
+		t.Errorf("Call got %q while Datastore is down, want the default greeting", body)
+	}
+	if !strings.Contains(logs.String(), "Failed to get greeting for +14155550100") {
+		t.Errorf("Datastore failure wasn't logged:\n%s", logs)
+	}
+}
+
+var skipActionPattern = regexp.MustCompile(`<Gather numDigits="1"[^>]* action="([^"]*)"`)
+
+func useSkipGreeting(t *testing.T) {
+	t.Helper()
+	setConfig(t, func(c *Config) { c.SkipGreetingKey = "0" })
+}
+
+func TestSkipGreetingGather(t *testing.T) {
+	useSkipGreeting(t)
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	match := skipActionPattern.FindStringSubmatch(body)
+	if match == nil || !strings.Contains(html.UnescapeString(match[1]), "skip=1") {
+		t.Fatalf("Call got %s, want the greeting in a <Gather> that skips it", body)
+	}
+	if !strings.Contains(body, "<Say>Please leave a message after the tone.</Say>") || !strings.Contains(body, "<Record") {
+		t.Errorf("Call got %s, want the greeting then the recording", body)
+	}
+}
+
+func TestSkipGreeting(t *testing.T) {
+	useSkipGreeting(t)
+	// Any key cuts the greeting short, not just SkipGreetingKey.
+	for _, digits := range []string{"0", "5"} {
+		body := getCall(url.Values{"skip": {"1"}, "Digits": {digits}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+		if strings.Contains(body, "<Gather") || strings.Contains(body, "<Say>Please leave") {
+			t.Errorf("Call after pressing %s got %s, want the greeting skipped", digits, body)
+		}
+		if !strings.Contains(body, "<Record") {
+			t.Errorf("Call after pressing %s got %s, want the recording", digits, body)
+		}
+	}
+}
+
+func TestSkipGreetingOffByDefault(t *testing.T) {
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if strings.Contains(body, "<Gather") {
+		t.Errorf("Call got %s, want no <Gather> without SkipGreetingKey", body)
+	}
+}
+
+func TestSkipGreetingKeepsExtension(t *testing.T) {
+	useDirectory(t, func(c *Config) { c.SkipGreetingKey = "0" })
+	body := getCall(url.Values{"directory": {"1"}, "Digits": {"102"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	match := skipActionPattern.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("Call got %s, want the greeting in a <Gather>", body)
+	}
+	action, err := url.Parse(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := action.Query(); q.Get("skip") != "1" || q.Get("directory") != "1" || q.Get("extension") != "102" {
+		t.Errorf("Skip action is %s, want it to keep extension 102", action)
+	}
+	body = getCall(url.Values{"skip": {"1"}, "directory": {"1"}, "extension": {"102"}, "Digits": {"0"}, "From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if got := recordAction(t, body); !strings.Contains(got, "extension=102") {
+		t.Errorf("Record action after skipping is %s, want extension 102", got)
+	}
+}
+
+func TestSkipGreetingKeyValidated(t *testing.T) {
+	for _, key := range []string{"ab", "x"} {
+		c := config
+		c.SkipGreetingKey = key
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() accepted SkipGreetingKey %q", key)
+		}
+	}
+}
+
+// useMaxGreetingLength limits greetings to 10 seconds at 1000 bytes per second, with
+// nothing known about greeting lengths yet.
+func useMaxGreetingLength(t *testing.T) {
+	t.Helper()
+	useDatastore(t)
+	useGreetings(t, 10)
+	setConfig(t, func(c *Config) {
+		c.MaxGreetingSeconds, c.GreetingBytesPerSecond = 10, 1000
+	})
+	saved := greetingLengths
+	greetingLengths = newLRUCache(time.Hour, 10)
+	t.Cleanup(func() {
+		greetingLengths = saved
+	})
+	putIdentity(t, "+14155550100", 42)
+}
+
+// sizedGreetingHandler serves a greeting whose audio is the given number of bytes.
+// A negative size leaves out the Content-Length.
+func sizedGreetingHandler(size int) http.HandlerFunc {
+	greeting := greetingHandler(`{"audio_url": "https://cdn.example.com/greeting.mp3"}`)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/greeting.mp3") {
+			if size >= 0 {
+				w.Header().Set("Content-Length", fmt.Sprint(size))
+			}
+			return
+		}
+		greeting(w, r)
+	}
+}
+
+func TestLongGreetingFallsBackToDefault(t *testing.T) {
+	useMaxGreetingLength(t)
+	fake := interceptHTTP(t, sizedGreetingHandler(60000))
+	logs := captureLog(t)
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if strings.Contains(body, "<Play>") || !strings.Contains(body, "<Say>Please leave a message after the tone.</Say>") {
+		t.Errorf("Call got %s, want the default greeting instead of a 60 second one", body)
+	}
+	if requests := fake.RequestsTo("/greeting.mp3"); len(requests) != 1 || requests[0].Method != "HEAD" {
+		t.Errorf("Greeting audio requests %v, want one HEAD", requests)
+	}
+	if !strings.Contains(logs.String(), "Not playing greeting of +14155550100") {
+		t.Errorf("Long greeting wasn't logged:\n%s", logs)
+	}
+}
+
+func TestShortGreetingPlayed(t *testing.T) {
+	useMaxGreetingLength(t)
+	interceptHTTP(t, sizedGreetingHandler(5000))
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if !strings.Contains(body, "<Play>https://cdn.example.com/greeting.mp3</Play>") {
+		t.Errorf("Call got %s, want the 5 second greeting played", body)
+	}
+}
+
+func TestGreetingOfUnknownLengthPlayed(t *testing.T) {
+	useMaxGreetingLength(t)
+	interceptHTTP(t, sizedGreetingHandler(-1))
+	body := getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}}).Body.String()
+	if !strings.Contains(body, "<Play>https://cdn.example.com/greeting.mp3</Play>") {
+		t.Errorf("Call got %s, want a greeting of unknown length played", body)
+	}
+}
+
+func TestGreetingLengthCached(t *testing.T) {
+	useMaxGreetingLength(t)
+	fake := interceptHTTP(t, sizedGreetingHandler(60000))
+	captureLog(t)
+	if !isGreetingTooLong("https://cdn.example.com/greeting.mp3") || !isGreetingTooLong("https://cdn.example.com/greeting.mp3") {
+		t.Error("isGreetingTooLong() = false for a 60 second greeting")
+	}
+	if requests := fake.RequestsTo("/greeting.mp3"); len(requests) != 1 {
+		t.Errorf("Greeting length was checked %d times, want once", len(requests))
+	}
+}
+
+func TestGreetingLengthNotCheckedByDefault(t *testing.T) {
+	useDatastore(t)
+	useGreetings(t, 10)
+	putIdentity(t, "+14155550100", 42)
+	fake := interceptHTTP(t, sizedGreetingHandler(60000))
+	getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}})
+	if requests := fake.RequestsTo("/greeting.mp3"); len(requests) != 0 {
+		t.Errorf("Greeting length was checked without MaxGreetingSeconds: %v", requests)
+	}
+}
+
+func TestMaxGreetingSecondsValidated(t *testing.T) {
+	c := config
+	c.MaxGreetingSeconds, c.GreetingBytesPerSecond = 10, 0
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() accepted MaxGreetingSeconds without GreetingBytesPerSecond")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// GzipMinBytes is the smallest response worth compressing.
+const GzipMinBytes = 1024
+
+// gzipResponse wraps a handler so that its responses are gzipped for clients that
+// accept it, unless they're tiny. Only meant for JSON endpoints: streaming responses
+// would be held up, and Twilio doesn't need compressed TwiML.
+func gzipResponse(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !config.CompressAdminResponses || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			handler(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.finish()
+		handler(gw, r)
+	}
+}
+
+// gzipResponseWriter holds back the response until it's big enough to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < GzipMinBytes {
+		return len(p), nil
+	}
+	header := w.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	w.writeHeader()
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gz.Write(w.buf); err != nil {
+		return 0, err
+	}
+	w.buf = nil
+	return len(p), nil
+}
+
+func (w *gzipResponseWriter) writeHeader() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// finish writes out whatever is left of the response.
+func (w *gzipResponseWriter) finish() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	w.writeHeader()
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+	}
+}
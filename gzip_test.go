@@ -0,0 +1,85 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipRequest calls a handler writing a JSON body of the given size through
+// gzipResponse, with the Accept-Encoding header if set.
+func gzipRequest(t *testing.T, size int, acceptEncoding string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	body := `"` + strings.Repeat("a", size-2) + `"`
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		// Write in pieces, like json.Encoder might.
+		w.Write([]byte(body[:size/2]))
+		w.Write([]byte(body[size/2:]))
+	}
+	req := httptest.NewRequest("GET", "/v1/calls", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	gzipResponse(handler)(rec, req)
+	return rec, body
+}
+
+func TestGzipLargeResponse(t *testing.T) {
+	setConfig(t, func(c *Config) { c.CompressAdminResponses = true })
+	rec, body := gzipRequest(t, 10*GzipMinBytes, "gzip, deflate")
+	if rec.Code != http.StatusCreated {
+		t.Errorf("Gzipped response has status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if rec.Body.Len() >= len(body) {
+		t.Errorf("Gzipped response is %d bytes, want less than %d", rec.Body.Len(), len(body))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Errorf("Gunzipped response is %d bytes, want the %d bytes written", len(data), len(body))
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+}
+
+func TestGzipSkipsSmallResponse(t *testing.T) {
+	setConfig(t, func(c *Config) { c.CompressAdminResponses = true })
+	rec, body := gzipRequest(t, 100, "gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding of a small response = %q, want none", got)
+	}
+	if rec.Code != http.StatusCreated || rec.Body.String() != body {
+		t.Errorf("Small response got %d %q, want it as written", rec.Code, rec.Body)
+	}
+}
+
+func TestGzipRequiresAcceptEncoding(t *testing.T) {
+	setConfig(t, func(c *Config) { c.CompressAdminResponses = true })
+	rec, body := gzipRequest(t, 10*GzipMinBytes, "")
+	if got := rec.Header().Get("Content-Encoding"); got != "" || rec.Body.String() != body {
+		t.Errorf("Response without Accept-Encoding has Content-Encoding %q, want it uncompressed", got)
+	}
+}
+
+func TestGzipOffByDefault(t *testing.T) {
+	rec, body := gzipRequest(t, 10*GzipMinBytes, "gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "" || rec.Body.String() != body {
+		t.Errorf("Response without CompressAdminResponses has Content-Encoding %q, want it uncompressed", got)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// concurrencyLimiter bounds how many deliveries run at once. Waiting live calls are
+// let through before waiting background work, since a caller is waiting on them.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	free   int
+	live   []chan struct{}
+	queued []chan struct{}
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	return &concurrencyLimiter{free: max}
+}
+
+// Acquire blocks until a slot is free and returns a function that frees it again.
+func (l *concurrencyLimiter) Acquire(live bool) (release func()) {
+	l.mu.Lock()
+	if l.free > 0 {
+		l.free--
+		l.mu.Unlock()
+		return l.release
+	}
+	ready := make(chan struct{})
+	if live {
+		l.live = append(l.live, ready)
+	} else {
+		l.queued = append(l.queued, ready)
+	}
+	l.mu.Unlock()
+	<-ready
+	return l.release
+}
+
+// release hands the slot to the next waiter, if any.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.live) > 0 {
+		close(l.live[0])
+		l.live = l.live[1:]
+	} else if len(l.queued) > 0 {
+		close(l.queued[0])
+		l.queued = l.queued[1:]
+	} else {
+		l.free++
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func useDeliveryLimiter(t *testing.T, max int) {
+	t.Helper()
+	setConfig(t, func(c *Config) {
+		c.MaxConcurrentDeliveries = max
+	})
+	saved := deliveryLimiter
+	deliveryLimiter = newConcurrencyLimiter(max)
+	t.Cleanup(func() {
+		deliveryLimiter = saved
+	})
+}
+
+func TestConcurrencyLimiterPrefersLive(t *testing.T) {
+	limiter := newConcurrencyLimiter(1)
+	release := limiter.Acquire(true)
+	order := make(chan string, 2)
+	var wg sync.WaitGroup
+	wait := func(name string, live bool) {
+		defer wg.Done()
+		limiter.Acquire(live)()
+		order <- name
+	}
+	wg.Add(2)
+	go wait("queued", false)
+	time.Sleep(20 * time.Millisecond)
+	go wait("live", true)
+	time.Sleep(20 * time.Millisecond)
+	release()
+	wg.Wait()
+	if first := <-order; first != "live" {
+		t.Errorf("%s delivery went first, want the waiting call let through first", first)
+	}
+}
+
+func TestDeliveriesBoundedAcrossCallsAndQueue(t *testing.T) {
+	useDeliveryLimiter(t, 2)
+	setConfig(t, func(c *Config) {
+		c.StreamMap = map[string]StreamTarget{"+14155550100": {StreamId: 7, AccountId: 42}}
+	})
+	captureLog(t)
+	var running, most int32
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			seen := atomic.LoadInt32(&most)
+			if n <= seen || atomic.CompareAndSwapInt32(&most, seen, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		streamHandler(7)(w, r)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		// Half of the deliveries are calls and half come from the pending queue.
+		go func(retrying bool) {
+			defer wg.Done()
+			voicemail := PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1.mp3"}
+			if err := deliverVoicemail(voicemail, retrying); err != nil {
+				t.Error(err)
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("%d deliveries ran at once, want at most 2", most)
+	}
+}
+
+func TestNoAccountTextOutsideDeliverySlot(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	useDeliveryLimiter(t, 1)
+	setConfig(t, func(c *Config) {
+		c.NotifyNoAccountBySMS = true
+		c.StreamMap = map[string]StreamTarget{"+14155550102": {StreamId: 7, AccountId: 42}}
+	})
+	captureLog(t)
+	texting, unblock := make(chan struct{}), make(chan struct{})
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/Messages.json") {
+			close(texting)
+			<-unblock
+			twilioSMS(false)(w, r)
+			return
+		}
+		streamHandler(7)(w, r)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1.mp3"}, false)
+	}()
+	defer func() {
+		close(unblock)
+		<-done
+	}()
+	<-texting
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550102", AudioURL: "https://api.twilio.com/recordings/RE2.mp3"}, false)
+	}()
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Errorf("deliverVoicemail() while another recipient was being texted = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Delivery waited for another recipient's text to be sent")
+	}
+}
+
+func TestMaxConcurrentDeliveriesValidated(t *testing.T) {
+	c := config
+	c.MaxConcurrentDeliveries = -1
+	if err := c.Validate(); err == nil {
+		t.Error("Validate() accepted a negative MaxConcurrentDeliveries")
+	}
+}
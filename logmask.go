@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"regexp"
+)
+
+// phoneNumberPattern matches E.164 numbers, also when URL encoded (e.g. in logged
+// query strings).
+var phoneNumberPattern = regexp.MustCompile(`(\+|%2B)([0-9]{4})[0-9]+([0-9]{4})`)
+
+// maskNumbers masks the middle digits of phone numbers, e.g. "+14155550100" becomes
+// "+1415***0100".
+func maskNumbers(text []byte) []byte {
+	return phoneNumberPattern.ReplaceAll(text, []byte("${1}${2}***${3}"))
+}
+
+// maskingWriter masks phone numbers in everything written to it. It's used as the
+// log output with LogNumberMasking, so that no log line leaks a full number.
+type maskingWriter struct {
+	w io.Writer
+}
+
+func (m *maskingWriter) Write(p []byte) (int, error) {
+	if _, err := m.w.Write(maskNumbers(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logOutput returns the writer to log to, masking phone numbers written to w if
+// LogNumberMasking is set.
+func logOutput(w io.Writer) io.Writer {
+	if !config.LogNumberMasking {
+		return w
+	}
+	return &maskingWriter{w}
+}
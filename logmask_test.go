@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMaskNumbers(t *testing.T) {
+	tests := map[string]string{
+		"Call from +14155550101":               "Call from +1415***0101",
+		"GET /v1/call?From=%2B14155550101&x=1": "GET /v1/call?From=%2B1415***0101&x=1",
+		"Stream 12345678901 of voicemail 42":   "Stream 12345678901 of voicemail 42",
+		"Short number +1234567":                "Short number +1234567",
+	}
+	for text, want := range tests {
+		if got := string(maskNumbers([]byte(text))); got != want {
+			t.Errorf("maskNumbers(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+// logNumbers makes calls that log phone numbers from callHandler, deliverVoicemail
+// and sendSMS, logging through logOutput, and returns the log.
+func logNumbers(t *testing.T, masking bool) string {
+	t.Helper()
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.LogNumberMasking = masking
+		c.TestRecipient = "+14155550199"
+		c.TestAccountId = 42
+		c.SMSCountryPrefixes = []string{"+44"}
+	})
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, streamHandler(7))
+	logs := captureLog(t)
+	log.SetOutput(logOutput(log.Writer()))
+	getCall(url.Values{"From": {"+14155550100"}, "ForwardedFrom": {"+14155550100"}})
+	deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550199", AudioURL: "https://api.twilio.com/recordings/RE1"}, false)
+	sendSMS("+14155550102", "no_account", "You have a voicemail")
+	return logs.String()
+}
+
+func TestLogNumberMasking(t *testing.T) {
+	logs := logNumbers(t, true)
+	for _, masked := range []string{"Self call from +1415***0100", "test recipient +1415***0199", "Not sending SMS to +1415***0102"} {
+		if !strings.Contains(logs, masked) {
+			t.Errorf("Log is missing %q:\n%s", masked, logs)
+		}
+	}
+	// The middle digits of every number here are 555.
+	if strings.Contains(logs, "555") {
+		t.Errorf("Log contains a full number with LogNumberMasking:\n%s", logs)
+	}
+}
+
+func TestLogNumberMaskingOffByDefault(t *testing.T) {
+	logs := logNumbers(t, false)
+	for _, number := range []string{"Self call from +14155550100", "test recipient +14155550199", "Not sending SMS to +14155550102"} {
+		if !strings.Contains(logs, number) {
+			t.Errorf("Log is missing %q without LogNumberMasking:\n%s", number, logs)
+		}
+	}
+	if strings.Contains(logs, "***") {
+		t.Errorf("Log is masked without LogNumberMasking:\n%s", logs)
+	}
+}
+
+func TestMaskingWriterReportsFullLength(t *testing.T) {
+	var buf bytes.Buffer
+	line := []byte("Call from +14155550101\n")
+	if n, err := (&maskingWriter{&buf}).Write(line); n != len(line) || err != nil {
+		t.Errorf("Write() = %d, %v, want %d, nil", n, err, len(line))
+	}
+}
@@ -1,20 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"path"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"google.golang.org/api/iterator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 const (
@@ -22,16 +31,98 @@ const (
 	TwilioFromNumber = "+14427776437"
 	TwilioKeySid     = "_REMOVED_"
 	TwilioKeySecret  = "_REMOVED_"
-	TwilioMessages   = "https://api.twilio.com/2010-04-01/Accounts/_REMOVED_/Messages"
+	TwilioAccountSid = "_REMOVED_"
+	MaxSMSAttempts   = 3
+	MaxAPIAttempts   = 3
+	// Attempts at a Datastore operation that fails because of contention.
+	MaxDatastoreAttempts = 4
+	// Twilio gives up on webhooks that take longer than this to respond.
+	TwilioWebhookTimeout = 15 * time.Second
+	// Longest recording Twilio supports, in seconds.
+	TwilioMaxRecordLength = 14400
+	// Attempts at a PendingSMS when there's no RetrySchedule.
+	MaxPendingSMSAttempts = 10
+	// How long callers of /v1/flush are asked to wait while a flush is running.
+	FlushRetryAfterSeconds = 60
 )
 
-const Response = `<?xml version="1.0" encoding="UTF-8"?>
+var responseTemplate = template.Must(template.New("response").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
 <Response>
+	{{- if not .SkippedGreeting}}
+	{{- if .GreetingPauseSeconds}}
+	<Pause length="{{.GreetingPauseSeconds}}" />
+	{{- end}}
+	{{- if .SkipAction}}
+	<Gather numDigits="1" timeout="1" method="GET" action="{{xml .SkipAction}}">
+	{{- end}}
+	{{- if .Greeting.AudioURL}}
+	<Play>{{xml .Greeting.AudioURL}}</Play>
+	{{- else if .Greeting.Text}}
+	<Say>{{xml .Greeting.Text}}</Say>
+	{{- else}}
 	<Say>Please leave a message after the tone.</Say>
-	<Record maxLength="30" />
+	{{- end}}
+	{{- if .SkipAction}}
+	</Gather>
+	{{- end}}
+	{{- end}}
+	<Record maxLength="{{.RecordMaxLength}}"
+		{{- if .RecordAction}} action="{{xml .RecordAction}}"{{end}}
+		{{- if ne .RecordingChannels "mono"}} recordingChannels="{{xml .RecordingChannels}}"{{end}}
+		{{- if .TrimSilence}} trim="trim-silence"{{else}} trim="do-not-trim"{{end}}
+		{{- if .FinishOnKey}} finishOnKey="{{xml .FinishOnKeyDigits}}"{{end}}
+		{{- if .RecordingCallbackURL}} recordingStatusCallback="{{xml .RecordingCallbackURL}}"{{end}} />
 	<Say>Sorry, no message could be recorded.</Say>
+</Response>`))
+
+const ThankYouResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Say>Thank you, your message has been sent. Goodbye.</Say>
+	<Hangup />
+</Response>`
+
+const EmptyResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response></Response>`
+
+const HangupResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Hangup />
+</Response>`
+
+const NotInServiceResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Say>Sorry, the number you have called is not in service.</Say>
+	<Hangup />
+</Response>`
+
+const AnonymousRejectedResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Say>Sorry, messages can't be left from withheld numbers.</Say>
+	<Hangup />
+</Response>`
+
+const SelfCallRejectedResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Say>Sorry, you can't leave a message for your own number.</Say>
+	<Hangup />
+</Response>`
+
+const QueueFullResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Say>Sorry, your message couldn't be delivered. Please try again later.</Say>
+	<Hangup />
+</Response>`
+
+const DrainingResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Say>Sorry, we can't take your message right now. Please try again shortly.</Say>
+	<Hangup />
 </Response>`
 
+const TestSMSText = "This is a test message from Roger Voicemail."
+
 const VoicemailText = `You have new voicemail in Roger. First, please verify your phone number to listen.
 Open Roger > Settings > Connect accounts > Add phone number.
 http://rgr.im/get`
@@ -40,252 +131,2964 @@ type Config struct {
 	ListenAddr  string
 	ProjectId   string
 	AccessToken string
+
+	// Bearer token required by the admin endpoints. Admin endpoints are disabled if empty.
+	AdminToken string
+	// Gzip the JSON responses of the admin list endpoints for clients that accept it.
+	CompressAdminResponses bool
+	// Admin actions are audit logged. The actor is taken from this request header (e.g.
+	// one set by an identity-aware proxy), if set. With AuditToDatastore, audit logs are
+	// also stored as AuditLog entities.
+	AuditActorHeader string
+	AuditToDatastore bool
+
+	// Run locally without Twilio or Roger: skip signature checks and log outgoing SMS
+	// and Roger API requests instead of making them. Also enabled by setting the
+	// VOICEMAIL_LOCAL_DEV environment variable.
+	LocalDev bool
+
+	// Datastore namespace for all entities. Empty means the default namespace.
+	DatastoreNamespace string
+	// How long to wait for Datastore to become reachable on startup.
+	StartupProbeSeconds int
+	// Make a Datastore query and connect to the Roger API before listening for calls.
+	WarmUp bool
+	// Longest we wait before retrying a request the Roger API rate limited. Zero
+	// disables retries.
+	MaxAPIRetryWaitSeconds int
+	// How long requests in flight, and then work left running in the background (such
+	// as flushes started by /v1/flush), each get to finish when shutting down.
+	ShutdownGraceSeconds int
+	// Datastore kinds of the identities (shared with the Roger API) and of our pending
+	// voicemails.
+	IdentityKind string
+	PendingKind  string
+	// Backend for pending voicemails ("datastore" or "memory").
+	PendingStore string
+	// Serve flushes from an in-memory mirror of the pending queue for this many seconds
+	// after it was last loaded, instead of querying Datastore every time. Zero disables
+	// the mirror.
+	PendingCacheSeconds int
+	// Maximum number of pending voicemails per flush (zero means all), and how many
+	// are delivered in parallel.
+	FlushBatchSize int
+	FlushWorkers   int
+	// Deliver pending voicemails between the same sender and recipient one at a time,
+	// oldest first, so a later voicemail never arrives before an earlier one.
+	FlushInOrder bool
+	// Delays before each retry of a pending voicemail (e.g. ["1m", "5m", "2h"]). Once
+	// all have been used up, the voicemail is dead-lettered. If empty, pending
+	// voicemails are retried on every flush.
+	RetrySchedule []string
+	retrySchedule []time.Duration
+
+	// Twilio auth token used to validate webhook signatures. Validation is skipped if empty.
+	TwilioAuthToken string
+	// Public base URL of this service (e.g. "https://voicemail.example.com"), used to
+	// validate webhook signatures. Derived from the request if empty.
+	PublicURL string
+
+	// Twilio REST API version and optional region/edge to route requests through.
+	TwilioAPIVersion string
+	TwilioRegion     string
+	TwilioEdge       string
+
+	// Window and capacity of the in-memory RecordingSid dedup set. A zero window
+	// disables it.
+	DedupWindowSeconds int
+	DedupMaxEntries    int
+
+	// Look up the caller's name with Twilio Lookup when Twilio doesn't pass one on.
+	// Lookups are paid, so results are cached for CallerNameCacheSeconds, for up to
+	// CallerNameCacheSize numbers.
+	LookupCallerNames      bool
+	CallerNameCacheSize    int
+	CallerNameCacheSeconds int
+
+	// Notify the recipient of a missed call when the caller hung up without recording.
+	DeliverMissedCalls bool
+
+	// Hang up instead of recording when Twilio's answering machine detection says the
+	// caller is a machine (e.g. a robocall).
+	DropMachineCalls bool
+
+	// URL that Twilio posts the finished recording to (the action attribute of <Record>).
+	// If empty, Twilio posts back to the URL that served the TwiML.
+	RecordAction string
+	// URL of the /v1/recording endpoint, if Twilio should also report recordings to
+	// the recording status callback. Recordings are only delivered once either way.
+	RecordingStatusCallback string
+
+	// Greet callers with the recipient's greeting from the Roger API, if they have one.
+	// Greetings are cached for GreetingCacheSeconds, for up to GreetingCacheSize
+	// recipients.
+	FetchGreetings       bool
+	GreetingPath         string
+	GreetingCacheSeconds int
+	GreetingCacheSize    int
+	// Silence before the greeting, so callers don't miss its first word while the call
+	// connects. Zero means no pause.
+	GreetingPauseSeconds int
+	// Play the default greeting instead of audio greetings that look longer than this,
+	// judging by their size at GreetingBytesPerSecond, so that callers don't wait ages
+	// for the beep. Zero allows any length.
+	MaxGreetingSeconds     int
+	GreetingBytesPerSecond int
+
+	// Maximum recording length in seconds.
+	RecordMaxLength int
+	// Recordings shorter than MinDurationSeconds (usually hangups) are dropped, and
+	// those longer than MaxDurationSeconds are delivered with the "over_max_duration"
+	// metadata field set. Zero disables either check.
+	MinDurationSeconds int
+	MaxDurationSeconds int
+	// Timeout for each outgoing HTTP request (Roger API, Twilio and audio downloads).
+	HTTPTimeoutSeconds int
+	// Recording channels ("mono" or "dual"). Dual-channel keeps the caller's audio on
+	// its own channel.
+	RecordingChannels string
+	// Trim leading and trailing silence from recordings.
+	TrimSilence bool
+	// Key that ends the recording: a single DTMF key, "any" or "none". Twilio's default
+	// (any key) applies if empty.
+	FinishOnKey string
+	// Key that callers can press during the greeting to skip straight to the beep.
+	// Greetings can't be skipped if empty.
+	SkipGreetingKey string
+	// After recording, ask the caller whether to send the message or record it again.
+	// Only the recording they send is delivered. Requires /v1/call-status to be set up,
+	// so that recordings are still delivered when the caller hangs up at the prompt.
+	// Can't be combined with RecordingStatusCallback.
+	AllowRerecord bool
+
+	// Rewrites applied in order to recording URLs before delivery, e.g. to serve them
+	// from a CDN. By default, recordings are fetched as MP3 (which is faster) instead
+	// of WAV.
+	AudioURLRewrites []RewriteRule
+
+	// Split recordings longer than ChunkSeconds into several chunks (requires ffmpeg).
+	ChunkRecordings bool
+	ChunkSeconds    int
+	// After adding a voicemail to a stream, fetch the stream to check that it has a new
+	// chunk, and post the voicemail again if it doesn't. Costs two extra requests.
+	ConfirmDelivery bool
+	// Transcode recordings before delivery (e.g. to Opus), with either a command or an
+	// HTTP service that takes the MP3 as the POST body and responds with the
+	// transcoded audio. "{input}" and "{output}" in the command's arguments are
+	// replaced with file names. TranscodeExtension is the extension of the output,
+	// which determines its Content-Type. Transcoded recordings aren't split into
+	// chunks, and the original recording is delivered if transcoding fails. The
+	// command is killed if it runs for longer than TranscodeTimeoutSeconds.
+	TranscodeCommand        []string
+	TranscodeURL            string
+	TranscodeExtension      string
+	TranscodeTimeoutSeconds int
+
+	// Maximum number of deliveries to the Roger API at once, shared by calls and the
+	// pending queue. Calls go first when the limit is reached. Zero means unlimited.
+	MaxConcurrentDeliveries int
+	// Extra attempts at adding a voicemail to a stream we just created for it, before
+	// queuing it for later.
+	ChunkRetries int
+	// What to do with a pending voicemail when the Roger API returns 404 because the
+	// account or stream is gone: "retry" like any other error, "dead_letter" it, or
+	// "reresolve" the recipient (creating a new stream) once before dead-lettering it.
+	APINotFound string
+	// Largest recording we download for splitting. Bigger recordings are posted whole
+	// with their Twilio URL. Zero means unlimited.
+	MaxAudioBytes int64
+	// Timeout for each recording download and upload of the processed audio (instead
+	// of HTTPTimeoutSeconds, since recordings are much bigger than API responses), and
+	// how many downloads may run at once. Zero means unlimited, and a zero timeout uses
+	// HTTPTimeoutSeconds.
+	DownloadTimeoutSeconds int
+	MaxConcurrentDownloads int
+
+	// HTTP proxy for all outgoing requests, e.g. "http://proxy.internal:3128". The
+	// HTTP_PROXY and HTTPS_PROXY environment variables are used if empty.
+	OutboundProxyURL string
+	outboundProxy    *url.URL
+
+	// How to handle callers who withhold their number: "shared" puts all of them in one
+	// stream per recipient, "per_call" gives each call its own stream and "reject"
+	// doesn't take their messages.
+	AnonymousCallers string
+	// How to handle calls from the number they were forwarded from (someone calling
+	// their own line): "allow" delivers them as a voicemail to oneself, and "reject"
+	// doesn't take their messages.
+	SelfCalls string
+
+	// Names of the Twilio parameters holding the caller and recipient numbers.
+	FromField string
+	ToField   string
+
+	// Maximum rate of outgoing SMS, to stay within Twilio's limits. Zero means unlimited.
+	SMSPerSecond float64
+	// E.164 prefixes (e.g. ["+1", "+44"]) of the numbers we send SMS to, since
+	// international texts can be expensive or unreliable. An empty list allows all.
+	SMSCountryPrefixes []string
+
+	// Recipient numbers we take voicemail for. Entries ending in "*" match by prefix.
+	// An empty list serves all numbers.
+	ServedNumbers []string
+
+	// Twilio form fields (e.g. a campaign ID) passed on to the Roger API as metadata.
+	PassthroughFields []string
+	// Also pass on any form field starting with this prefix (e.g. "x_"), so Studio flows
+	// can attach context. Keys must be alphanumeric or "_", and sensitive-looking keys
+	// are never passed on.
+	PassthroughPrefix string
+	// Attach Twilio's RecordingUrl as the "original_audio_url" metadata field, even when
+	// the delivered audio is rewritten or re-hosted. Off by default, since it gives away
+	// a Twilio URL.
+	AttachOriginalAudioURL bool
+
+	// Store a CallLog for every call, with the recording and outcome, not just for the
+	// ones that /v1/call-status hears about.
+	LogCalls bool
+
+	// Log and record (as the twilio_latency_seconds metric) how long Twilio's status
+	// callbacks took to reach us, from their Timestamp parameter.
+	LogTwilioLatency bool
+
+	// Mask the middle digits of phone numbers in all log output (e.g. "+1415***0100"),
+	// for deployments that mustn't log personal data such as under GDPR.
+	LogNumberMasking bool
+
+	// Log the full (redacted) Twilio form of every call, for debugging routing.
+	DebugLogForms bool
+
+	// Maps a recipient number to the identity to deliver to, e.g. an email address.
+	NumberMap map[string]string
+	// Extension directory for shared lines. If set, callers are asked to enter the
+	// extension of the person they're calling, which maps to the identity to deliver
+	// to. Unknown extensions go to DirectoryDefault, or the number called if that's
+	// empty.
+	Directory        map[string]string
+	DirectoryDefault string
+	DirectoryPrompt  string
+	// Maps a recipient (after NumberMap) to a stream that voicemails are added to
+	// directly, skipping identity resolution.
+	StreamMap map[string]StreamTarget
+	// Roger backends for recipients other than the default one, keyed by recipient
+	// prefix. The longest matching prefix wins.
+	Backends map[string]Backend
+	// Roger API tokens for individual recipients (after NumberMap), for tenants with
+	// their own token. With LookupRecipientTokens, recipients not in the map are also
+	// looked up as RecipientToken entities. Anyone else uses their backend's token.
+	RecipientTokens       map[string]string
+	LookupRecipientTokens bool
+	// Recipients (after NumberMap) must match this pattern, so that a malformed number
+	// doesn't sit in the pending queue forever. Identities configured in NumberMap or
+	// Directory (such as usernames) are always accepted. Empty disables the check.
+	RecipientPattern string
+	recipientPattern *regexp.Regexp
+	mappedRecipients map[string]bool
+
+	// Deliver the transcription as a text-only voicemail when Twilio has no recording
+	// (e.g. it expired) but does have a transcription.
+	DeliverTranscriptions bool
+
+	// Metadata fields attached to every delivery (e.g. {"source": "phone"}), so that
+	// the Roger app can attribute voicemails. StreamMetadata overrides or adds fields
+	// per recipient (after NumberMap). Fields set for the voicemail itself win.
+	DefaultStreamMetadata map[string]string
+	StreamMetadata        map[string]map[string]string
+
+	// Type of the stream created for voicemails from people without an account
+	// ("voicemail" or "group"). The Roger API picks the type if empty.
+	StreamType string
+
+	// Label for the sender of voicemails people leave themselves (e.g. "Your
+	// voicemail"), attached as the "sender_label" metadata field.
+	MonologueLabel string
+
+	// Voicemails for TestRecipient (e.g. a number used by end-to-end tests) go to
+	// TestAccountId, whoever the number belongs to.
+	TestRecipient string
+	TestAccountId int64
+
+	// Create accounts (through the Roger API endpoint at ProvisionPath) for recipients
+	// in ProvisionNumbers that don't have one, and deliver to them right away instead
+	// of queueing. Entries ending in "*" match by prefix.
+	ProvisionAccounts bool
+	ProvisionNumbers  []string
+	ProvisionPath     string
+
+	// Slack-compatible webhooks to post voicemails to for recipients without a Roger
+	// account (e.g. a business line routed to a team channel). Voicemails posted to
+	// Slack are only also queued for Roger with SlackAlsoQueue.
+	SlackWebhooks  map[string]string
+	SlackAlsoQueue bool
+
+	// Queue a voicemail instead of waiting on its delivery once this many seconds have
+	// passed, so that we respond before Twilio gives up (TwilioWebhookTimeout) and
+	// calls us again. Zero waits however long delivery takes.
+	ResponseBudgetSeconds int
+
+	// How long to wait before checking once more whether a recipient without an account
+	// has just signed up, instead of queueing their voicemail right away. This holds up
+	// the response to Twilio, so keep it short.
+	NoAccountGraceMillis int
+
+	// Text the recipient VoicemailText when they don't have an account yet. The text is
+	// a template with the sender's number (.From), name if known (.Name) and pending
+	// voicemail ID (.ID), e.g. for a deep link like "http://rgr.im/get?v={{.ID}}".
+	// Values inserted into links should be escaped with the "query" function.
+	NotifyNoAccountBySMS bool
+	VoicemailText        string
+	voicemailText        *template.Template
+	// Translations of VoicemailText keyed by E.164 prefix (e.g. "+46" for Sweden). The
+	// longest matching prefix wins, and everyone else gets VoicemailText.
+	LocalizedVoicemailText map[string]string
+	localizedVoicemailText map[string]*template.Template
+
+	// Retry no-account SMS that couldn't be sent on the next flushes, as PendingSMS
+	// entities, following RetrySchedule (or up to MaxPendingSMSAttempts times without
+	// one).
+	RetrySMS bool
+
+	// Slack-compatible webhook for ops alerts, sent when the pending queue reaches
+	// AlertQueueDepth voicemails or AlertConsecutiveFailures deliveries in a row fail.
+	// Zero thresholds disable that alert. Each alert repeats at most once per
+	// AlertCooldownSeconds.
+	AlertWebhookURL          string
+	AlertQueueDepth          int
+	AlertConsecutiveFailures int
+	AlertCooldownSeconds     int
+	// Alert once this many calls and recordings have come in without a recipient.
+	AlertMissingRecipients int
+
+	// Maximum number of voicemails in the pending queue. Once it's full, voicemails
+	// that can't be delivered are dropped and the caller is asked to try again later.
+	// Zero means unlimited.
+	MaxPendingQueue int
+
+	// Maximum number of voicemails delivered to one recipient per (UTC) day. Any
+	// beyond that are queued until the next day. Zero means unlimited.
+	MaxDailyVoicemails int
+}
+
+// Backend is a Roger API that voicemails can be delivered to.
+type Backend struct {
+	APIBaseURL  string
+	AccessToken string
+
+	apiURL *url.URL
+}
+
+// RewriteRule replaces matches of the Pattern regular expression with Replacement,
+// which may refer to groups as $1 etc.
+type RewriteRule struct {
+	Pattern     string
+	Replacement string
+
+	re *regexp.Regexp
+}
+
+// StreamTarget is an existing stream to deliver voicemails to, and the account that
+// posts them.
+type StreamTarget struct {
+	StreamId  int64
+	AccountId int64
+}
+
+// Validate checks that the loaded configuration is usable, and parses any values that
+// need it.
+//
+// Recordings are delivered while Twilio waits for our response, so every request made
+// during delivery has to fit in TwilioWebhookTimeout. Delivery makes up to two Roger
+// API requests, plus a download and one request per chunk when chunking is enabled,
+// so HTTPTimeoutSeconds should be at most TwilioWebhookTimeout divided by that number
+// of requests. Warnings lists any configuration that breaks this.
+func (c *Config) Validate() error {
+	if c.TwilioAPIVersion == "" {
+		return fmt.Errorf("TwilioAPIVersion must not be empty")
+	}
+	if strings.Contains(c.TwilioAPIVersion, "/") {
+		return fmt.Errorf("invalid TwilioAPIVersion %q", c.TwilioAPIVersion)
+	}
+	if c.TwilioEdge != "" && c.TwilioRegion == "" {
+		return fmt.Errorf("TwilioEdge requires TwilioRegion to be set")
+	}
+	for _, label := range []string{c.TwilioRegion, c.TwilioEdge} {
+		if strings.ContainsAny(label, "./: ") {
+			return fmt.Errorf("invalid Twilio region/edge %q", label)
+		}
+	}
+	if c.DedupWindowSeconds < 0 {
+		return fmt.Errorf("DedupWindowSeconds must not be negative")
+	}
+	if c.LookupCallerNames && (c.CallerNameCacheSize <= 0 || c.CallerNameCacheSeconds <= 0) {
+		return fmt.Errorf("CallerNameCacheSize and CallerNameCacheSeconds must be positive when caller name lookups are enabled")
+	}
+	if c.DedupWindowSeconds > 0 && c.DedupMaxEntries <= 0 {
+		return fmt.Errorf("DedupMaxEntries must be positive when dedup is enabled")
+	}
+	if c.StartupProbeSeconds <= 0 {
+		return fmt.Errorf("StartupProbeSeconds must be positive")
+	}
+	if c.MaxAPIRetryWaitSeconds < 0 {
+		return fmt.Errorf("MaxAPIRetryWaitSeconds must not be negative")
+	}
+	if c.ShutdownGraceSeconds <= 0 {
+		return fmt.Errorf("ShutdownGraceSeconds must be positive")
+	}
+	for prefix, backend := range c.Backends {
+		u, err := url.Parse(backend.APIBaseURL)
+		if err != nil || !u.IsAbs() || !strings.HasSuffix(u.Path, "/") {
+			return fmt.Errorf("APIBaseURL for backend %s must be an absolute URL ending in /", prefix)
+		}
+		if backend.AccessToken == "" {
+			return fmt.Errorf("AccessToken for backend %s must not be empty", prefix)
+		}
+		backend.apiURL = u
+		c.Backends[prefix] = backend
+	}
+	for extension, identity := range c.Directory {
+		if extension == "" || identity == "" {
+			return fmt.Errorf("Directory entries need an extension and an identity")
+		}
+	}
+	if len(c.Directory) > 0 && c.DirectoryPrompt == "" {
+		return fmt.Errorf("DirectoryPrompt must be set when Directory is")
+	}
+	for recipient, target := range c.StreamMap {
+		if target.StreamId <= 0 || target.AccountId <= 0 {
+			return fmt.Errorf("StreamMap entry for %s needs a StreamId and AccountId", recipient)
+		}
+	}
+	if c.IdentityKind == "" || c.PendingKind == "" {
+		return fmt.Errorf("IdentityKind and PendingKind must not be empty")
+	}
+	if c.PendingStore != "datastore" && c.PendingStore != "memory" {
+		return fmt.Errorf("invalid PendingStore %q", c.PendingStore)
+	}
+	if c.FlushBatchSize < 0 {
+		return fmt.Errorf("FlushBatchSize must not be negative")
+	}
+	if c.FlushWorkers <= 0 {
+		return fmt.Errorf("FlushWorkers must be positive")
+	}
+	c.retrySchedule = nil
+	for _, value := range c.RetrySchedule {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			return fmt.Errorf("invalid RetrySchedule entry %q", value)
+		}
+		c.retrySchedule = append(c.retrySchedule, delay)
+	}
+	if c.AlertWebhookURL != "" {
+		if u, err := url.Parse(c.AlertWebhookURL); err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid AlertWebhookURL")
+		}
+	}
+	if c.AlertQueueDepth < 0 || c.AlertConsecutiveFailures < 0 || c.AlertCooldownSeconds < 0 || c.AlertMissingRecipients < 0 {
+		return fmt.Errorf("alert thresholds and cooldown must not be negative")
+	}
+	if c.MaxPendingQueue < 0 {
+		return fmt.Errorf("MaxPendingQueue must not be negative")
+	}
+	if c.MaxDailyVoicemails < 0 {
+		return fmt.Errorf("MaxDailyVoicemails must not be negative")
+	}
+	if c.SMSPerSecond < 0 {
+		return fmt.Errorf("SMSPerSecond must not be negative")
+	}
+	switch c.AnonymousCallers {
+	case "shared", "per_call", "reject":
+	default:
+		return fmt.Errorf("invalid AnonymousCallers %q", c.AnonymousCallers)
+	}
+	switch c.SelfCalls {
+	case "allow", "reject":
+	default:
+		return fmt.Errorf("invalid SelfCalls %q", c.SelfCalls)
+	}
+	if c.FromField == "" || c.ToField == "" {
+		return fmt.Errorf("FromField and ToField must not be empty")
+	}
+	if c.FetchGreetings && c.GreetingPath == "" {
+		return fmt.Errorf("GreetingPath must be set when FetchGreetings is enabled")
+	}
+	if c.GreetingCacheSeconds < 0 {
+		return fmt.Errorf("GreetingCacheSeconds must not be negative")
+	}
+	if c.FetchGreetings && c.GreetingCacheSize <= 0 {
+		return fmt.Errorf("GreetingCacheSize must be positive when FetchGreetings is enabled")
+	}
+	if c.MaxGreetingSeconds > 0 && c.GreetingBytesPerSecond <= 0 {
+		return fmt.Errorf("GreetingBytesPerSecond must be positive when MaxGreetingSeconds is set")
+	}
+	if c.GreetingPauseSeconds < 0 {
+		return fmt.Errorf("GreetingPauseSeconds must not be negative")
+	}
+	if c.RecordMaxLength <= 0 || c.RecordMaxLength > TwilioMaxRecordLength {
+		return fmt.Errorf("RecordMaxLength must be between 1 and %d", TwilioMaxRecordLength)
+	}
+	if c.MinDurationSeconds < 0 || c.MaxDurationSeconds < 0 {
+		return fmt.Errorf("MinDurationSeconds and MaxDurationSeconds must not be negative")
+	}
+	if c.MaxDurationSeconds > 0 && c.MinDurationSeconds > c.MaxDurationSeconds {
+		return fmt.Errorf("MinDurationSeconds must not be more than MaxDurationSeconds")
+	}
+	if c.HTTPTimeoutSeconds <= 0 {
+		return fmt.Errorf("HTTPTimeoutSeconds must be positive")
+	}
+	if c.RecordingChannels != "mono" && c.RecordingChannels != "dual" {
+		return fmt.Errorf("RecordingChannels must be \"mono\" or \"dual\"")
+	}
+	if c.TestRecipient != "" && c.TestAccountId <= 0 {
+		return fmt.Errorf("TestAccountId must be set when TestRecipient is")
+	}
+	switch c.APINotFound {
+	case "retry", "dead_letter", "reresolve":
+	default:
+		return fmt.Errorf("invalid APINotFound %q", c.APINotFound)
+	}
+	switch c.StreamType {
+	case "", "voicemail", "group":
+	default:
+		return fmt.Errorf("StreamType must be \"voicemail\" or \"group\"")
+	}
+	if c.SkipGreetingKey != "" && (len(c.SkipGreetingKey) != 1 || !strings.Contains("0123456789*#", c.SkipGreetingKey)) {
+		return fmt.Errorf("invalid SkipGreetingKey %q", c.SkipGreetingKey)
+	}
+	switch c.FinishOnKey {
+	case "", "any", "none":
+	default:
+		if len(c.FinishOnKey) != 1 || !strings.Contains("0123456789*#", c.FinishOnKey) {
+			return fmt.Errorf("invalid FinishOnKey %q", c.FinishOnKey)
+		}
+	}
+	if c.ChunkRecordings && c.ChunkSeconds <= 0 {
+		return fmt.Errorf("ChunkSeconds must be positive when chunking is enabled")
+	}
+	tmpl, err := parseSMSTemplate(c.VoicemailText)
+	if err != nil {
+		return fmt.Errorf("invalid VoicemailText: %v", err)
+	}
+	c.voicemailText = tmpl
+	c.localizedVoicemailText = make(map[string]*template.Template, len(c.LocalizedVoicemailText))
+	for prefix, text := range c.LocalizedVoicemailText {
+		if !strings.HasPrefix(prefix, "+") {
+			return fmt.Errorf("LocalizedVoicemailText prefix %q must start with \"+\"", prefix)
+		}
+		tmpl, err := parseSMSTemplate(text)
+		if err != nil {
+			return fmt.Errorf("invalid LocalizedVoicemailText for %s: %v", prefix, err)
+		}
+		c.localizedVoicemailText[prefix] = tmpl
+	}
+	for i := range c.AudioURLRewrites {
+		rule := &c.AudioURLRewrites[i]
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid AudioURLRewrites pattern %q: %v", rule.Pattern, err)
+		}
+		rule.re = re
+	}
+	c.recipientPattern = nil
+	if c.RecipientPattern != "" {
+		re, err := regexp.Compile(c.RecipientPattern)
+		if err != nil {
+			return fmt.Errorf("invalid RecipientPattern: %v", err)
+		}
+		c.recipientPattern = re
+	}
+	c.mappedRecipients = make(map[string]bool, len(c.NumberMap)+len(c.Directory)+1)
+	for _, identity := range c.NumberMap {
+		c.mappedRecipients[identity] = true
+	}
+	for _, identity := range c.Directory {
+		c.mappedRecipients[identity] = true
+	}
+	if c.DirectoryDefault != "" {
+		c.mappedRecipients[c.DirectoryDefault] = true
+	}
+	if len(c.TranscodeCommand) > 0 && c.TranscodeURL != "" {
+		return fmt.Errorf("only one of TranscodeCommand and TranscodeURL can be set")
+	}
+	if (len(c.TranscodeCommand) > 0 || c.TranscodeURL != "") && audioContentType(c.TranscodeExtension) == "" {
+		return fmt.Errorf("unsupported TranscodeExtension %q", c.TranscodeExtension)
+	}
+	if len(c.TranscodeCommand) > 0 && c.TranscodeTimeoutSeconds <= 0 {
+		return fmt.Errorf("TranscodeTimeoutSeconds must be positive when TranscodeCommand is set")
+	}
+	if c.MaxConcurrentDeliveries < 0 {
+		return fmt.Errorf("MaxConcurrentDeliveries must not be negative")
+	}
+	if c.ChunkRetries < 0 {
+		return fmt.Errorf("ChunkRetries must not be negative")
+	}
+	if c.DownloadTimeoutSeconds < 0 || c.MaxConcurrentDownloads < 0 {
+		return fmt.Errorf("DownloadTimeoutSeconds and MaxConcurrentDownloads must not be negative")
+	}
+	if c.MaxAudioBytes < 0 {
+		return fmt.Errorf("MaxAudioBytes must not be negative")
+	}
+	c.outboundProxy = nil
+	if c.OutboundProxyURL != "" {
+		u, err := url.Parse(c.OutboundProxyURL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("OutboundProxyURL must be an http or https URL with a host")
+		}
+		c.outboundProxy = u
+	}
+	if c.AllowRerecord && c.RecordingStatusCallback != "" {
+		return fmt.Errorf("AllowRerecord can't be combined with RecordingStatusCallback")
+	}
+	if _, err := url.Parse(c.RecordingStatusCallback); err != nil {
+		return fmt.Errorf("invalid RecordingStatusCallback: %v", err)
+	}
+	if _, err := url.Parse(c.RecordAction); err != nil {
+		return fmt.Errorf("invalid RecordAction: %v", err)
+	}
+	return nil
+}
+
+// FinishOnKeyDigits returns the finishOnKey attribute value for FinishOnKey.
+func (c Config) FinishOnKeyDigits() string {
+	switch c.FinishOnKey {
+	case "any":
+		return "0123456789*#"
+	case "none":
+		return ""
+	default:
+		return c.FinishOnKey
+	}
+}
+
+// Warnings returns problems with the config that don't prevent it from being used,
+// such as timeouts that don't fit the recording length (see Validate).
+func (c *Config) Warnings() (warnings []string) {
+	requests := 2
+	if c.ChunkRecordings && c.ChunkSeconds > 0 && c.RecordMaxLength > c.ChunkSeconds {
+		chunks := (c.RecordMaxLength + c.ChunkSeconds - 1) / c.ChunkSeconds
+		requests = 3 + chunks
+	}
+	worstCase := time.Duration(requests*c.HTTPTimeoutSeconds) * time.Second
+	if worstCase > TwilioWebhookTimeout {
+		warnings = append(warnings, fmt.Sprintf(
+			"delivering a %ds recording may take up to %s (%d requests with a %ds timeout), longer than Twilio waits (%s)",
+			c.RecordMaxLength, worstCase, requests, c.HTTPTimeoutSeconds, TwilioWebhookTimeout))
+	}
+	if budget := time.Duration(c.ResponseBudgetSeconds) * time.Second; budget >= TwilioWebhookTimeout {
+		warnings = append(warnings, fmt.Sprintf("ResponseBudgetSeconds (%s) should be less than Twilio's timeout (%s)", budget, TwilioWebhookTimeout))
+	}
+	if c.ProvisionAccounts && len(c.ProvisionNumbers) == 0 {
+		warnings = append(warnings, "ProvisionAccounts is set but ProvisionNumbers is empty, so no accounts will be provisioned")
+	}
+	return
+}
+
+// Redacted returns a copy of the config that is safe to expose, with secrets masked.
+func (c Config) Redacted() Config {
+	c.AccessToken = redact(c.AccessToken)
+	c.AdminToken = redact(c.AdminToken)
+	c.TwilioAuthToken = redact(c.TwilioAuthToken)
+	c.OutboundProxyURL = redactURL(c.OutboundProxyURL)
+	// Slack webhook URLs contain their secret.
+	c.AlertWebhookURL = redact(c.AlertWebhookURL)
+	backends := make(map[string]Backend, len(c.Backends))
+	for prefix, backend := range c.Backends {
+		backend.AccessToken = redact(backend.AccessToken)
+		backends[prefix] = backend
+	}
+	c.Backends = backends
+	tokens := make(map[string]string, len(c.RecipientTokens))
+	for recipient, token := range c.RecipientTokens {
+		tokens[recipient] = redact(token)
+	}
+	c.RecipientTokens = tokens
+	webhooks := make(map[string]string, len(c.SlackWebhooks))
+	for recipient, webhookURL := range c.SlackWebhooks {
+		webhooks[recipient] = redact(webhookURL)
+	}
+	c.SlackWebhooks = webhooks
+	return c
+}
+
+// twilioMessagesURL builds the Messages endpoint for the configured API version and region.
+func twilioMessagesURL() string {
+	host := "api.twilio.com"
+	if config.TwilioRegion != "" {
+		if config.TwilioEdge != "" {
+			host = fmt.Sprintf("api.%s.%s.twilio.com", config.TwilioEdge, config.TwilioRegion)
+		} else {
+			host = fmt.Sprintf("api.%s.twilio.com", config.TwilioRegion)
+		}
+	}
+	return fmt.Sprintf("https://%s/%s/Accounts/%s/Messages.json", host, config.TwilioAPIVersion, TwilioAccountSid)
 }
 
 var (
-	config    Config
-	ctx       = context.Background()
-	store     *datastore.Client
-	apiURL, _ = url.Parse("https://api.rogertalk.com/v17/")
+	config = Config{
+		StartupProbeSeconds:    30,
+		ShutdownGraceSeconds:   10,
+		MaxAPIRetryWaitSeconds: 2,
+		PendingStore:           "datastore",
+		IdentityKind:           "Identity",
+		PendingKind:            "PendingVoicemail",
+		FlushWorkers:           1,
+		TwilioAPIVersion:       "2010-04-01",
+		DedupWindowSeconds:     60,
+		DedupMaxEntries:        10000,
+		CallerNameCacheSize:    10000,
+		CallerNameCacheSeconds: 86400,
+		GreetingPath:           "greeting",
+		GreetingCacheSeconds:   60,
+		GreetingCacheSize:      10000,
+		// 128 kbps MP3, or 8 kHz 16-bit WAV.
+		GreetingBytesPerSecond:  16000,
+		RecordMaxLength:         30,
+		HTTPTimeoutSeconds:      5,
+		RecordingChannels:       "mono",
+		TrimSilence:             true,
+		ChunkSeconds:            30,
+		ChunkRetries:            1,
+		TranscodeExtension:      ".opus",
+		TranscodeTimeoutSeconds: 60,
+		AudioURLRewrites: []RewriteRule{
+			// Recording URLs without an extension (or .wav) serve WAV.
+			{Pattern: `^([^?#]*/[^/.?#]*)(\.wav)?$`, Replacement: "${1}.mp3"},
+		},
+		FromField:            "From",
+		ToField:              "ForwardedFrom",
+		AnonymousCallers:     "shared",
+		SelfCalls:            "allow",
+		APINotFound:          "retry",
+		DirectoryPrompt:      "Please enter the extension of the person you are calling, followed by the pound key.",
+		AlertCooldownSeconds: 3600,
+		VoicemailText:        VoicemailText,
+		ProvisionPath:        "accounts",
+		// An E.164 number or an email address.
+		RecipientPattern: `^(\+[1-9][0-9]{6,14}|[^@\s]+@[^@\s]+\.[^@\s]+)$`,
+	}
+	recentRecordings *recentSet
+	deliveryLimiter  *concurrencyLimiter
+	downloadLimiter  *concurrencyLimiter
+	smsLimiter       *rateLimiter
+	// Keeps /v1/test-sms from being used to spam people.
+	testSMSLimiter = newRateLimiter(1.0/60, 5)
+	response       []byte
+	ctx            = context.Background()
+	httpClient     = &http.Client{}
+	downloadClient = &http.Client{}
+	store          *datastore.Client
+	pendingStore   PendingStore
+	apiURL, _      = url.Parse("https://api.rogertalk.com/v17/")
+	// How long to wait between attempts at reaching Datastore on startup.
+	probeInterval = time.Second
+
+	// The flush of the pending queue in progress, if any.
+	flushState struct {
+		sync.Mutex
+		running  bool
+		progress FlushProgress
+	}
+
+	errDailyCapReached  = fmt.Errorf("daily voicemail cap reached")
+	errPaused           = fmt.Errorf("delivery is paused")
+	errQueueFull        = fmt.Errorf("pending queue is full")
+	errInvalidRecipient = fmt.Errorf("recipient doesn't match RecipientPattern")
+	errStillDelivering  = fmt.Errorf("delivery is still in progress but couldn't be queued")
+
+	// Patterns for form keys and values that should never be logged in full.
+	sensitiveKeyPattern = regexp.MustCompile(`(?i)token|secret|password|auth|signature|key`)
+	tokenPattern        = regexp.MustCompile(`^[A-Za-z0-9_\-]{24,}$`)
+
+	// Form keys that may be passed on to the Roger API under PassthroughPrefix.
+	metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
 )
 
+// CallLog records the final status of a call, as reported by Twilio. With LogCalls,
+// it also records the recording and the outcome of each request for the call. Keyed
+// by CallSid.
+type CallLog struct {
+	From              string    `datastore:"from"`
+	To                string    `datastore:"to"`
+	Status            string    `datastore:"status"`
+	Duration          int       `datastore:"duration,noindex"`
+	Price             string    `datastore:"price,noindex"`
+	PriceUnit         string    `datastore:"price_unit,noindex"`
+	RecordingSid      string    `datastore:"recording_sid"`
+	RecordingURL      string    `datastore:"recording_url,noindex"`
+	RecordingDuration int       `datastore:"recording_duration,noindex"`
+	Outcome           string    `datastore:"outcome"`
+	CreatedAt         time.Time `datastore:"created_at"`
+	UpdatedAt         time.Time `datastore:"updated_at"`
+}
+
+// FlushProgress describes how far a flush of the pending queue has got.
+type FlushProgress struct {
+	StartedAt time.Time `json:"started_at"`
+	// Voicemails due for delivery in this flush, and how many have been tried so far.
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+}
+
+// DailyDeliveryCount tracks voicemails delivered to a recipient on one day. Keyed by
+// "<recipient>/<YYYY-MM-DD>".
+type DailyDeliveryCount struct {
+	Count int `datastore:"count,noindex"`
+}
+
 type Identity struct {
 	Account   *datastore.Key `datastore:"account"`
 	Available bool           `datastore:"available"`
 	Status    string         `datastore:"status"`
 }
 
+// Preferences holds per-recipient settings for this service. Keyed by identity. A
+// recipient without Preferences gets the defaults.
+type Preferences struct {
+	NotifyBySMS bool `datastore:"notify_by_sms,noindex"`
+}
+
+// RecordingClaim marks a recording as received. Keyed by RecordingSid.
+type RecordingClaim struct {
+	ClaimedAt time.Time `datastore:"claimed_at"`
+}
+
+// RecipientToken is a Roger API token to deliver to a recipient with. Keyed by the
+// recipient's identity.
+type RecipientToken struct {
+	Token string `datastore:"token,noindex"`
+}
+
+// SMSOptOut records whether a number has replied STOP to our messages. Keyed by number.
+type SMSOptOut struct {
+	OptedOut  bool      `datastore:"opted_out"`
+	UpdatedAt time.Time `datastore:"updated_at"`
+}
+
 type Participant struct {
 	Id int64
 }
 
-type PendingVoicemail struct {
-	From      string `datastore:"from",noindex`
-	To        string `datastore:"to"`
-	AudioURL  string `datastore:"audio_url",noindex`
-	Delivered bool   `datastore:"delivered"`
+type PendingVoicemail struct {
+	// ID is assigned by the PendingStore.
+	ID       int64  `datastore:"-"`
+	From     string `datastore:"from",noindex`
+	To       string `datastore:"to"`
+	AudioURL string `datastore:"audio_url",noindex`
+	// CallerName is the caller's name from Twilio's caller ID lookup, if any.
+	CallerName string `datastore:"caller_name,noindex"`
+	// Duration of the recording in seconds, as reported by Twilio.
+	Duration int `datastore:"duration,noindex"`
+	// Encrypted is set for recordings encrypted by Twilio, which we can't process. The
+	// encryption details are passed on in the metadata.
+	Encrypted bool `datastore:"encrypted,noindex"`
+	// StreamID is set once a stream has been created for the voicemail, so that retries
+	// post to it as StreamAccountID rather than creating another one.
+	StreamID        int64 `datastore:"stream_id,noindex"`
+	StreamAccountID int64 `datastore:"stream_account_id,noindex"`
+	// Text is the transcription, delivered instead of the audio if AudioURL is empty.
+	Text string `datastore:"text,noindex"`
+	// Metadata is a JSON object of extra fields to attach to the stream chunk.
+	Metadata  string `datastore:"metadata,noindex"`
+	Delivered bool   `datastore:"delivered"`
+	// DeliverAfter holds back the voicemail until the given time (if set).
+	DeliverAfter time.Time `datastore:"deliver_after,noindex"`
+	// DeadLetter is set once delivery has been given up on.
+	DeadLetter bool `datastore:"dead_letter,noindex"`
+	// InFlightUntil is set while a delivery that ran past the response budget is still
+	// in progress, so that flushes leave the voicemail alone until it finishes. It's a
+	// lease rather than a flag, so that the voicemail is retried even if the instance
+	// delivering it stops before finishing.
+	InFlightUntil time.Time `datastore:"in_flight_until,noindex"`
+	// Attempts is the number of times delivery from the queue has been attempted.
+	Attempts  int       `datastore:"attempts,noindex"`
+	CreatedAt time.Time `datastore:"created_at"`
+
+	// The recording, downloaded for transcoding or splitting before delivery. Not
+	// stored.
+	audioFile string
+}
+
+// TwilioError is the structured error body returned by the Twilio REST API.
+type TwilioError struct {
+	Status   int    `json:"status"`
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+}
+
+func (e *TwilioError) Error() string {
+	return fmt.Sprintf("twilio error %d: %s (%s)", e.Code, e.Message, e.MoreInfo)
+}
+
+// inFlight reports whether a delivery of the voicemail may still be in progress.
+func (v *PendingVoicemail) inFlight(now time.Time) bool {
+	return v.InFlightUntil.After(now)
+}
+
+// post adds the voicemail to an existing stream: the recording if there is one,
+// otherwise the transcription as a text-only chunk.
+func (v *PendingVoicemail) post(backend Backend, accountId, streamId int64) error {
+	if !config.ConfirmDelivery || config.LocalDev {
+		return v.postOnce(backend, accountId, streamId)
+	}
+	// Check that a new chunk shows up in the stream, and post again once if it doesn't.
+	before, err := getStream(backend, accountId, streamId)
+	if err != nil {
+		log.Printf("Failed to get stream %d, not confirming delivery: %v", streamId, err)
+		return v.postOnce(backend, accountId, streamId)
+	}
+	if len(before.Chunks) == 0 {
+		// The stream is new or the API left out its chunks, so there's nothing to tell
+		// a new chunk apart from.
+		return v.postOnce(backend, accountId, streamId)
+	}
+	for attempt := 1; ; attempt++ {
+		if err := v.postOnce(backend, accountId, streamId); err != nil {
+			return err
+		}
+		after, err := getStream(backend, accountId, streamId)
+		if err != nil {
+			log.Printf("Failed to get stream %d, can't confirm delivery: %v", streamId, err)
+			return nil
+		}
+		if after.latestChunkId() > before.latestChunkId() {
+			return nil
+		}
+		if attempt == 2 {
+			return fmt.Errorf("stream %d has no new chunk after posting voicemail", streamId)
+		}
+		log.Printf("Stream %d has no new chunk after posting voicemail, posting again", streamId)
+	}
+}
+
+// postOnce adds the voicemail to the stream without confirming delivery.
+func (v *PendingVoicemail) postOnce(backend Backend, accountId, streamId int64) error {
+	if v.AudioURL != "" && !v.Encrypted {
+		return postAudio(backend, accountId, streamId, v.AudioURL, v.audioFile, v.chunkFields())
+	}
+	fields := v.chunkFields()
+	if v.AudioURL != "" {
+		// Encrypted recordings can't be split, so post them whole.
+		fields.Set("audio_url", v.AudioURL)
+	} else {
+		fields.Set("text", v.Text)
+	}
+	_, err := postStream(backend, accountId, streamId, fields)
+	return err
+}
+
+// AddMetadata adds a field to attach to the stream chunk, keeping any existing ones.
+func (v *PendingVoicemail) AddMetadata(key, value string) error {
+	metadata := make(map[string]string)
+	if v.Metadata != "" {
+		if err := json.Unmarshal([]byte(v.Metadata), &metadata); err != nil {
+			return err
+		}
+	}
+	metadata[key] = value
+	return v.SetMetadata(metadata)
+}
+
+// SetMetadata stores the fields to attach to the stream chunk.
+func (v *PendingVoicemail) SetMetadata(metadata map[string]string) error {
+	if len(metadata) == 0 {
+		v.Metadata = ""
+		return nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	v.Metadata = string(data)
+	return nil
+}
+
+// chunkFields returns the extra fields to post with the audio chunk.
+func (v *PendingVoicemail) chunkFields() url.Values {
+	fields := url.Values{}
+	if metadata := streamMetadata(v.To, v.Metadata); metadata != "" {
+		fields.Set("metadata", metadata)
+	}
+	return fields
+}
+
+// queuedError is returned when a voicemail couldn't be delivered right away but was
+// stored in the pending queue.
+type queuedError struct {
+	message string
+}
+
+func (e *queuedError) Error() string {
+	return e.message
+}
+
+// notFoundError is returned when the Roger API responds with 404, because the
+// account or stream was deleted.
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+// streamCreatedError is returned when a stream was created for a voicemail but the
+// voicemail couldn't be added to it.
+type streamCreatedError struct {
+	err                 error
+	streamId, accountId int64
+}
+
+func (e *streamCreatedError) Error() string {
+	return fmt.Sprintf("created stream %d but failed to add voicemail: %v", e.streamId, e.err)
+}
+
+type Stream struct {
+	Id     int64
+	Others []Participant
+	// The most recent chunks, if the API included them.
+	Chunks []Chunk
+}
+
+type Chunk struct {
+	Id int64
+}
+
+// latestChunkId returns the highest chunk ID in the stream, or zero if it has none.
+func (s *Stream) latestChunkId() (latest int64) {
+	for _, chunk := range s.Chunks {
+		if chunk.Id > latest {
+			latest = chunk.Id
+		}
+	}
+	return
+}
+
+// Validate checks that the stream has the fields we rely on, to catch changes to the
+// Roger API before they send voicemails to the wrong place.
+func (s *Stream) Validate() error {
+	if s.Id == 0 {
+		return fmt.Errorf("stream has no id")
+	}
+	for i, other := range s.Others {
+		if other.Id == 0 {
+			return fmt.Errorf("stream %d has no id for participant %d", s.Id, i)
+		}
+	}
+	return nil
+}
+
+func main() {
+	// Load configuration from file.
+	data, err := ioutil.ReadFile(ConfigPath)
+	if err != nil {
+		log.Fatalf("Failed to load config (ioutil.ReadFile: %v)", err)
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		log.Fatalf("Failed to load config (json.Unmarshal: %v)", err)
+	}
+	if os.Getenv("VOICEMAIL_LOCAL_DEV") != "" {
+		config.LocalDev = true
+	}
+	if config.LocalDev {
+		log.Printf("Running in local development mode, no SMS or Roger API requests will be made")
+		if config.ProjectId == "" {
+			config.ProjectId = "voicemail-local"
+		}
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	log.SetOutput(logOutput(os.Stderr))
+	for _, warning := range config.Warnings() {
+		log.Printf("Config warning: %s", warning)
+	}
+	httpClient.Timeout = time.Duration(config.HTTPTimeoutSeconds) * time.Second
+	// Set on the default transport so that every client uses it.
+	setOutboundProxy(http.DefaultTransport.(*http.Transport))
+
+	response, err = renderResponse(nil, "", "", "", false)
+	if err != nil {
+		log.Fatalf("Failed to render TwiML response: %v", err)
+	}
+
+	if config.MaxConcurrentDeliveries > 0 {
+		deliveryLimiter = newConcurrencyLimiter(config.MaxConcurrentDeliveries)
+	}
+	if config.MaxConcurrentDownloads > 0 {
+		downloadLimiter = newConcurrencyLimiter(config.MaxConcurrentDownloads)
+	}
+	downloadClient.Timeout = httpClient.Timeout
+	if config.DownloadTimeoutSeconds > 0 {
+		downloadClient.Timeout = time.Duration(config.DownloadTimeoutSeconds) * time.Second
+	}
+	if config.SMSPerSecond > 0 {
+		smsLimiter = newRateLimiter(config.SMSPerSecond, 1)
+	}
+	if config.DedupWindowSeconds > 0 {
+		recentRecordings = newRecentSet(time.Duration(config.DedupWindowSeconds)*time.Second, config.DedupMaxEntries)
+	}
+	if config.LookupCallerNames {
+		callerNames = newLRUCache(time.Duration(config.CallerNameCacheSeconds)*time.Second, config.CallerNameCacheSize)
+	}
+	if config.FetchGreetings {
+		greetings = newLRUCache(time.Duration(config.GreetingCacheSeconds)*time.Second, config.GreetingCacheSize)
+	}
+
+	// Set up the Datastore client.
+	store, err = newDatastoreClient()
+	if err != nil {
+		log.Fatalf("Failed to create Datastore client (datastore.NewClient: %v)", err)
+	}
+	if err := waitForDatastore(pingDatastore, time.Duration(config.StartupProbeSeconds)*time.Second); err != nil {
+		log.Fatalf("Datastore is unreachable: %v", err)
+	}
+	pendingStore, err = newPendingStore(config.PendingStore)
+	if err != nil {
+		log.Fatalf("Failed to create pending store: %v", err)
+	}
+	if config.PendingCacheSeconds > 0 {
+		pendingStore = newCachedPendingStore(pendingStore, time.Duration(config.PendingCacheSeconds)*time.Second)
+	}
+	if config.WarmUp {
+		warmUp()
+	}
+
+	// Set up server for handling incoming requests.
+	http.HandleFunc("/v1/call", requireTwilio(callHandler))
+	http.HandleFunc("/v1/call-status", requireTwilio(callStatusHandler))
+	http.HandleFunc("/v1/recording", requireTwilio(recordingHandler))
+	http.HandleFunc("/v1/sms", requireTwilio(smsHandler))
+	http.HandleFunc("/v1/calls", requireAdmin(gzipResponse(callLogsHandler)))
+	http.HandleFunc("/v1/config", requireAdmin(gzipResponse(configHandler)))
+	http.HandleFunc("/v1/events", requireAdmin(eventsHandler))
+	http.HandleFunc("/v1/flush", requireAdmin(flushHandler))
+	http.HandleFunc("/v1/pending/", requireAdmin(pendingAudioHandler))
+	http.HandleFunc("/v1/pause", requireAdmin(pauseHandler))
+	http.HandleFunc("/v1/replay", requireAdmin(replayHandler))
+	http.HandleFunc("/v1/resume", requireAdmin(pauseHandler))
+	http.HandleFunc("/v1/test-sms", requireAdmin(testSMSHandler))
+
+	log.Printf("Starting server on %s...", config.ListenAddr)
+	if err := serve(&http.Server{Addr: config.ListenAddr}); err != nil {
+		log.Fatalf("Failed to serve (http.ListenAndServe: %v)", err)
+	}
+}
+
+func callHandler(w http.ResponseWriter, r *http.Request) {
+	// The outcome is filled in below so that it ends up in the final log line.
+	outcome := "unknown"
+	defer logRequestOutcome(r.Method, r.URL.Path, time.Now(), &outcome)
+	if config.LogCalls {
+		defer func() {
+			form := r.Form
+			if r.Method == "GET" {
+				form = r.URL.Query()
+			}
+			// Don't hold up the response to Twilio.
+			go logCall(form, outcome)
+		}()
+	}
+	// GET requests don't contain the recording.
+	if r.Method == "GET" {
+		query := r.URL.Query()
+		log.Printf("Incoming call: %s", query)
+		if query.Get(config.ToField) == "" {
+			reportMissingRecipient("call", query)
+		}
+		if isDraining() {
+			log.Printf("Turning away call for %s while shutting down", query.Get(config.ToField))
+			outcome = "draining"
+			w.Write([]byte(DrainingResponse))
+			return
+		}
+		if !isServedNumber(query.Get(config.ToField)) {
+			log.Printf("Not serving call for %s", query.Get(config.ToField))
+			outcome = "unserved"
+			w.Write([]byte(NotInServiceResponse))
+			return
+		}
+		if config.AnonymousCallers == "reject" && isAnonymous(query.Get(config.FromField)) {
+			log.Printf("Rejecting anonymous call for %s", query.Get(config.ToField))
+			outcome = "anonymous"
+			w.Write([]byte(AnonymousRejectedResponse))
+			return
+		}
+		if isSelfCall(query.Get(config.FromField), query.Get(config.ToField)) {
+			log.Printf("Self call from %s", query.Get(config.FromField))
+			if config.SelfCalls == "reject" {
+				outcome = "self_call"
+				w.Write([]byte(SelfCallRejectedResponse))
+				return
+			}
+		}
+		if config.DropMachineCalls && isMachine(query.Get("AnsweredBy")) {
+			log.Printf("Hanging up on machine caller %s (%s)", query.Get(config.FromField), query.Get("AnsweredBy"))
+			outcome = "machine"
+			w.Write([]byte(HangupResponse))
+			return
+		}
+		if len(config.Directory) > 0 {
+			if query.Get("directory") == "" {
+				outcome = "directory"
+				w.Write(directoryResponse(r.URL.Path))
+				return
+			}
+			if query.Get("skip") == "" {
+				// Otherwise the extension was entered before the greeting.
+				extension := query.Get("Digits")
+				if _, ok := config.Directory[extension]; !ok {
+					log.Printf("Unknown extension %q for %s", extension, query.Get(config.ToField))
+				}
+				query.Set("extension", extension)
+			}
+		}
+		outcome = "answered"
+		w.Write(answerResponse(r.URL.Path, query))
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		log.Printf("Failed to parse body: %v", err)
+		outcome = "bad_request"
+		return
+	}
+	if config.AllowRerecord {
+		if twiml, ok := rerecordResponse(r.URL, r.Form, &outcome); ok {
+			w.Write(twiml)
+			return
+		}
+	}
+	twiml := receiveRecording(r.Form, &outcome)
+	if twiml != nil {
+		w.Write(twiml)
+	}
+}
+
+func callStatusHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		log.Printf("Failed to parse body: %v", err)
+		return
+	}
+	sid := r.Form.Get("CallSid")
+	if sid == "" {
+		http.Error(w, "Missing CallSid", http.StatusBadRequest)
+		return
+	}
+	// Duration and price are only present once the call has completed.
+	duration, _ := strconv.Atoi(r.Form.Get("CallDuration"))
+	var callLog CallLog
+	err = updateCallLog(sid, func(stored *CallLog) {
+		if from := r.Form.Get(config.FromField); from != "" {
+			stored.From = from
+		}
+		if to := r.Form.Get(config.ToField); to != "" {
+			stored.To = to
+		}
+		stored.Status = r.Form.Get("CallStatus")
+		stored.Duration = duration
+		stored.Price = r.Form.Get("Price")
+		stored.PriceUnit = r.Form.Get("PriceUnit")
+		callLog = *stored
+	})
+	if err != nil {
+		log.Printf("Failed to store call log for %s: %v", sid, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Call %s is %s (%ds)", sid, callLog.Status, callLog.Duration)
+	if config.AllowRerecord && callLog.Status == "completed" {
+		// The caller may have hung up without confirming their recording.
+		deliverUnconfirmedRecording(sid)
+	}
+}
+
+// answerResponse returns the TwiML to answer a call with, using the recipient's own
+// greeting if enabled. Falls back to the default greeting on any error.
+func answerResponse(path string, query url.Values) []byte {
+	// Set for calls routed through the directory.
+	_, routed := query["extension"]
+	extension := query.Get("extension")
+	if !config.FetchGreetings && config.RecordingStatusCallback == "" && config.SkipGreetingKey == "" && !routed {
+		return response
+	}
+	// Set when the caller pressed a key during the greeting. Any key has already cut
+	// the greeting short, so go on to the beep rather than playing it again.
+	skipped := query.Get("skip") != ""
+	to := query.Get(config.ToField)
+	var greeting *Greeting
+	if config.FetchGreetings && !skipped {
+		recipient := to
+		if identity, ok := config.NumberMap[recipient]; ok {
+			recipient = identity
+		}
+		if routed {
+			recipient = directoryRecipient(extension, recipient)
+		}
+		var err error
+		greeting, err = getGreeting(recipient)
+		if err != nil {
+			log.Printf("Failed to get greeting for %s: %v", recipient, err)
+		}
+	}
+	var callbackURL string
+	if config.RecordingStatusCallback != "" {
+		callbackURL = recordingCallbackURL(query.Get(config.FromField), to)
+	}
+	var recordAction string
+	if routed {
+		recordAction = recordActionURL(path, extension)
+		if callbackURL != "" {
+			callbackURL = addQuery(callbackURL, "extension", extension)
+		}
+	}
+	var skipAction string
+	if config.SkipGreetingKey != "" && !skipped {
+		skipAction = addQuery(path, "skip", "1")
+		if routed {
+			// Skip the directory prompt when the caller comes back.
+			skipAction = addQuery(addQuery(skipAction, "directory", "1"), "extension", extension)
+		}
+	}
+	data, err := renderResponse(greeting, callbackURL, recordAction, skipAction, skipped)
+	if err != nil {
+		log.Printf("Failed to render response for %s: %v", to, err)
+		return response
+	}
+	return data
+}
+
+// backendFor returns the Roger backend that serves the recipient, with the
+// recipient's own token if they have one.
+func backendFor(recipient string) Backend {
+	backend := Backend{AccessToken: config.AccessToken, apiURL: apiURL}
+	longest := -1
+	for prefix, candidate := range config.Backends {
+		if len(prefix) > longest && strings.HasPrefix(recipient, prefix) {
+			backend, longest = candidate, len(prefix)
+		}
+	}
+	if token := recipientToken(recipient); token != "" {
+		backend.AccessToken = token
+	}
+	return backend
+}
+
+// callerName cleans up the CallerName value from Twilio, which is empty or a raw
+// number when no name is known.
+func callerName(name string) string {
+	name = strings.TrimSpace(name)
+	if _, err := normalizeNumber(name); err == nil {
+		return ""
+	}
+	return name
+}
+
+// claimRecording marks the recording as received in Datastore, so that it's only
+// delivered once across all instances. Returns false if it was already claimed.
+func claimRecording(sid string) (claimed bool, err error) {
+	key := nameKey("RecordingClaim", sid)
+	err = runInTransaction(store, func(tx *datastore.Transaction) error {
+		var claim RecordingClaim
+		err := tx.Get(key, &claim)
+		if err == nil {
+			claimed = false
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		claimed = true
+		_, err = tx.Put(key, &RecordingClaim{ClaimedAt: time.Now()})
+		return err
+	})
+	return
+}
+
+// dailyDeliveryKey returns the key of the recipient's DailyDeliveryCount for the day.
+func dailyDeliveryKey(to string, now time.Time) *datastore.Key {
+	return nameKey("DailyDeliveryCount", fmt.Sprintf("%s/%s", to, now.UTC().Format("2006-01-02")))
+}
+
+func deliverMissedCall(from, to string) (err error) {
+	if to == "" {
+		return fmt.Errorf("empty recipient (did someone call us?)")
+	}
+	if from == "" {
+		from = "unknownuser"
+	}
+	if isPaused() {
+		// There's nothing to queue without audio, so just drop it.
+		return errPaused
+	}
+	if !isValidRecipient(to) {
+		log.Printf("Not delivering missed call to invalid recipient %q", to)
+		return errInvalidRecipient
+	}
+	_, toIdentity, err := getIdentityPair(from, to)
+	if toIdentity == nil || toIdentity.Available {
+		// There's nothing to queue without audio, so just drop it.
+		return fmt.Errorf("receiver %s doesn't have an account, dropping missed call", to)
+	}
+	fields := url.Values{
+		"participant": {from},
+		"reason":      {"missed_call"},
+	}
+	if metadata := streamMetadata(to, ""); metadata != "" {
+		fields.Set("metadata", metadata)
+	}
+	_, err = postStream(backendFor(to), toIdentity.Account.ID, 0, fields)
+	return
+}
+
+func deliverPendingVoicemail(voicemail *PendingVoicemail) (err error) {
+	err = deliverVoicemail(*voicemail, true)
+	if err == errDailyCapReached {
+		voicemail.DeliverAfter = nextDay(time.Now())
+		if storeErr := pendingStore.Put(voicemail); storeErr != nil {
+			return fmt.Errorf("%v, failed to postpone pending voicemail: %v", err, storeErr)
+		}
+		return fmt.Errorf("%v for %s, postponed to %s", err, voicemail.To, voicemail.DeliverAfter)
+	}
+	if _, ok := err.(*queuedError); ok {
+		// Waiting for the recipient to sign up doesn't use up a retry, so leave the
+		// stored voicemail as it is.
+		return
+	}
+	if err == errPaused {
+		// Neither does delivery being paused, and it isn't a failure worth alerting on.
+		return
+	}
+	if isNotFound(err) && config.APINotFound != "retry" {
+		if config.APINotFound == "reresolve" && voicemail.StreamID > 0 {
+			log.Printf("Stream %d of pending voicemail %d is gone, delivering to %s again", voicemail.StreamID, voicemail.ID, voicemail.To)
+			voicemail.StreamID, voicemail.StreamAccountID = 0, 0
+			err = deliverVoicemail(*voicemail, true)
+		}
+		if isNotFound(err) {
+			voicemail.DeadLetter = true
+			err = fmt.Errorf("%v (giving up, the account or stream is gone)", err)
+		}
+	}
+	recordDeliveryResult(err)
+	if err != nil {
+		if created, ok := err.(*streamCreatedError); ok {
+			voicemail.StreamID, voicemail.StreamAccountID = created.streamId, created.accountId
+		}
+		// Keep track of the attempt even though delivery failed, and schedule the next.
+		if after, ok := nextAttempt(voicemail.Attempts); !ok {
+			voicemail.DeadLetter = true
+			err = fmt.Errorf("%v (giving up after %d attempts)", err, voicemail.Attempts)
+		} else if !after.IsZero() {
+			voicemail.DeliverAfter = after
+		}
+		if storeErr := pendingStore.Put(voicemail); storeErr != nil {
+			log.Printf("Failed to update attempts for pending voicemail %d: %v", voicemail.ID, storeErr)
+		}
+		return
+	}
+	return pendingStore.MarkDelivered(voicemail.ID)
+}
+
+func deliverVoicemail(voicemail PendingVoicemail, retrying bool) (err error) {
+	if voicemail.To == "" {
+		return fmt.Errorf("empty recipient (did someone call us?)")
+	}
+	if voicemail.From == "" {
+		voicemail.From = "unknownuser"
+	}
+	if isPaused() {
+		if retrying {
+			return errPaused
+		}
+		return queueVoicemail(&voicemail, "delivery is paused")
+	}
+	if voicemail.AudioURL != "" && !voicemail.Encrypted && processesAudio() {
+		// Download outside the delivery slot, so that slow downloads don't hold up
+		// other deliveries.
+		source, cleanup, err := downloadRecording(voicemail.AudioURL)
+		if err != nil {
+			log.Printf("Failed to download %s, posting it as is: %v", voicemail.AudioURL, err)
+		} else {
+			defer cleanup()
+			voicemail.audioFile = source
+		}
+	}
+	from, to, audioURL := voicemail.From, voicemail.To, voicemail.AudioURL
+	backend := backendFor(to)
+	// The cap applies to every delivery to the recipient, including mapped streams
+	// and retries that already have a stream.
+	if config.MaxDailyVoicemails > 0 {
+		now := time.Now()
+		reserved, reserveErr := reserveDailyDelivery(to, now)
+		if reserveErr != nil {
+			// Prefer delivering over dropping when the counter is unavailable.
+			log.Printf("Failed to check daily cap for %s: %v", to, reserveErr)
+		} else if !reserved {
+			if retrying {
+				return errDailyCapReached
+			}
+			voicemail.DeliverAfter = nextDay(now)
+			return queueVoicemail(&voicemail, fmt.Sprintf("receiver %s reached the daily cap", to))
+		} else {
+			defer func() {
+				if err == nil {
+					return
+				}
+				// Only voicemails that were delivered count towards the cap.
+				if releaseErr := releaseDailyDelivery(to, now); releaseErr != nil {
+					log.Printf("Failed to release daily delivery for %s: %v", to, releaseErr)
+				}
+			}()
+		}
+	}
+	if target, ok := config.StreamMap[to]; ok {
+		defer acquireDeliverySlot(retrying)()
+		return voicemail.post(backend, target.AccountId, target.StreamId)
+	}
+	if voicemail.StreamID > 0 {
+		// A previous attempt already created the stream.
+		defer acquireDeliverySlot(retrying)()
+		return voicemail.post(backend, voicemail.StreamAccountID, voicemail.StreamID)
+	}
+	if !isValidRecipient(to) {
+		log.Printf("Not delivering voicemail to invalid recipient %q", to)
+		return errInvalidRecipient
+	}
+	fromIdentity, toIdentity, err := getIdentityPair(from, to)
+	if config.TestRecipient != "" && to == config.TestRecipient {
+		log.Printf("Delivering voicemail for test recipient %s to account %d", to, config.TestAccountId)
+		toIdentity = &Identity{Account: idKey("Account", config.TestAccountId)}
+	}
+	if (toIdentity == nil || toIdentity.Available) && !retrying && config.NoAccountGraceMillis > 0 {
+		// The recipient may be signing up right now, so give them a moment.
+		time.Sleep(time.Duration(config.NoAccountGraceMillis) * time.Millisecond)
+		if identity, graceErr := getIdentity(to); graceErr != nil {
+			log.Printf("Failed to re-check identity %s: %v", to, graceErr)
+		} else if identity != nil && !identity.Available {
+			log.Printf("Receiver %s got an account within %dms", to, config.NoAccountGraceMillis)
+			toIdentity = identity
+		}
+	}
+	if (toIdentity == nil || toIdentity.Available) && shouldProvision(to) {
+		accountId, provisionErr := provisionAccount(backend, to)
+		if provisionErr != nil {
+			log.Printf("Failed to provision an account for %s: %v", to, provisionErr)
+		} else {
+			log.Printf("Provisioned account %d for %s", accountId, to)
+			toIdentity = &Identity{Account: idKey("Account", accountId)}
+		}
+	}
+	if toIdentity == nil || toIdentity.Available {
+		if retrying {
+			// The voicemail is already in the queue, so don't add it.
+			return &queuedError{fmt.Sprintf("retried delivery but %s still doesn't have an account", to)}
+		}
+		posted, slackErr := postVoicemailToSlack(voicemail)
+		if slackErr != nil {
+			log.Printf("Failed to post voicemail for %s to Slack: %v", to, slackErr)
+		} else if posted {
+			log.Printf("Posted voicemail for %s to Slack", to)
+			if !config.SlackAlsoQueue {
+				return nil
+			}
+		}
+		err = queueVoicemail(&voicemail, fmt.Sprintf("receiver %s doesn't have an account", to))
+		if _, ok := err.(*queuedError); ok {
+			// Only tell them about voicemails we kept.
+			notifyNoAccount(voicemail)
+		}
+		return
+	}
+	defer acquireDeliverySlot(retrying)()
+	toId := toIdentity.Account.ID
+	var fromId int64
+	if fromIdentity != nil && !fromIdentity.Available {
+		fromId = fromIdentity.Account.ID
+		if !config.ChunkRecordings {
+			fields := voicemail.chunkFields()
+			fields.Set("participant", strconv.FormatInt(toId, 10))
+			if audioURL != "" {
+				fields.Set("audio_url", audioURL)
+			} else {
+				fields.Set("text", voicemail.Text)
+			}
+			_, err = postStream(backend, fromId, 0, fields)
+			return
+		}
+		// The stream needs to exist before the chunks can be added to it.
+		stream, err := postStream(backend, fromId, 0, url.Values{
+			"participant": {strconv.FormatInt(toId, 10)},
+		})
+		if err != nil {
+			return err
+		}
+		return postToNewStream(voicemail, backend, fromId, stream.Id, retrying)
+	}
+	// Sender has no account, so we need to create the stream in "reverse" first.
+	fields := url.Values{
+		"participant": {from},
+		"reason":      {"voicemail"},
+	}
+	if voicemail.CallerName != "" {
+		fields.Set("display_name", voicemail.CallerName)
+	}
+	if config.StreamType != "" {
+		fields.Set("type", config.StreamType)
+	}
+	stream, err := postStream(backend, toId, 0, fields)
+	if err != nil {
+		return
+	}
+	if len(stream.Others) > 0 {
+		fromId = stream.Others[0].Id
+	} else {
+		// This is a monologue stream (the person left themselves a voicemail).
+		fromId = toId
+		if config.MonologueLabel != "" {
+			if err := voicemail.AddMetadata("sender_label", config.MonologueLabel); err != nil {
+				log.Printf("Failed to label voicemail from %s to themselves: %v", from, err)
+			}
+		}
+	}
+	return postToNewStream(voicemail, backend, fromId, stream.Id, retrying)
+}
+
+// acquireDeliverySlot waits for one of the MaxConcurrentDeliveries slots for posting
+// a voicemail to the Roger API, and returns a function that frees it. Only the posts
+// hold a slot, so that lookups, grace periods and texts don't hold up other calls.
+func acquireDeliverySlot(retrying bool) (release func()) {
+	if deliveryLimiter == nil {
+		return func() {}
+	}
+	// Retries come from the pending queue, so nobody is waiting on them.
+	return deliveryLimiter.Acquire(!retrying)
+}
+
+// deliveryOutcome categorizes the result of deliverVoicemail for logging.
+func deliveryOutcome(err error) string {
+	if err == nil {
+		return "delivered"
+	}
+	if _, ok := err.(*queuedError); ok {
+		return "queued"
+	}
+	if err == errQueueFull {
+		return "shed"
+	}
+	if err == errInvalidRecipient {
+		return "invalid_recipient"
+	}
+	return "failed"
+}
+
+// deliverWithinBudget delivers a voicemail that was just left, but stops waiting after
+// ResponseBudgetSeconds so that we can respond before Twilio times out and retries
+// the callback. The voicemail is queued instead, marked as in flight so that flushes
+// skip it until the delivery has had time to finish (its budget again, plus the
+// HTTPTimeoutSeconds of a last request). Once the delivery in progress finishes, the
+// queued copy is removed if it went through, or released for flushes to retry if it
+// failed. If it can't be queued, the claim on the recording (sid) is kept until the
+// delivery finishes, so that a retry from Twilio doesn't deliver it a second time.
+func deliverWithinBudget(voicemail PendingVoicemail, sid string) error {
+	if config.ResponseBudgetSeconds <= 0 {
+		return deliverVoicemail(voicemail, false)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- deliverVoicemail(voicemail, false)
+	}()
+	budget := time.Duration(config.ResponseBudgetSeconds) * time.Second
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(budget):
+	}
+	pending := voicemail
+	pending.InFlightUntil = time.Now().Add(budget + time.Duration(config.HTTPTimeoutSeconds)*time.Second)
+	err := queueVoicemail(&pending, fmt.Sprintf("delivery took longer than %s", budget))
+	queued := pending.ID != 0
+	if !queued {
+		log.Printf("Delivery took longer than %s and couldn't be queued: %v", budget, err)
+	}
+	// Shutdown waits for this, so that the delivery can finish and tidy up after itself.
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		deliverErr := <-done
+		_, ok := deliverErr.(*queuedError)
+		if !queued {
+			if deliverErr != nil && !ok {
+				log.Printf("Delivery failed after the response budget: %v", deliverErr)
+				// Let Twilio's retry (or its other callback for the recording) deliver it.
+				releaseRecording(sid)
+			}
+			return
+		}
+		if deliverErr != nil && !ok {
+			log.Printf("Delivery failed after the response budget, pending voicemail %d will be retried: %v", pending.ID, deliverErr)
+			pending.InFlightUntil = time.Time{}
+			if err := pendingStore.Put(&pending); err != nil {
+				log.Printf("Failed to release pending voicemail %d: %v", pending.ID, err)
+			}
+			return
+		}
+		// Either it was delivered or it queued a copy of its own.
+		if err := pendingStore.Delete(pending.ID); err != nil {
+			log.Printf("Failed to delete pending voicemail %d: %v", pending.ID, err)
+		}
+	}()
+	if !queued {
+		// The delivery in progress may still succeed, so don't ask the caller to retry.
+		return errStillDelivering
+	}
+	return err
+}
+
+// deliveryEvent describes the outcome of delivering a voicemail.
+func deliveryEvent(voicemail PendingVoicemail, pendingID int64, err error) Event {
+	event := Event{From: voicemail.From, To: voicemail.To, Pending: pendingID}
+	event.Outcome = deliveryOutcome(err)
+	switch event.Outcome {
+	case "delivered", "queued":
+		event.Type = event.Outcome
+	default:
+		event.Type = "failed"
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// flushPendingQueue delivers the pending voicemails that are due. Only one flush runs
+// at a time, so it returns false right away if another one is in progress.
+func flushPendingQueue() bool {
+	if !tryStartFlush() {
+		return false
+	}
+	runFlush()
+	return true
+}
+
+// tryStartFlush claims the flush for the caller, unless one is already running. The
+// caller must then call runFlush.
+func tryStartFlush() bool {
+	flushState.Lock()
+	defer flushState.Unlock()
+	if flushState.running {
+		return false
+	}
+	flushState.running, flushState.progress = true, FlushProgress{StartedAt: time.Now()}
+	return true
+}
+
+// runFlush delivers the pending voicemails that are due, for a flush claimed by
+// tryStartFlush.
+func runFlush() {
+	defer func() {
+		flushState.Lock()
+		flushState.running = false
+		flushState.Unlock()
+	}()
+	if isPaused() {
+		log.Printf("Not flushing pending voicemails while delivery is paused")
+		return
+	}
+	start := time.Now()
+	voicemails, err := pendingStore.Query()
+	if err != nil {
+		log.Printf("Failed to get pending voicemails: %v", err)
+	}
+	checkQueueDepth(len(voicemails))
+	var oldest time.Time
+	var due []*PendingVoicemail
+	for _, voicemail := range voicemails {
+		if !voicemail.CreatedAt.IsZero() && (oldest.IsZero() || voicemail.CreatedAt.Before(oldest)) {
+			oldest = voicemail.CreatedAt
+		}
+		if voicemail.DeadLetter || voicemail.inFlight(time.Now()) || voicemail.DeliverAfter.After(time.Now()) {
+			continue
+		}
+		due = append(due, voicemail)
+	}
+	// Entries created before CreatedAt was tracked don't count towards the age.
+	if oldest.IsZero() {
+		oldestPendingSeconds.Set(0)
+	} else {
+		oldestPendingSeconds.Set(int64(time.Since(oldest).Seconds()))
+	}
+	// Each batch is delivered in order, stopping at the first failure.
+	var batches [][]*PendingVoicemail
+	if config.FlushInOrder {
+		batches = orderedBatches(voicemails, time.Now())
+	} else {
+		for _, voicemail := range due {
+			batches = append(batches, []*PendingVoicemail{voicemail})
+		}
+	}
+	if config.FlushBatchSize > 0 {
+		remaining := config.FlushBatchSize
+		for i, batch := range batches {
+			if len(batch) >= remaining {
+				batches[i] = batch[:remaining]
+				batches = batches[:i+1]
+				break
+			}
+			remaining -= len(batch)
+		}
+	}
+	total := 0
+	for _, batch := range batches {
+		total += len(batch)
+	}
+	flushState.Lock()
+	flushState.progress.Total = total
+	flushState.Unlock()
+	// Deliver with a bounded number of workers.
+	var delivered, failed int64
+	queue := make(chan []*PendingVoicemail)
+	var wg sync.WaitGroup
+	for i := 0; i < config.FlushWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				for _, voicemail := range batch {
+					ok := flushPendingVoicemail(voicemail)
+					flushState.Lock()
+					flushState.progress.Processed++
+					flushState.Unlock()
+					if !ok {
+						atomic.AddInt64(&failed, 1)
+						break
+					}
+					atomic.AddInt64(&delivered, 1)
+				}
+			}
+		}()
+	}
+	for i, batch := range batches {
+		if isDraining() {
+			log.Printf("Shutting down, leaving %d batches of pending voicemails for later", len(batches)-i)
+			break
+		}
+		queue <- batch
+	}
+	close(queue)
+	wg.Wait()
+	log.Printf("Flushed %d pending voicemails (%d delivered, %d failed) in %s", delivered+failed, delivered, failed, time.Since(start))
+	if config.RetrySMS && !isDraining() {
+		flushPendingSMS()
+	}
+}
+
+// currentFlush returns the progress of the flush in progress, if any.
+func currentFlush() (progress FlushProgress, running bool) {
+	flushState.Lock()
+	defer flushState.Unlock()
+	return flushState.progress, flushState.running
+}
+
+// orderedBatches groups pending voicemails by sender and recipient, oldest first, so
+// that each pair's voicemails are delivered in the order they were left. A batch ends
+// before the first voicemail that isn't due yet (or is still being delivered), since
+// the ones after it would otherwise overtake it. Dead letters are skipped.
+func orderedBatches(voicemails []*PendingVoicemail, now time.Time) [][]*PendingVoicemail {
+	var pairs []string
+	groups := make(map[string][]*PendingVoicemail)
+	for _, voicemail := range voicemails {
+		if voicemail.DeadLetter {
+			continue
+		}
+		pair := voicemail.From + "\n" + voicemail.To
+		if _, ok := groups[pair]; !ok {
+			pairs = append(pairs, pair)
+		}
+		groups[pair] = append(groups[pair], voicemail)
+	}
+	var batches [][]*PendingVoicemail
+	for _, pair := range pairs {
+		group := groups[pair]
+		sort.Slice(group, func(i, j int) bool {
+			if !group[i].CreatedAt.Equal(group[j].CreatedAt) {
+				return group[i].CreatedAt.Before(group[j].CreatedAt)
+			}
+			return group[i].ID < group[j].ID
+		})
+		n := 0
+		for n < len(group) && !group[n].inFlight(now) && !group[n].DeliverAfter.After(now) {
+			n++
+		}
+		if n > 0 {
+			batches = append(batches, group[:n])
+		}
+	}
+	return batches
+}
+
+// flushPendingVoicemail attempts delivery of a pending voicemail and reports success.
+func flushPendingVoicemail(voicemail *PendingVoicemail) bool {
+	voicemail.Attempts++
+	err := deliverPendingVoicemail(voicemail)
+	publishEvent(deliveryEvent(*voicemail, voicemail.ID, err))
+	if err != nil {
+		log.Printf("Failed to deliver pending voicemail %d (retry, attempt %d): %v", voicemail.ID, voicemail.Attempts, err)
+		return false
+	}
+	recordingDurations.Observe(float64(voicemail.Duration))
+	if voicemail.Attempts > 1 {
+		log.Printf("Delivered pending voicemail %d to %s (recovered after %d attempts)", voicemail.ID, voicemail.To, voicemail.Attempts)
+	} else {
+		log.Printf("Delivered pending voicemail %d to %s (retry, attempt 1)", voicemail.ID, voicemail.To)
+	}
+	return true
+}
+
+// getIdentity returns the identity, or nil if it doesn't exist.
+func getIdentity(name string) (*Identity, error) {
+	identity := new(Identity)
+	err := store.Get(ctx, nameKey(config.IdentityKind, name), identity)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func getIdentityPair(a, b string) (aa, bb *Identity, err error) {
+	// Ugly hack due to strange design of the Go datastore package.
+	// TODO: Clean up.
+	aa = new(Identity)
+	if err := store.Get(ctx, nameKey(config.IdentityKind, a), aa); err != nil {
+		aa = nil
+	}
+	bb = new(Identity)
+	if err := store.Get(ctx, nameKey(config.IdentityKind, b), bb); err != nil {
+		bb = nil
+	}
+	return
+}
+
+// getPreferences returns the recipient's preferences, or the defaults if they haven't
+// set any.
+func getPreferences(identity string) (*Preferences, error) {
+	prefs := &Preferences{NotifyBySMS: true}
+	err := store.Get(ctx, nameKey("Preferences", identity), prefs)
+	if err == datastore.ErrNoSuchEntity {
+		return &Preferences{NotifyBySMS: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// getStream fetches a stream on behalf of one of its participants, including its most
+// recent chunks.
+func getStream(backend Backend, accountId, streamId int64) (*Stream, error) {
+	ref, err := url.Parse(fmt.Sprintf("streams/%d", streamId))
+	if err != nil {
+		return nil, err
+	}
+	streamURL := backend.apiURL.ResolveReference(ref)
+	streamURL.RawQuery = url.Values{
+		"include_chunks": {"true"},
+		"on_behalf_of":   {strconv.FormatInt(accountId, 10)},
+	}.Encode()
+	req, err := http.NewRequest("GET", streamURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", backend.AccessToken))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s (on behalf of %d) returned %s", req.URL.Path, accountId, resp.Status)
+	}
+	stream := new(Stream)
+	if err := json.NewDecoder(resp.Body).Decode(stream); err != nil {
+		return nil, fmt.Errorf("%s (on behalf of %d) returned invalid JSON: %v", req.URL.Path, accountId, err)
+	}
+	return stream, nil
+}
+
+// idKey returns a numeric key in the configured namespace.
+func idKey(kind string, id int64) *datastore.Key {
+	key := datastore.IDKey(kind, id, nil)
+	key.Namespace = config.DatastoreNamespace
+	return key
+}
+
+// incompleteKey returns a new incomplete key in the configured namespace.
+func incompleteKey(kind string) *datastore.Key {
+	key := datastore.IncompleteKey(kind, nil)
+	key.Namespace = config.DatastoreNamespace
+	return key
+}
+
+// isContention reports whether a Datastore error is caused by contention, so that the
+// operation can be retried.
+func isContention(err error) bool {
+	return err == datastore.ErrConcurrentTransaction || grpc.Code(err) == codes.Aborted
+}
+
+// isEmailIdentity reports whether the identity is an email address rather than a number.
+func isEmailIdentity(identity string) bool {
+	return strings.Contains(identity, "@")
+}
+
+// isAnonymous reports whether a Twilio From value means the caller withheld their
+// number.
+func isAnonymous(from string) bool {
+	switch strings.ToLower(from) {
+	case "", "anonymous", "restricted", "unknown", "unavailable", "private", "+266696687":
+		return true
+	}
+	return false
+}
+
+// isMachine reports whether a Twilio AnsweredBy value indicates a machine or fax.
+func isMachine(answeredBy string) bool {
+	return strings.HasPrefix(answeredBy, "machine_") || answeredBy == "fax"
+}
+
+// isValidRecipient reports whether the recipient matches RecipientPattern or is one
+// of the configured identities, counting the ones that aren't.
+func isValidRecipient(to string) bool {
+	if config.recipientPattern == nil || config.recipientPattern.MatchString(to) || config.mappedRecipients[to] {
+		return true
+	}
+	invalidRecipients.Add(1)
+	return false
+}
+
+// isNotFound reports whether delivery failed because the Roger API returned 404.
+func isNotFound(err error) bool {
+	if created, ok := err.(*streamCreatedError); ok {
+		err = created.err
+	}
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// isSelfCall reports whether the caller called the number they're forwarded from.
+func isSelfCall(from, to string) bool {
+	if number, err := normalizeNumber(from); err == nil {
+		from = number
+	}
+	if number, err := normalizeNumber(to); err == nil {
+		to = number
+	}
+	return from != "" && from == to && !isAnonymous(from)
+}
+
+// isServedNumber reports whether we take voicemail for the number.
+func isServedNumber(number string) bool {
+	if normalized, err := normalizeNumber(number); err == nil {
+		number = normalized
+	}
+	return len(config.ServedNumbers) == 0 || matchesNumber(number, config.ServedNumbers)
+}
+
+func isSMSOptedOut(number string) (bool, error) {
+	var optOut SMSOptOut
+	err := store.Get(ctx, nameKey("SMSOptOut", number), &optOut)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return optOut.OptedOut, nil
+}
+
+func logRequestOutcome(method, path string, start time.Time, outcome *string) {
+	log.Printf("Handled %s %s in %s (%s)", method, path, time.Since(start), *outcome)
+}
+
+func logRequestTime(method, path string, start time.Time) {
+	log.Printf("Handled %s %s in %s", method, path, time.Since(start))
+}
+
+// nameKey returns a named key in the configured namespace.
+func nameKey(kind, name string) *datastore.Key {
+	key := datastore.NameKey(kind, name, nil)
+	key.Namespace = config.DatastoreNamespace
+	return key
+}
+
+// newDatastoreClient connects to Datastore, or to the emulator instead when
+// DATASTORE_EMULATOR_HOST is set.
+func newDatastoreClient() (*datastore.Client, error) {
+	if host := os.Getenv("DATASTORE_EMULATOR_HOST"); host != "" {
+		log.Printf("Using Datastore emulator at %s", host)
+	} else if config.LocalDev {
+		log.Printf("Warning: local development mode without DATASTORE_EMULATOR_HOST uses the real Datastore")
+	}
+	return datastore.NewClient(ctx, config.ProjectId)
+}
+
+// newQuery returns a query for kind in the configured namespace.
+func newQuery(kind string) *datastore.Query {
+	return datastore.NewQuery(kind).Namespace(config.DatastoreNamespace)
+}
+
+// nextAttempt returns when to retry after the given number of failed attempts,
+// following RetrySchedule, or false once all retries have been used up. The time is
+// zero if there's no schedule, meaning the next flush.
+func nextAttempt(attempts int) (after time.Time, ok bool) {
+	schedule := config.retrySchedule
+	if len(schedule) == 0 {
+		return time.Time{}, true
+	}
+	if attempts > len(schedule) {
+		return time.Time{}, false
+	}
+	return time.Now().Add(schedule[attempts-1]), true
+}
+
+// nextDay returns the start of the UTC day following t.
+func nextDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// notifyNoAccount lets a recipient without an account know that they have voicemail.
+func notifyNoAccount(voicemail PendingVoicemail) {
+	to := voicemail.To
+	if !config.NotifyNoAccountBySMS || config.VoicemailText == "" {
+		return
+	}
+	if isEmailIdentity(to) {
+		// TODO: Send an email instead.
+		log.Printf("Not texting email-keyed recipient %s", to)
+		return
+	}
+	prefs, err := getPreferences(to)
+	if err != nil {
+		log.Printf("Failed to get preferences for %s: %v", to, err)
+	} else if !prefs.NotifyBySMS {
+		log.Printf("Not texting %s (disabled in preferences)", to)
+		return
+	}
+	var buf bytes.Buffer
+	err = voicemailTextFor(to).Execute(&buf, struct {
+		From, Name string
+		ID         int64
+	}{voicemail.From, voicemail.CallerName, voicemail.ID})
+	if err != nil {
+		log.Printf("Failed to render SMS for %s: %v", to, err)
+		return
+	}
+	if _, err := sendSMS(to, "no_account", buf.String()); err != nil {
+		log.Printf("Failed to notify %s of voicemail: %v", to, err)
+		if config.RetrySMS {
+			queueSMS(to, "no_account", buf.String(), err)
+		}
+	}
+}
+
+// parseSMSTemplate parses an SMS text template.
+func parseSMSTemplate(text string) (*template.Template, error) {
+	return template.New("sms").Funcs(template.FuncMap{
+		"query": url.QueryEscape,
+	}).Parse(text)
+}
+
+// parseTwilioError extracts a TwilioError from a response body, or returns nil if the
+// body isn't a Twilio error.
+func parseTwilioError(body []byte) *TwilioError {
+	twilioErr := new(TwilioError)
+	if err := json.Unmarshal(body, twilioErr); err != nil || twilioErr.Code == 0 {
+		return nil
+	}
+	return twilioErr
+}
+
+// twilioStatusError describes an unsuccessful response from Twilio, with Twilio's
+// error code and message if the body has them.
+func twilioStatusError(name string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	if twilioErr := parseTwilioError(body); twilioErr != nil {
+		return fmt.Errorf("%s returned %s: %v", name, resp.Status, twilioErr)
+	}
+	return fmt.Errorf("%s returned %s", name, resp.Status)
+}
+
+// pingDatastore does a lightweight Datastore read, to check that it's reachable.
+func pingDatastore() error {
+	var identity Identity
+	err := store.Get(ctx, nameKey(config.IdentityKind, "probe"), &identity)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// postToNewStream adds the voicemail to a stream that was just created for it,
+// retrying up to ChunkRetries times. If that fails, the voicemail is queued with the
+// stream ID, so that retries don't create another empty stream.
+func postToNewStream(voicemail PendingVoicemail, backend Backend, accountId, streamId int64, retrying bool) (err error) {
+	for attempt := 0; attempt <= config.ChunkRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying voicemail for stream %d after error: %v", streamId, err)
+		}
+		if err = voicemail.post(backend, accountId, streamId); err == nil {
+			return nil
+		}
+		if isNotFound(err) {
+			break
+		}
+	}
+	if retrying {
+		return &streamCreatedError{err, streamId, accountId}
+	}
+	voicemail.StreamID, voicemail.StreamAccountID = streamId, accountId
+	return queueVoicemail(&voicemail, fmt.Sprintf("created stream %d but failed to add voicemail (%v)", streamId, err))
+}
+
+// postSMS sends a message through Twilio and returns its SID. If Twilio rate limited
+// the request, the duration to wait before retrying is returned along with the error.
+func postSMS(fields url.Values) (sid string, retryAfter time.Duration, err error) {
+	if config.LocalDev {
+		log.Printf("Local dev: not texting %s: %q", fields.Get("To"), fields.Get("Body"))
+		return
+	}
+	req, err := http.NewRequest("POST", twilioMessagesURL(), strings.NewReader(fields.Encode()))
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(TwilioKeySid, TwilioKeySecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		if retryAfter == 0 {
+			retryAfter = time.Second
+		}
+	}
+	if resp.StatusCode != 201 {
+		return "", retryAfter, twilioStatusError(req.URL.Path, resp)
+	}
+	var message struct {
+		Sid string `json:"sid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+		// The message was still sent.
+		log.Printf("Failed to read SMS response from Twilio: %v", err)
+	}
+	sid = message.Sid
+	return
+}
+
+func postStream(backend Backend, accountId, streamId int64, fields url.Values) (stream *Stream, err error) {
+	return postStreamBody(httpClient, backend, accountId, streamId, []byte(fields.Encode()), "application/x-www-form-urlencoded")
 }
 
-type Stream struct {
-	Id     int64
-	Others []Participant
+// postStreamBody posts to the stream, retrying if the Roger API rate limits us. The
+// wait before each retry is what the API asked for, or exponential backoff if it
+// didn't say, capped at MaxAPIRetryWaitSeconds.
+func postStreamBody(client *http.Client, backend Backend, accountId, streamId int64, payload []byte, contentType string) (stream *Stream, err error) {
+	backoff := 500 * time.Millisecond
+	maxWait := time.Duration(config.MaxAPIRetryWaitSeconds) * time.Second
+	for attempt := 1; ; attempt++ {
+		var retryAfter time.Duration
+		stream, retryAfter, err = tryPostStreamBody(client, backend, accountId, streamId, payload, contentType)
+		if retryAfter < 0 || maxWait == 0 || attempt == MaxAPIAttempts {
+			return
+		}
+		if retryAfter == 0 {
+			retryAfter = backoff
+			backoff *= 2
+		}
+		if retryAfter > maxWait {
+			retryAfter = maxWait
+		}
+		log.Printf("Roger API rate limited %d, retrying in %s", accountId, retryAfter)
+		time.Sleep(retryAfter)
+	}
 }
 
-func main() {
-	// Load configuration from file.
-	data, err := ioutil.ReadFile(ConfigPath)
+// tryPostStreamBody makes a single request to the stream. If the Roger API rate
+// limited it, the duration it asked us to wait (possibly zero) is returned along with
+// the error. Otherwise retryAfter is negative.
+func tryPostStreamBody(client *http.Client, backend Backend, accountId, streamId int64, payload []byte, contentType string) (stream *Stream, retryAfter time.Duration, err error) {
+	retryAfter = -1
+	if config.LocalDev {
+		// Pretend the stream was created with nobody else in it.
+		log.Printf("Local dev: not posting to stream %d on behalf of %d", streamId, accountId)
+		return &Stream{Id: streamId}, retryAfter, nil
+	}
+	var path string
+	if streamId > 0 {
+		path = fmt.Sprintf("streams/%d/chunks", streamId)
+	} else {
+		path = "streams"
+	}
+	ref, err := url.Parse(path)
 	if err != nil {
-		log.Fatalf("Failed to load config (ioutil.ReadFile: %v)", err)
+		return
 	}
-	err = json.Unmarshal(data, &config)
+	streamsURL := backend.apiURL.ResolveReference(ref)
+	query := url.Values{
+		"on_behalf_of": {strconv.FormatInt(accountId, 10)},
+	}
+	streamsURL.RawQuery = query.Encode()
+	req, err := http.NewRequest("POST", streamsURL.String(), bytes.NewReader(payload))
 	if err != nil {
-		log.Fatalf("Failed to load config (json.Unmarshal: %v)", err)
+		return
 	}
-
-	// Set up the Datastore client.
-	store, err = datastore.NewClient(ctx, config.ProjectId)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", backend.AccessToken))
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Failed to create Datastore client (datastore.NewClient: %v)", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		if retryAfter == 0 {
+			retryAfter = parseRateLimitReset(resp.Header.Get("X-RateLimit-Reset"))
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// The account or stream was deleted since we looked it up.
+		return nil, retryAfter, &notFoundError{fmt.Sprintf("%s (on behalf of %d) returned %s", req.URL.Path, accountId, resp.Status)}
+	}
+	if resp.StatusCode != 200 {
+		return nil, retryAfter, fmt.Errorf("%s (on behalf of %d) returned %s", req.URL.Path, accountId, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if len(body) == 0 {
+		return nil, retryAfter, fmt.Errorf("%s (on behalf of %d) returned an empty body", req.URL.Path, accountId)
+	}
+	respType := resp.Header.Get("Content-Type")
+	if respType != "" && !strings.Contains(respType, "json") {
+		return nil, retryAfter, fmt.Errorf("%s (on behalf of %d) returned %s instead of JSON: %q", req.URL.Path, accountId, respType, snippet(body))
+	}
+	stream = new(Stream)
+	if err := json.Unmarshal(body, stream); err != nil {
+		return nil, retryAfter, fmt.Errorf("%s (on behalf of %d) returned invalid JSON (%v): %q", req.URL.Path, accountId, err, snippet(body))
+	}
+	if err := stream.Validate(); err != nil {
+		return nil, retryAfter, fmt.Errorf("%s (on behalf of %d) returned an unexpected stream (%v): %q", req.URL.Path, accountId, err, snippet(body))
 	}
+	return
+}
 
-	// Set up server for handling incoming requests.
-	http.HandleFunc("/v1/call", callHandler)
+// receiveRecording handles a finished recording posted by Twilio, either to the
+// <Record> action or the recording status callback. It returns the TwiML to respond
+// with (if any) and sets the outcome for logging.
+func receiveRecording(form url.Values, outcome *string) []byte {
+	if config.DebugLogForms {
+		log.Printf("Call form: %s", redactForm(form))
+	}
+	from, to := form.Get(config.FromField), form.Get(config.ToField)
+	if to == "" {
+		reportMissingRecipient("recording", form)
+	}
+	if number, err := normalizeNumber(to); err == nil {
+		to = number
+	} else if to != "" {
+		log.Printf("Failed to normalize recipient %q: %v", to, err)
+	}
+	if number, err := normalizeNumber(from); err == nil {
+		from = number
+	}
+	if !isServedNumber(to) {
+		log.Printf("Not delivering voicemail for unserved number %s", to)
+		*outcome = "unserved"
+		return []byte(NotInServiceResponse)
+	}
+	if isSelfCall(from, to) {
+		log.Printf("Self call voicemail from %s", from)
+		if config.SelfCalls == "reject" {
+			*outcome = "self_call"
+			return []byte(HangupResponse)
+		}
+	}
+	if identity, ok := config.NumberMap[to]; ok {
+		to = identity
+	}
+	if extension, ok := form["extension"]; ok && len(config.Directory) > 0 {
+		to = directoryRecipient(extension[0], to)
+	}
+	if isAnonymous(from) {
+		switch config.AnonymousCallers {
+		case "reject":
+			log.Printf("Not delivering anonymous voicemail for %s", to)
+			*outcome = "anonymous"
+			return []byte(HangupResponse)
+		case "per_call":
+			from = "anonymous-" + form.Get("CallSid")
+		default:
+			// Delivered from "unknownuser".
+			from = ""
+		}
+	}
+	// Twilio may post the same recording more than once (e.g. both to the <Record>
+	// action and the status callback), so only deliver it the first time.
+	sid := form.Get("RecordingSid")
+	if sid != "" {
+		// Cheaply drop duplicates seen by this instance before checking Datastore.
+		duplicate := recentRecordings != nil && recentRecordings.CheckAndAdd(sid)
+		if !duplicate {
+			claimed, err := claimRecording(sid)
+			if err != nil {
+				// Prefer a possible duplicate over losing the voicemail.
+				log.Printf("Failed to claim recording %s: %v", sid, err)
+			}
+			duplicate = err == nil && !claimed
+		}
+		if duplicate {
+			log.Printf("Ignoring duplicate callback for recording %s", sid)
+			*outcome = "duplicate"
+			return []byte(ThankYouResponse)
+		}
+	}
+	audioURL := form.Get("RecordingUrl")
+	text := form.Get("TranscriptionText")
+	if audioURL == "" && config.DeliverTranscriptions && text != "" {
+		log.Printf("%s -> %s (transcription only)", from, to)
+	} else if audioURL == "" {
+		if !config.DeliverMissedCalls {
+			log.Printf("%s -> %s (no recording)", from, to)
+			*outcome = "no_recording"
+			return nil
+		}
+		log.Printf("%s -> %s (missed call)", from, to)
+		*outcome = "missed_call"
+		if err := deliverMissedCall(from, to); err != nil {
+			log.Printf("Failed to deliver missed call: %v", err)
+			*outcome = "missed_call_failed"
+			releaseRecording(sid)
+		}
+		return nil
+	}
+	encryptionDetails := form.Get("EncryptionDetails")
+	if audioURL != "" && encryptionDetails == "" {
+		audioURL = rewriteAudioURL(audioURL)
+	}
+	log.Printf("%s -> %s (%s)", from, to, audioURL)
+	voicemail := PendingVoicemail{
+		From:       from,
+		To:         to,
+		AudioURL:   audioURL,
+		CallerName: callerName(form.Get("CallerName")),
+	}
+	if audioURL == "" {
+		voicemail.Text = text
+	}
+	if voicemail.CallerName == "" && config.LookupCallerNames {
+		if _, err := normalizeNumber(from); err == nil {
+			name, err := lookupCallerName(from)
+			if err != nil {
+				log.Printf("Failed to look up caller name for %s: %v", from, err)
+			}
+			voicemail.CallerName = name
+		}
+	}
 
-	log.Printf("Starting server on %s...", config.ListenAddr)
-	if err := http.ListenAndServe(config.ListenAddr, nil); err != nil {
-		log.Fatalf("Failed to serve (http.ListenAndServe: %v)", err)
+	duration, durationErr := strconv.Atoi(form.Get("RecordingDuration"))
+	voicemail.Duration = duration
+	metadata := make(map[string]string)
+	if durationErr == nil && audioURL != "" {
+		if duration < config.MinDurationSeconds {
+			log.Printf("Dropping %ds recording from %s to %s (shorter than %ds)", duration, from, to, config.MinDurationSeconds)
+			*outcome = "too_short"
+			return []byte(HangupResponse)
+		}
+		if config.MaxDurationSeconds > 0 && duration > config.MaxDurationSeconds {
+			// We can't cut the audio without transcoding it, so let the client know.
+			log.Printf("Recording from %s to %s is %ds, longer than %ds", from, to, duration, config.MaxDurationSeconds)
+			metadata["over_max_duration"] = "true"
+		}
+	}
+	if config.AttachOriginalAudioURL && audioURL != "" {
+		metadata["original_audio_url"] = form.Get("RecordingUrl")
+	}
+	if encryptionDetails != "" {
+		// Only the recipient's client has the private key to decrypt the recording.
+		voicemail.Encrypted = true
+		metadata["encryption_details"] = encryptionDetails
+	}
+	for _, field := range config.PassthroughFields {
+		if value := form.Get(field); value != "" {
+			metadata[field] = value
+		}
+	}
+	if prefix := config.PassthroughPrefix; prefix != "" {
+		for key, values := range form {
+			if !strings.HasPrefix(key, prefix) || len(values) == 0 || values[0] == "" {
+				continue
+			}
+			if !metadataKeyPattern.MatchString(key) || sensitiveKeyPattern.MatchString(key) {
+				log.Printf("Not passing on form field %q", key)
+				continue
+			}
+			metadata[key] = values[0]
+		}
+	}
+	if err := voicemail.SetMetadata(metadata); err != nil {
+		log.Printf("Failed to set metadata: %v", err)
+	}
+	publishEvent(Event{Type: "received", From: from, To: to, Duration: voicemail.Duration})
+	err := deliverWithinBudget(voicemail, sid)
+	recordDeliveryResult(err)
+	*outcome = deliveryOutcome(err)
+	publishEvent(deliveryEvent(voicemail, 0, err))
+	if _, queued := err.(*queuedError); err != nil && !queued && err != errStillDelivering {
+		// Let Twilio's retry (or its other callback for the recording) deliver it.
+		releaseRecording(sid)
+	}
+	if err != nil {
+		log.Printf("Failed to deliver voicemail (first attempt): %v", err)
+	} else {
+		recordingDurations.Observe(float64(voicemail.Duration))
 	}
+	if err == errQueueFull {
+		return []byte(QueueFullResponse)
+	}
+	// The caller has left a message, so thank them regardless of delivery.
+	return []byte(ThankYouResponse)
 }
 
-func callHandler(w http.ResponseWriter, r *http.Request) {
-	defer logRequestTime(r.Method, r.URL.Path, time.Now())
-	// GET requests don't contain the recording.
-	if r.Method == "GET" {
-		log.Printf("Incoming call: %s", r.URL.Query())
-		w.Write([]byte(Response))
+func recordingHandler(w http.ResponseWriter, r *http.Request) {
+	outcome := "unknown"
+	defer logRequestOutcome(r.Method, r.URL.Path, time.Now(), &outcome)
+	if config.LogCalls {
+		defer func() {
+			go logCall(r.Form, outcome)
+		}()
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	err := r.ParseForm()
 	if err != nil {
 		log.Printf("Failed to parse body: %v", err)
+		outcome = "bad_request"
 		return
 	}
-	from, to := r.Form.Get("From"), r.Form.Get("ForwardedFrom")
-	audioURL := r.Form.Get("RecordingUrl")
-	if ext := path.Ext(audioURL); ext == "" || ext == ".wav" {
-		// Using MP3 directly is faster.
-		audioURL = audioURL[:len(audioURL)-len(ext)] + ".mp3"
-	}
-	log.Printf("%s -> %s (%s)", from, to, audioURL)
-	err = deliverVoicemail(from, to, audioURL, false)
-	if err != nil {
-		log.Printf("Failed to deliver voicemail: %v", err)
+	if status := r.Form.Get("RecordingStatus"); status != "completed" {
+		log.Printf("Ignoring recording %s with status %s", r.Form.Get("RecordingSid"), status)
+		outcome = "recording_" + status
+		return
 	}
+	// Twilio ignores the response to status callbacks.
+	receiveRecording(r.Form, &outcome)
 }
 
-func deliverPendingVoicemail(key *datastore.Key, voicemail PendingVoicemail) (err error) {
-	err = deliverVoicemail(voicemail.From, voicemail.To, voicemail.AudioURL, true)
+// recordingCallbackURL returns the recording status callback URL for a call. The
+// callback doesn't include the caller and recipient, so they're added to the URL.
+func recordingCallbackURL(from, to string) string {
+	callbackURL, err := url.Parse(config.RecordingStatusCallback)
 	if err != nil {
-		return
+		return config.RecordingStatusCallback
 	}
-	voicemail.Delivered = true
-	_, err = store.Put(ctx, key, &voicemail)
-	return
+	query := callbackURL.Query()
+	query.Set(config.FromField, from)
+	query.Set(config.ToField, to)
+	callbackURL.RawQuery = query.Encode()
+	return callbackURL.String()
 }
 
-func deliverVoicemail(from, to, audioURL string, retrying bool) (err error) {
-	if to == "" {
-		return fmt.Errorf("empty recipient (did someone call us?)")
+// recipientToken returns the recipient's own Roger API token, or an empty string if
+// they don't have one.
+func recipientToken(recipient string) string {
+	if token, ok := config.RecipientTokens[recipient]; ok {
+		return token
 	}
-	if from == "" {
-		from = "unknownuser"
+	if !config.LookupRecipientTokens || recipient == "" {
+		return ""
 	}
-	fromIdentity, toIdentity, err := getIdentityPair(from, to)
-	if toIdentity == nil || toIdentity.Available {
-		if retrying {
-			// The voicemail is already in the queue, so don't add it.
-			return fmt.Errorf("retried delivery but %s still doesn't have an account", to)
+	var token RecipientToken
+	err := store.Get(ctx, nameKey("RecipientToken", recipient), &token)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Printf("Failed to get token for %s, using the default: %v", recipient, err)
+	}
+	return token.Token
+}
+
+// redactForm returns a copy of the form values with anything that looks like a secret
+// masked, so that it can be logged.
+func redactForm(form url.Values) url.Values {
+	redacted := make(url.Values, len(form))
+	for key, values := range form {
+		sensitiveKey := sensitiveKeyPattern.MatchString(key)
+		for _, value := range values {
+			if sensitiveKey || tokenPattern.MatchString(value) {
+				value = redact(value)
+			}
+			redacted[key] = append(redacted[key], value)
 		}
-		pending := PendingVoicemail{
-			From:     from,
-			To:       to,
-			AudioURL: audioURL,
+	}
+	return redacted
+}
+
+// releaseDailyDelivery gives back a delivery counted by reserveDailyDelivery that
+// didn't go through.
+func releaseDailyDelivery(to string, now time.Time) error {
+	key := dailyDeliveryKey(to, now)
+	return runInTransaction(store, func(tx *datastore.Transaction) error {
+		var count DailyDeliveryCount
+		if err := tx.Get(key, &count); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		key, storeErr := store.Put(ctx, datastore.IncompleteKey("PendingVoicemail", nil), &pending)
-		if storeErr != nil {
-			err = fmt.Errorf("receiver %s doesn't have an account, failed to store pending voicemail: %v", to, storeErr)
-		} else {
-			err = fmt.Errorf("receiver %s doesn't have an account, stored pending voicemail (%d)", to, key.ID)
+		if count.Count <= 0 {
+			return nil
 		}
+		count.Count--
+		_, err := tx.Put(key, &count)
+		return err
+	})
+}
+
+// releaseRecording removes the claim on a recording that failed to be delivered, so
+// that it's delivered if Twilio posts it again.
+func releaseRecording(sid string) {
+	if sid == "" {
 		return
 	}
-	toId := toIdentity.Account.ID
-	var fromId int64
-	if fromIdentity != nil && !fromIdentity.Available {
-		fromId = fromIdentity.Account.ID
-		_, err = postStream(fromId, 0, url.Values{
-			"participant": {strconv.FormatInt(toId, 10)},
-			"audio_url":   {audioURL},
-		})
-		return
+	if recentRecordings != nil {
+		recentRecordings.Remove(sid)
 	}
-	// Sender has no account, so we need to create the stream in "reverse" first.
-	// TODO: Give the sender a formatted display name from Twilio.
-	stream, err := postStream(toId, 0, url.Values{
-		"participant": {from},
-		"reason":      {"voicemail"},
+	err := retryContention(func() error {
+		return store.Delete(ctx, nameKey("RecordingClaim", sid))
 	})
 	if err != nil {
+		log.Printf("Failed to release recording %s: %v", sid, err)
+	}
+}
+
+// renderResponse renders the TwiML that answers incoming calls from the config, the
+// recipient's greeting (if any) and the recording status callback URL (if any). With
+// a skip action, the greeting can be skipped by pressing SkipGreetingKey.
+func renderResponse(greeting *Greeting, callbackURL, recordAction, skipAction string, skippedGreeting bool) ([]byte, error) {
+	data := struct {
+		Config
+		Greeting             Greeting
+		RecordingCallbackURL string
+		SkipAction           string
+		SkippedGreeting      bool
+	}{Config: config, RecordingCallbackURL: callbackURL, SkipAction: skipAction, SkippedGreeting: skippedGreeting}
+	if recordAction != "" {
+		data.RecordAction = recordAction
+	}
+	if greeting != nil {
+		data.Greeting = *greeting
+	}
+	var buf bytes.Buffer
+	if err := responseTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// retryContention runs f, retrying with backoff while it fails because of Datastore
+// contention. Other errors, including ErrNoSuchEntity, are returned right away.
+func retryContention(f func() error) (err error) {
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if !isContention(err) || attempt == MaxDatastoreAttempts {
+			return
+		}
+		log.Printf("Datastore contention (attempt %d), retrying in %s: %v", attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// rewriteAudioURL applies AudioURLRewrites to a recording URL.
+func rewriteAudioURL(audioURL string) string {
+	for _, rule := range config.AudioURLRewrites {
+		audioURL = rule.re.ReplaceAllString(audioURL, rule.Replacement)
+	}
+	return audioURL
+}
+
+// runInTransaction runs f in a transaction, retrying it if it keeps failing because
+// of contention.
+func runInTransaction(client *datastore.Client, f func(tx *datastore.Transaction) error) error {
+	return retryContention(func() error {
+		_, err := client.RunInTransaction(ctx, f)
+		return err
+	})
+}
+
+// reportMissingRecipient counts and logs a request without a recipient, which usually
+// means a Twilio number isn't set up to forward calls. If AlertMissingRecipients is
+// set, operators are alerted once that many requests have come in (and then at most
+// once per cooldown).
+func reportMissingRecipient(kind string, form url.Values) {
+	missingRecipients.Add(kind, 1)
+	log.Printf("Missing recipient (%s) for %s from %s: %s", config.ToField, kind, form.Get("To"), redactForm(form))
+	if config.AlertMissingRecipients <= 0 {
 		return
 	}
-	if len(stream.Others) > 0 {
-		fromId = stream.Others[0].Id
-	} else {
-		// This is a monologue stream (the person left themselves a voicemail).
-		fromId = toId
+	var total int64
+	missingRecipients.Do(func(kv expvar.KeyValue) {
+		if count, ok := kv.Value.(*expvar.Int); ok {
+			total += count.Value()
+		}
+	})
+	if total >= int64(config.AlertMissingRecipients) {
+		alert("missing_recipient", fmt.Sprintf("%d requests without a recipient (%s), most recently a %s to %s.", total, config.ToField, kind, form.Get("To")))
 	}
-	_, err = postStream(fromId, stream.Id, url.Values{
-		"audio_url": {audioURL},
+}
+
+// reserveDailyDelivery counts a delivery to the recipient for the current day, and
+// returns false without counting it if the recipient already reached the cap.
+func reserveDailyDelivery(to string, now time.Time) (reserved bool, err error) {
+	key := dailyDeliveryKey(to, now)
+	err = runInTransaction(store, func(tx *datastore.Transaction) error {
+		var count DailyDeliveryCount
+		if err := tx.Get(key, &count); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if count.Count >= config.MaxDailyVoicemails {
+			reserved = false
+			return nil
+		}
+		count.Count++
+		reserved = true
+		_, err := tx.Put(key, &count)
+		return err
 	})
 	return
 }
 
-func flushPendingQueue() {
-	q := datastore.NewQuery("PendingVoicemail").Filter("delivered =", false)
-	t := store.Run(ctx, q)
-	for {
-		var voicemail PendingVoicemail
-		key, err := t.Next(&voicemail)
-		if err == iterator.Done {
-			break
-		} else if err != nil {
-			log.Printf("Failed to get a pending voicemail: %v", err)
-			continue
+// sendSMS texts a message of the given kind (for metrics) to the number, unless it has
+// opted out, and returns the message SID. The SID is empty if nothing was sent.
+func sendSMS(to, kind, message string) (sid string, err error) {
+	outcome := "failed"
+	defer func() {
+		smsMessages.Add(kind+"_"+outcome, 1)
+	}()
+	optedOut, err := isSMSOptedOut(to)
+	if err != nil {
+		return "", fmt.Errorf("failed to check SMS opt-out for %s: %v", to, err)
+	}
+	if optedOut {
+		log.Printf("Not sending SMS to %s (opted out)", to)
+		outcome = "suppressed"
+		return
+	}
+	if !smsAllowed(to) {
+		log.Printf("Not sending SMS to %s (country not in SMSCountryPrefixes)", to)
+		outcome = "disallowed_country"
+		return
+	}
+	fields := url.Values{
+		"From": {TwilioFromNumber},
+		"To":   {to},
+		"Body": {message},
+	}
+	for attempt := 1; ; attempt++ {
+		if smsLimiter != nil {
+			smsLimiter.Wait()
 		}
-		if err := deliverPendingVoicemail(key, voicemail); err != nil {
-			log.Printf("Failed to deliver a pending voicemail: %v", err)
+		var retryAfter time.Duration
+		sid, retryAfter, err = postSMS(fields)
+		if err == nil {
+			outcome = "sent"
+		}
+		if retryAfter == 0 || attempt == MaxSMSAttempts {
+			return
+		}
+		// Twilio asked us to slow down, so hold back all messages, not just this one.
+		log.Printf("Twilio rate limited SMS to %s, retrying in %s", to, retryAfter)
+		if smsLimiter != nil {
+			smsLimiter.PauseFor(retryAfter)
 		} else {
-			log.Printf("Delivered pending voicemail to %s", voicemail.To)
+			time.Sleep(retryAfter)
 		}
 	}
 }
 
-func getIdentityPair(a, b string) (aa, bb *Identity, err error) {
-	// Ugly hack due to strange design of the Go datastore package.
-	// TODO: Clean up.
-	aa = new(Identity)
-	if err := store.Get(ctx, datastore.NameKey("Identity", a, nil), aa); err != nil {
-		aa = nil
+// setOutboundProxy makes the transport use OutboundProxyURL, if configured. Otherwise
+// the transport keeps its proxy, which for the default one is from the environment.
+func setOutboundProxy(transport *http.Transport) {
+	if config.outboundProxy == nil {
+		return
 	}
-	bb = new(Identity)
-	if err := store.Get(ctx, datastore.NameKey("Identity", b, nil), bb); err != nil {
-		bb = nil
+	transport.Proxy = http.ProxyURL(config.outboundProxy)
+	log.Printf("Using outbound proxy %s", redactURL(config.OutboundProxyURL))
+}
+
+func setSMSOptOut(number string, optedOut bool) (err error) {
+	if number == "" {
+		return fmt.Errorf("empty sender")
+	}
+	optOut := SMSOptOut{
+		OptedOut:  optedOut,
+		UpdatedAt: time.Now(),
+	}
+	_, err = store.Put(ctx, nameKey("SMSOptOut", number), &optOut)
+	if err == nil {
+		log.Printf("Set SMS opt-out to %t for %s", optedOut, number)
 	}
 	return
 }
 
-func logRequestTime(method, path string, start time.Time) {
-	log.Printf("Handled %s %s in %s", method, path, time.Since(start))
+// snippet truncates a response body for inclusion in an error message.
+func snippet(body []byte) string {
+	const maxLength = 200
+	if len(body) > maxLength {
+		return string(body[:maxLength]) + "..."
+	}
+	return string(body)
 }
 
-func postStream(accountId, streamId int64, fields url.Values) (stream *Stream, err error) {
-	var path string
-	if streamId > 0 {
-		path = fmt.Sprintf("streams/%d/chunks", streamId)
-	} else {
-		path = "streams"
-	}
-	ref, err := url.Parse(path)
-	if err != nil {
-		return
+// smsAllowed returns whether the number is in a country we send SMS to.
+func smsAllowed(number string) bool {
+	if len(config.SMSCountryPrefixes) == 0 {
+		return true
 	}
-	streamsURL := apiURL.ResolveReference(ref)
-	query := url.Values{
-		"on_behalf_of": {strconv.FormatInt(accountId, 10)},
+	for _, prefix := range config.SMSCountryPrefixes {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
 	}
-	streamsURL.RawQuery = query.Encode()
-	req, err := http.NewRequest("POST", streamsURL.String(), strings.NewReader(fields.Encode()))
-	if err != nil {
+	return false
+}
+
+func smsHandler(w http.ResponseWriter, r *http.Request) {
+	defer logRequestTime(r.Method, r.URL.Path, time.Now())
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.AccessToken))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultClient.Do(req)
+	err := r.ParseForm()
 	if err != nil {
+		log.Printf("Failed to parse body: %v", err)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%s (on behalf of %d) returned %s", req.URL.Path, accountId, resp.Status)
+	from := r.Form.Get("From")
+	// Twilio already replies to these keywords itself, so we only need to record them.
+	switch strings.ToUpper(strings.TrimSpace(r.Form.Get("Body"))) {
+	case "STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT":
+		err = setSMSOptOut(from, true)
+	case "START", "YES", "UNSTOP":
+		err = setSMSOptOut(from, false)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return
+		log.Printf("Failed to update SMS opt-out for %s: %v", from, err)
 	}
-	stream = new(Stream)
-	err = json.Unmarshal(body, stream)
-	return
+	w.Write([]byte(EmptyResponse))
 }
 
-func sendSMS(to, message string) (err error) {
-	fields := url.Values{
-		"From": {TwilioFromNumber},
-		"To":   {to},
-		"Body": {message},
+// queueVoicemail stores a voicemail that couldn't be delivered for the given reason
+// in the pending queue. Returns a queuedError if it was stored, errQueueFull if the
+// queue is full, and any other error if it couldn't be stored.
+func queueVoicemail(voicemail *PendingVoicemail, reason string) error {
+	err := storePendingVoicemail(voicemail)
+	if err == errQueueFull {
+		// Log enough to replay it once the queue has drained.
+		log.Printf("Dropping voicemail %s -> %s (%s) because the pending queue is full: %s", voicemail.From, voicemail.To, voicemail.AudioURL, reason)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%s, failed to store pending voicemail: %v", reason, err)
 	}
-	req, err := http.NewRequest("POST", TwilioMessages, strings.NewReader(fields.Encode()))
-	if err != nil {
-		return
+	return &queuedError{fmt.Sprintf("%s, stored pending voicemail (%d)", reason, voicemail.ID)}
+}
+
+// storePendingVoicemail adds a voicemail to the pending queue, unless the queue
+// already holds MaxPendingQueue voicemails.
+func storePendingVoicemail(pending *PendingVoicemail) error {
+	if config.MaxPendingQueue > 0 && pending.ID == 0 {
+		count, err := pendingStore.Count()
+		if err != nil {
+			// Prefer queuing over dropping when the queue can't be counted.
+			log.Printf("Failed to count pending voicemails: %v", err)
+		} else if count >= config.MaxPendingQueue {
+			shedVoicemails.Add(1)
+			return errQueueFull
+		}
 	}
-	req.SetBasicAuth(TwilioKeySid, TwilioKeySecret)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := http.DefaultClient.Do(req)
+	pending.CreatedAt = time.Now()
+	return pendingStore.Put(pending)
+}
+
+// streamMetadata merges the configured metadata for the recipient with the voicemail's
+// own JSON metadata, returning the JSON to post.
+func streamMetadata(to, metadata string) string {
+	overrides := config.StreamMetadata[to]
+	if len(config.DefaultStreamMetadata) == 0 && len(overrides) == 0 {
+		return metadata
+	}
+	merged := make(map[string]string)
+	for key, value := range config.DefaultStreamMetadata {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &merged); err != nil {
+			log.Printf("Failed to merge metadata %q: %v", metadata, err)
+			return metadata
+		}
+	}
+	data, err := json.Marshal(merged)
 	if err != nil {
-		return
+		log.Printf("Failed to encode metadata: %v", err)
+		return metadata
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("%s returned %s", req.URL.Path, resp.Status)
+	return string(data)
+}
+
+// voicemailTextFor returns the no-account SMS template in the recipient's language.
+func voicemailTextFor(to string) *template.Template {
+	tmpl := config.voicemailText
+	longest := -1
+	for prefix, candidate := range config.localizedVoicemailText {
+		if strings.HasPrefix(to, prefix) && len(prefix) > longest {
+			tmpl, longest = candidate, len(prefix)
+		}
 	}
-	return
+	return tmpl
+}
+
+// waitForDatastore retries probe until it succeeds or the timeout passes, so that we
+// don't accept calls we can't handle.
+func waitForDatastore(probe func() error, timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		if err = probe(); err == nil {
+			log.Printf("Datastore is reachable (attempt %d)", attempt)
+			return nil
+		}
+		log.Printf("Datastore probe failed (attempt %d): %v", attempt, err)
+		if time.Now().Add(probeInterval).After(deadline) {
+			return fmt.Errorf("gave up after %d attempts: %v", attempt, err)
+		}
+		time.Sleep(probeInterval)
+	}
+}
+
+// xmlEscape escapes a string for use in XML text or attribute values.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
 }
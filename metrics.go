@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+)
+
+// Metrics are exported through expvar at /debug/vars.
+var (
+	oldestPendingSeconds = expvar.NewInt("oldest_pending_seconds")
+	recordingDurations   = newHistogram("recording_duration_seconds", []float64{5, 15, 30, 60, 120, 300})
+	// Time between Twilio sending a status callback and us receiving it.
+	twilioLatencies = newHistogram("twilio_latency_seconds", []float64{0.5, 1, 2, 5, 10, 30})
+	// Counts requests without a recipient number (usually a misconfigured Twilio
+	// number), by "call" or "recording".
+	missingRecipients = expvar.NewMap("missing_recipient")
+	// Counts deliveries dropped because the recipient didn't match RecipientPattern.
+	invalidRecipients = expvar.NewInt("invalid_recipients")
+	// Counts voicemails dropped because the pending queue was full.
+	shedVoicemails = expvar.NewInt("shed_voicemails")
+	// Counts SMS by message type and outcome, e.g. "no_account_sent".
+	smsMessages = expvar.NewMap("sms_messages")
+	// Counts caller name lookups by "hit" or "miss" of the cache.
+	callerNameLookups = expvar.NewMap("caller_name_lookups")
+)
+
+// histogram counts observations into cumulative buckets, Prometheus style. Each
+// bucket "le_<bound>" counts observations less than or equal to the bound.
+type histogram struct {
+	bounds []float64
+	m      *expvar.Map
+}
+
+func newHistogram(name string, bounds []float64) *histogram {
+	return &histogram{bounds: bounds, m: expvar.NewMap(name)}
+}
+
+func (h *histogram) Observe(value float64) {
+	for _, bound := range h.bounds {
+		if value <= bound {
+			h.m.Add(fmt.Sprintf("le_%g", bound), 1)
+		}
+	}
+	h.m.Add("le_inf", 1)
+	h.m.AddFloat("sum", value)
+	h.m.Add("count", 1)
+}
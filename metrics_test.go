@@ -0,0 +1,229 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bucketCount returns the count of the histogram bucket, e.g. "le_15".
+func bucketCount(h *histogram, bucket string) int64 {
+	count, ok := h.m.Get(bucket).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
+
+func TestHistogramObserve(t *testing.T) {
+	h := newHistogram(fmt.Sprintf("test_histogram_%d", time.Now().UnixNano()), []float64{5, 15, 30})
+	h.Observe(10)
+	want := map[string]int64{"le_5": 0, "le_15": 1, "le_30": 1, "le_inf": 1, "count": 1}
+	for bucket, count := range want {
+		if got := bucketCount(h, bucket); got != count {
+			t.Errorf("Bucket %s is %d after observing 10, want %d", bucket, got, count)
+		}
+	}
+	h.Observe(5)
+	h.Observe(400)
+	want = map[string]int64{"le_5": 1, "le_15": 2, "le_30": 2, "le_inf": 3, "count": 3}
+	for bucket, count := range want {
+		if got := bucketCount(h, bucket); got != count {
+			t.Errorf("Bucket %s is %d after observing 10, 5 and 400, want %d", bucket, got, count)
+		}
+	}
+	if sum := h.m.Get("sum").(*expvar.Float).Value(); sum != 415 {
+		t.Errorf("Sum is %g, want 415", sum)
+	}
+}
+
+func TestRecordingDurationsObservedOnFlush(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, streamHandler(7, 99))
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1", Duration: 20}
+	if err := pendingStore.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	before, beforeShort := bucketCount(recordingDurations, "le_30"), bucketCount(recordingDurations, "le_15")
+	if !flushPendingVoicemail(voicemail) {
+		t.Fatal("flushPendingVoicemail() failed")
+	}
+	if got := bucketCount(recordingDurations, "le_30"); got != before+1 {
+		t.Errorf("Bucket le_30 went from %d to %d, want one more", before, got)
+	}
+	if got := bucketCount(recordingDurations, "le_15"); got != beforeShort {
+		t.Errorf("Bucket le_15 went from %d to %d for a 20s recording", beforeShort, got)
+	}
+}
+
+func TestRecordingDurationsNotObservedOnFailure(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	})
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1", Duration: 20}
+	if err := pendingStore.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	before := bucketCount(recordingDurations, "count")
+	flushPendingVoicemail(voicemail)
+	if got := bucketCount(recordingDurations, "count"); got != before {
+		t.Errorf("Failed delivery changed the count from %d to %d", before, got)
+	}
+}
+
+// smsCount returns the number of SMS counted with the kind and outcome.
+func smsCount(key string) int64 {
+	count, ok := smsMessages.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
+
+func TestSMSMessagesCounted(t *testing.T) {
+	useDatastore(t)
+	captureLog(t)
+	sent, failed, suppressed := smsCount("test_sent"), smsCount("test_failed"), smsCount("test_suppressed")
+
+	interceptHTTP(t, new(smsTimes).ServeHTTP)
+	if _, err := sendSMS("+14155550100", "test", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := smsCount("test_sent") - sent; got != 1 {
+		t.Errorf("Sending an SMS counted %d test_sent, want 1", got)
+	}
+
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"code": 21211, "message": "Invalid 'To' Phone Number", "status": 400}`)
+	})
+	if _, err := sendSMS("+14155550100", "test", "Hello"); err == nil {
+		t.Fatal("sendSMS() succeeded, want the Twilio error")
+	}
+	if got := smsCount("test_failed") - failed; got != 1 {
+		t.Errorf("Failing to send an SMS counted %d test_failed, want 1", got)
+	}
+
+	if err := setSMSOptOut("+14155550100", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendSMS("+14155550100", "test", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := smsCount("test_suppressed") - suppressed; got != 1 {
+		t.Errorf("Texting an opted out number counted %d test_suppressed, want 1", got)
+	}
+	if got := smsCount("test_sent") - sent; got != 1 {
+		t.Errorf("Counted %d test_sent in total, want 1", got)
+	}
+}
+
+func missingRecipientCount(kind string) int64 {
+	count, ok := missingRecipients.Get(kind).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return count.Value()
+}
+
+func TestMissingRecipientCounted(t *testing.T) {
+	logs := captureLog(t)
+	calls, recordings := missingRecipientCount("call"), missingRecipientCount("recording")
+	getCall(url.Values{"From": {"+14155550101"}, "To": {"+14155550199"}})
+	postForm(recordingHandler, "/v1/recording?From=%2B14155550101&To=%2B14155550199", url.Values{
+		"RecordingUrl":    {"https://api.twilio.com/recordings/RE1"},
+		"RecordingSid":    {"RE1"},
+		"RecordingStatus": {"completed"},
+	})
+	if got := missingRecipientCount("call") - calls; got != 1 {
+		t.Errorf("Counted %d calls without a recipient, want 1", got)
+	}
+	if got := missingRecipientCount("recording") - recordings; got != 1 {
+		t.Errorf("Counted %d recordings without a recipient, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "Missing recipient (ForwardedFrom) for call from +14155550199") {
+		t.Errorf("Log = %q, want the misconfigured number logged", logs.String())
+	}
+}
+
+func TestMissingRecipientNotCountedWithRecipient(t *testing.T) {
+	captureLog(t)
+	calls := missingRecipientCount("call")
+	getCall(url.Values{"From": {"+14155550101"}, "ForwardedFrom": {"+14155550100"}})
+	if got := missingRecipientCount("call") - calls; got != 0 {
+		t.Errorf("Counted %d calls without a recipient, want none", got)
+	}
+}
+
+func TestMissingRecipientAlert(t *testing.T) {
+	var total int64
+	missingRecipients.Do(func(kv expvar.KeyValue) {
+		total += kv.Value.(*expvar.Int).Value()
+	})
+	messages := useAlerts(t, func(c *Config) {
+		c.AlertMissingRecipients = int(total) + 2
+	})
+	getCall(url.Values{"From": {"+14155550101"}, "To": {"+14155550199"}})
+	if received := receivedAlerts(messages); len(received) != 0 {
+		t.Errorf("Alerted %q below the threshold", received)
+	}
+	getCall(url.Values{"From": {"+14155550101"}, "To": {"+14155550199"}})
+	received := receivedAlerts(messages)
+	if len(received) != 1 || !strings.Contains(received[0], "+14155550199") {
+		t.Errorf("Alerts = %q, want one naming the misconfigured number", received)
+	}
+}
+
+func TestTwilioLatency(t *testing.T) {
+	receivedAt := time.Date(2026, 10, 14, 12, 0, 3, 500e6, time.UTC)
+	latency, ok := twilioLatency(url.Values{"Timestamp": {"Wed, 14 Oct 2026 12:00:00 +0000"}}, receivedAt)
+	if !ok || latency != 3500*time.Millisecond {
+		t.Errorf("twilioLatency() = %s, %t, want 3.5s", latency, ok)
+	}
+	captureLog(t)
+	for _, form := range []url.Values{{}, {"Timestamp": {"yesterday"}}} {
+		if latency, ok := twilioLatency(form, receivedAt); ok {
+			t.Errorf("twilioLatency(%v) = %s, want no latency", form, latency)
+		}
+	}
+}
+
+func TestTwilioLatencyRecorded(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) { c.LogTwilioLatency = true })
+	logs := captureLog(t)
+	before := bucketCount(twilioLatencies, "le_5")
+	form := url.Values{"CallSid": {"CA1"}, "CallStatus": {"completed"}, "Timestamp": {time.Now().Add(-2 * time.Second).Format(time.RFC1123Z)}}
+	if rec := postForm(requireTwilio(callStatusHandler), "/v1/call-status", form); rec.Code != http.StatusOK {
+		t.Fatalf("Status callback got %d: %s", rec.Code, rec.Body)
+	}
+	if got := bucketCount(twilioLatencies, "le_5"); got != before+1 {
+		t.Errorf("le_5 bucket went from %d to %d, want one more", before, got)
+	}
+	if !strings.Contains(logs.String(), "Twilio sent POST /v1/call-status") {
+		t.Errorf("Latency wasn't logged:\n%s", logs)
+	}
+}
+
+func TestTwilioLatencyOffByDefault(t *testing.T) {
+	useDatastore(t)
+	logs := captureLog(t)
+	before := bucketCount(twilioLatencies, "count")
+	form := url.Values{"CallSid": {"CA1"}, "CallStatus": {"completed"}, "Timestamp": {time.Now().Format(time.RFC1123Z)}}
+	postForm(requireTwilio(callStatusHandler), "/v1/call-status", form)
+	if got := bucketCount(twilioLatencies, "count"); got != before {
+		t.Error("Recorded latency without LogTwilioLatency")
+	}
+	if strings.Contains(logs.String(), "Twilio sent") {
+		t.Errorf("Latency was logged without LogTwilioLatency:\n%s", logs)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// normalizeNumber converts a phone number in a common format to E.164 (e.g.
+// "(415) 555-0100" to "+14155550100"). Numbers without a country code are assumed
+// to be North American.
+func normalizeNumber(raw string) (string, error) {
+	if len(raw) > 64 {
+		return "", fmt.Errorf("phone number is too long")
+	}
+	trimmed := strings.TrimSpace(raw)
+	digits := make([]byte, 0, len(trimmed))
+	international := false
+	for i, r := range trimmed {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, byte(r))
+		case r == '+' && i == 0:
+			international = true
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+			// Formatting characters are ignored.
+		default:
+			return "", fmt.Errorf("invalid character %q in phone number", r)
+		}
+	}
+	if !international {
+		switch {
+		case len(digits) == 10:
+			digits = append([]byte("1"), digits...)
+		case len(digits) == 11 && digits[0] == '1':
+		default:
+			return "", fmt.Errorf("phone number %q has no country code", raw)
+		}
+	}
+	if len(digits) < 8 || len(digits) > 15 {
+		return "", fmt.Errorf("phone number %q has an invalid length", raw)
+	}
+	if digits[0] == '0' {
+		return "", fmt.Errorf("phone number %q has an invalid country code", raw)
+	}
+	return "+" + string(digits), nil
+}
+
+// matchesNumber reports whether the number is in the list. Entries ending in "*"
+// match by prefix.
+func matchesNumber(number string, list []string) bool {
+	for _, entry := range list {
+		if strings.HasSuffix(entry, "*") {
+			if strings.HasPrefix(number, strings.TrimSuffix(entry, "*")) {
+				return true
+			}
+		} else if number == entry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+func TestNormalizeNumber(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"+14155550100", "+14155550100"},
+		{"(415) 555-0100", "+14155550100"},
+		{"415.555.0100", "+14155550100"},
+		{"4155550100", "+14155550100"},
+		{"1-415-555-0100", "+14155550100"},
+		{" +1 415 555 0100 ", "+14155550100"},
+		{"+44 20 7946 0958", "+442079460958"},
+		{"+46 70 123 45 67", "+46701234567"},
+	}
+	for _, test := range tests {
+		got, err := normalizeNumber(test.raw)
+		if err != nil {
+			t.Errorf("normalizeNumber(%q) failed: %v", test.raw, err)
+		} else if got != test.want {
+			t.Errorf("normalizeNumber(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeNumberErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"anonymous",
+		"client:alice",
+		"555-0100",
+		"24155550100",
+		"+0123456789",
+		"+1234567",
+		"+1234567890123456",
+		"415+5550100",
+		"+1415555\x000100",
+		"+1415555\n0100",
+		"+١٤١٥٥٥٥٠١٠٠",
+		"＋14155550100",
+		strings.Repeat("1", 65),
+	}
+	for _, raw := range tests {
+		if got, err := normalizeNumber(raw); err == nil {
+			t.Errorf("normalizeNumber(%q) = %q, want an error", raw, got)
+		}
+	}
+}
+
+func FuzzNormalizeNumber(f *testing.F) {
+	for _, seed := range []string{
+		"+14155550100",
+		"(415) 555-0100",
+		"415.555.0100",
+		"4155550100",
+		"1-415-555-0100",
+		"+44 20 7946 0958",
+		"anonymous",
+		"client:alice",
+		"+266696687",
+		"",
+		"+",
+		"+1415555\x000100",
+		"+١٤١٥٥٥٥٠١٠٠",
+		strings.Repeat("9", 100),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		number, err := normalizeNumber(raw)
+		if err != nil {
+			if number != "" {
+				t.Errorf("normalizeNumber(%q) returned %q along with an error", raw, number)
+			}
+			if err.Error() == "" {
+				t.Errorf("normalizeNumber(%q) returned an empty error", raw)
+			}
+			return
+		}
+		if !e164Pattern.MatchString(number) {
+			t.Fatalf("normalizeNumber(%q) = %q, which isn't E.164", raw, number)
+		}
+		if again, err := normalizeNumber(number); err != nil || again != number {
+			t.Errorf("normalizeNumber(%q) = %q, %v, want it unchanged", number, again, err)
+		}
+	})
+}
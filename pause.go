@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// How long an instance may keep using a cached pause flag before reading it again.
+const PauseCacheDuration = 10 * time.Second
+
+// DeliveryPause is a global switch that holds back all delivery, shared by every
+// instance. Keyed by "delivery".
+type DeliveryPause struct {
+	Paused    bool      `datastore:"paused,noindex"`
+	UpdatedAt time.Time `datastore:"updated_at,noindex"`
+}
+
+var pauseCache struct {
+	sync.Mutex
+	paused    bool
+	fetchedAt time.Time
+}
+
+// isPaused reports whether delivery is paused. If the flag can't be read, the last
+// known value is used until it's time to read it again, so that a Datastore outage
+// doesn't add a failing read to every call. The read happens outside the lock, so a
+// slow read doesn't hold up deliveries that could use the cached value.
+func isPaused() bool {
+	pauseCache.Lock()
+	paused, fresh := pauseCache.paused, time.Since(pauseCache.fetchedAt) < PauseCacheDuration
+	pauseCache.Unlock()
+	if fresh {
+		return paused
+	}
+	start := time.Now()
+	var pause DeliveryPause
+	err := store.Get(ctx, nameKey("DeliveryPause", "delivery"), &pause)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Printf("Failed to get delivery pause: %v", err)
+	}
+	pauseCache.Lock()
+	defer pauseCache.Unlock()
+	if pauseCache.fetchedAt.After(start) {
+		// Someone set or read the flag while we were reading it, so theirs is newer.
+		return pauseCache.paused
+	}
+	if err == nil || err == datastore.ErrNoSuchEntity {
+		pauseCache.paused = pause.Paused
+	}
+	pauseCache.fetchedAt = time.Now()
+	return pauseCache.paused
+}
+
+// setPaused pauses or resumes delivery for all instances. Other instances notice
+// within PauseCacheDuration.
+func setPaused(paused bool) error {
+	pause := DeliveryPause{Paused: paused, UpdatedAt: time.Now()}
+	if _, err := store.Put(ctx, nameKey("DeliveryPause", "delivery"), &pause); err != nil {
+		return err
+	}
+	pauseCache.Lock()
+	pauseCache.paused = paused
+	pauseCache.fetchedAt = time.Now()
+	pauseCache.Unlock()
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expirePauseCache makes the next isPaused read the flag from Datastore.
+func expirePauseCache() {
+	pauseCache.Lock()
+	pauseCache.fetchedAt = time.Time{}
+	pauseCache.Unlock()
+}
+
+func TestPauseHandler(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	captureLog(t)
+	if rec := adminRequest(pauseHandler, "POST", "/v1/pause", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"paused": true`) {
+		t.Fatalf("Pause returned %d: %s", rec.Code, rec.Body)
+	}
+	expirePauseCache()
+	if !isPaused() {
+		t.Error("Delivery isn't paused in Datastore after POST /v1/pause")
+	}
+	if rec := adminRequest(pauseHandler, "POST", "/v1/resume", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"paused": false`) {
+		t.Fatalf("Resume returned %d: %s", rec.Code, rec.Body)
+	}
+	expirePauseCache()
+	if isPaused() {
+		t.Error("Delivery is still paused after POST /v1/resume")
+	}
+	if rec := adminRequest(pauseHandler, "GET", "/v1/pause", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /v1/pause returned %d, want 405", rec.Code)
+	}
+}
+
+func TestPausedRecordingQueued(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	putIdentity(t, "+14155550100", 42)
+	cachePause(t, true)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	captureLog(t)
+	rec := postRecordingAction("RE1")
+	if !strings.Contains(rec.Body.String(), "<Response>") {
+		t.Errorf("Recording while paused got %q, want TwiML", rec.Body)
+	}
+	if requests := fake.RequestsTo("/streams"); len(requests) != 0 {
+		t.Errorf("Delivered %d requests while paused", len(requests))
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails pending after a recording while paused, want 1", count)
+	}
+}
+
+func TestPausedMissedCallDropped(t *testing.T) {
+	useDatastore(t)
+	putIdentity(t, "+14155550100", 42)
+	cachePause(t, true)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	if err := deliverMissedCall("+14155550101", "+14155550100"); err != errPaused {
+		t.Errorf("deliverMissedCall() while paused = %v, want errPaused", err)
+	}
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("Missed call made %d requests while paused", len(requests))
+	}
+}
+
+func TestPausedFlushSuspended(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	putIdentity(t, "+14155550100", 42)
+	queuePending(t, 2)
+	cachePause(t, true)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	captureLog(t)
+	flushPendingQueue()
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("Flush made %d requests while paused", len(requests))
+	}
+	if count, _ := memory.Count(); count != 2 {
+		t.Errorf("%d voicemails pending after a paused flush, want 2", count)
+	}
+}
+
+func TestPausedRetryKeepsAttempts(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.AlertConsecutiveFailures = 1
+	})
+	t.Cleanup(func() {
+		alerts.Lock()
+		alerts.consecutiveFailures = 0
+		alerts.Unlock()
+	})
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1", Attempts: 2}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	// Paused between the start of the flush and this delivery.
+	cachePause(t, true)
+	captureLog(t)
+	flushPendingVoicemail(voicemail)
+	stored, err := memory.Get(voicemail.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Attempts != 2 || !stored.DeliverAfter.IsZero() || stored.DeadLetter {
+		t.Errorf("Paused retry changed the pending voicemail to %+v", stored)
+	}
+	alerts.Lock()
+	failures := alerts.consecutiveFailures
+	alerts.Unlock()
+	if failures != 0 {
+		t.Errorf("Paused retry counted %d failed deliveries, want none", failures)
+	}
+}
+
+func TestPauseReadFailureCached(t *testing.T) {
+	useDatastore(t)
+	cachePause(t, true)
+	expirePauseCache()
+	failDatastore(t)
+	logs := captureLog(t)
+	if !isPaused() {
+		t.Error("isPaused() didn't use the last known value when Datastore failed")
+	}
+	isPaused()
+	if n := strings.Count(logs.String(), "Failed to get delivery pause"); n != 1 {
+		t.Errorf("Datastore was read %d times within PauseCacheDuration, want once", n)
+	}
+}
+
+func TestPausedReplayQueued(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	putIdentity(t, "+14155550100", 42)
+	cachePause(t, true)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	form := url.Values{"RecordingSid": {"RE1"}, "from": {"+14155550101"}, "to": {"+14155550100"}, "audio_url": {"https://api.twilio.com/recordings/RE1"}}
+	if rec := adminRequest(replayHandler, "POST", "/v1/replay", form.Encode()); rec.Code != http.StatusAccepted {
+		t.Errorf("Replay while paused returned %d, want 202", rec.Code)
+	}
+	if requests := fake.RequestsTo("/streams"); len(requests) != 0 {
+		t.Errorf("Replay delivered %d requests while paused", len(requests))
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails pending after a replay while paused, want 1", count)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// PendingStore persists voicemails that couldn't be delivered yet.
+type PendingStore interface {
+	// Put creates or updates a pending voicemail. A voicemail with a zero ID is new and
+	// gets assigned an ID.
+	Put(voicemail *PendingVoicemail) error
+	// Get returns a single pending voicemail.
+	Get(id int64) (*PendingVoicemail, error)
+	// Query returns all voicemails that haven't been delivered yet.
+	Query() ([]*PendingVoicemail, error)
+	// Count returns the number of voicemails that haven't been delivered yet.
+	Count() (int, error)
+	Delete(id int64) error
+	MarkDelivered(id int64) error
+}
+
+func newPendingStore(backend string) (PendingStore, error) {
+	switch backend {
+	case "datastore":
+		return &datastorePendingStore{client: store}, nil
+	case "memory":
+		return newMemoryPendingStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown pending store %q", backend)
+	}
+}
+
+// datastorePendingStore keeps pending voicemails in Datastore.
+type datastorePendingStore struct {
+	client *datastore.Client
+}
+
+func (s *datastorePendingStore) Put(voicemail *PendingVoicemail) error {
+	key := incompleteKey(config.PendingKind)
+	if voicemail.ID != 0 {
+		key = idKey(config.PendingKind, voicemail.ID)
+	}
+	var stored *datastore.Key
+	err := retryContention(func() (err error) {
+		stored, err = s.client.Put(ctx, key, voicemail)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	voicemail.ID = stored.ID
+	return nil
+}
+
+func (s *datastorePendingStore) Get(id int64) (*PendingVoicemail, error) {
+	voicemail := new(PendingVoicemail)
+	if err := s.client.Get(ctx, idKey(config.PendingKind, id), voicemail); err != nil {
+		return nil, err
+	}
+	voicemail.ID = id
+	return voicemail, nil
+}
+
+func (s *datastorePendingStore) Query() ([]*PendingVoicemail, error) {
+	q := newQuery(config.PendingKind).Filter("delivered =", false)
+	t := s.client.Run(ctx, q)
+	var voicemails []*PendingVoicemail
+	for {
+		voicemail := new(PendingVoicemail)
+		key, err := t.Next(voicemail)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return voicemails, err
+		}
+		voicemail.ID = key.ID
+		voicemails = append(voicemails, voicemail)
+	}
+	return voicemails, nil
+}
+
+func (s *datastorePendingStore) Count() (int, error) {
+	return s.client.Count(ctx, newQuery(config.PendingKind).Filter("delivered =", false).KeysOnly())
+}
+
+func (s *datastorePendingStore) Delete(id int64) error {
+	return retryContention(func() error {
+		return s.client.Delete(ctx, idKey(config.PendingKind, id))
+	})
+}
+
+func (s *datastorePendingStore) MarkDelivered(id int64) error {
+	key := idKey(config.PendingKind, id)
+	return runInTransaction(s.client, func(tx *datastore.Transaction) error {
+		var voicemail PendingVoicemail
+		if err := tx.Get(key, &voicemail); err != nil {
+			return err
+		}
+		voicemail.Delivered = true
+		_, err := tx.Put(key, &voicemail)
+		return err
+	})
+}
+
+// cachedPendingStore mirrors the pending queue of another store in memory, so that a
+// flush shortly after the last one (or right after queueing) doesn't need a full
+// Datastore query. The underlying store is the source of truth: every write goes to it
+// first, mirrored voicemails are got from it again on every query, and the mirror is
+// reloaded from it once it's older than the TTL. This also means voicemails queued by
+// this instance show up right away, even though Datastore queries are only eventually
+// consistent.
+type cachedPendingStore struct {
+	PendingStore
+	ttl        time.Duration
+	mu         sync.Mutex
+	loadedAt   time.Time
+	voicemails map[int64]PendingVoicemail
+}
+
+func newCachedPendingStore(underlying PendingStore, ttl time.Duration) *cachedPendingStore {
+	return &cachedPendingStore{
+		PendingStore: underlying,
+		ttl:          ttl,
+		voicemails:   make(map[int64]PendingVoicemail),
+	}
+}
+
+func (s *cachedPendingStore) Put(voicemail *PendingVoicemail) error {
+	if err := s.PendingStore.Put(voicemail); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if voicemail.Delivered {
+		delete(s.voicemails, voicemail.ID)
+	} else {
+		s.voicemails[voicemail.ID] = *voicemail
+	}
+	return nil
+}
+
+func (s *cachedPendingStore) Query() ([]*PendingVoicemail, error) {
+	s.mu.Lock()
+	if time.Since(s.loadedAt) < s.ttl {
+		ids := make([]int64, 0, len(s.voicemails))
+		for id := range s.voicemails {
+			ids = append(ids, id)
+		}
+		s.mu.Unlock()
+		return s.refresh(ids)
+	}
+	s.mu.Unlock()
+	voicemails, err := s.PendingStore.Query()
+	if err != nil {
+		return voicemails, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.voicemails = make(map[int64]PendingVoicemail, len(voicemails))
+	for _, voicemail := range voicemails {
+		s.voicemails[voicemail.ID] = *voicemail
+	}
+	s.loadedAt = time.Now()
+	return voicemails, nil
+}
+
+// refresh gets the mirrored voicemails from the underlying store again. Other instances
+// may have delivered, deleted or dead-lettered them since they were mirrored, and
+// unlike a query, getting them by key always sees that.
+func (s *cachedPendingStore) refresh(ids []int64) ([]*PendingVoicemail, error) {
+	var voicemails []*PendingVoicemail
+	var firstErr error
+	for _, id := range ids {
+		voicemail, err := s.PendingStore.Get(id)
+		if err == datastore.ErrNoSuchEntity || (err == nil && voicemail.Delivered) {
+			s.evict(id)
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.mu.Lock()
+		if _, ok := s.voicemails[id]; ok {
+			s.voicemails[id] = *voicemail
+		}
+		s.mu.Unlock()
+		voicemails = append(voicemails, voicemail)
+	}
+	sort.Sort(byID(voicemails))
+	return voicemails, firstErr
+}
+
+func (s *cachedPendingStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.loadedAt) < s.ttl {
+		return len(s.voicemails), nil
+	}
+	return s.PendingStore.Count()
+}
+
+func (s *cachedPendingStore) Delete(id int64) error {
+	if err := s.PendingStore.Delete(id); err != nil {
+		return err
+	}
+	s.evict(id)
+	return nil
+}
+
+func (s *cachedPendingStore) MarkDelivered(id int64) error {
+	if err := s.PendingStore.MarkDelivered(id); err != nil {
+		return err
+	}
+	s.evict(id)
+	return nil
+}
+
+func (s *cachedPendingStore) evict(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.voicemails, id)
+}
+
+// memoryPendingStore keeps pending voicemails in memory, for local development.
+type memoryPendingStore struct {
+	mu         sync.Mutex
+	nextID     int64
+	voicemails map[int64]PendingVoicemail
+}
+
+func newMemoryPendingStore() *memoryPendingStore {
+	return &memoryPendingStore{
+		nextID:     1,
+		voicemails: make(map[int64]PendingVoicemail),
+	}
+}
+
+func (s *memoryPendingStore) Put(voicemail *PendingVoicemail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if voicemail.ID == 0 {
+		voicemail.ID = s.nextID
+		s.nextID++
+	}
+	s.voicemails[voicemail.ID] = *voicemail
+	return nil
+}
+
+func (s *memoryPendingStore) Get(id int64) (*PendingVoicemail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	voicemail, ok := s.voicemails[id]
+	if !ok {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return &voicemail, nil
+}
+
+func (s *memoryPendingStore) Query() ([]*PendingVoicemail, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var voicemails []*PendingVoicemail
+	for _, voicemail := range s.voicemails {
+		if voicemail.Delivered {
+			continue
+		}
+		voicemail := voicemail
+		voicemails = append(voicemails, &voicemail)
+	}
+	sort.Sort(byID(voicemails))
+	return voicemails, nil
+}
+
+func (s *memoryPendingStore) Count() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, voicemail := range s.voicemails {
+		if !voicemail.Delivered {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryPendingStore) Delete(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.voicemails, id)
+	return nil
+}
+
+func (s *memoryPendingStore) MarkDelivered(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	voicemail, ok := s.voicemails[id]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	voicemail.Delivered = true
+	s.voicemails[id] = voicemail
+	return nil
+}
+
+type byID []*PendingVoicemail
+
+func (a byID) Len() int           { return len(a) }
+func (a byID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byID) Less(i, j int) bool { return a[i].ID < a[j].ID }
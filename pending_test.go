@@ -0,0 +1,714 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// pendingStores sets up an empty store of each PendingStore implementation.
+var pendingStores = map[string]func(t *testing.T) PendingStore{
+	"memory": func(t *testing.T) PendingStore {
+		return newMemoryPendingStore()
+	},
+	"datastore": func(t *testing.T) PendingStore {
+		useDatastore(t)
+		return &datastorePendingStore{client: store}
+	},
+	"cached": func(t *testing.T) PendingStore {
+		useDatastore(t)
+		return newCachedPendingStore(&datastorePendingStore{client: store}, time.Minute)
+	},
+}
+
+func pendingIDs(voicemails []*PendingVoicemail) []int64 {
+	ids := make([]int64, len(voicemails))
+	for i, voicemail := range voicemails {
+		ids[i] = voicemail.ID
+	}
+	return ids
+}
+
+func TestPendingStorePutAndGet(t *testing.T) {
+	for name, newStore := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}
+			if err := s.Put(voicemail); err != nil {
+				t.Fatal(err)
+			}
+			if voicemail.ID == 0 {
+				t.Fatal("Put() didn't assign an ID")
+			}
+			id := voicemail.ID
+			voicemail.Attempts = 2
+			if err := s.Put(voicemail); err != nil {
+				t.Fatal(err)
+			}
+			if voicemail.ID != id {
+				t.Errorf("Put() of an existing voicemail changed its ID from %d to %d", id, voicemail.ID)
+			}
+			got, err := s.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != id || got.To != "+14155550100" || got.AudioURL != voicemail.AudioURL || got.Attempts != 2 {
+				t.Errorf("Get(%d) = %+v, want %+v", id, got, voicemail)
+			}
+			if _, err := s.Get(id + 1000); err != datastore.ErrNoSuchEntity {
+				t.Errorf("Get() of a missing voicemail returned %v, want ErrNoSuchEntity", err)
+			}
+		})
+	}
+}
+
+func TestPendingStoreQuery(t *testing.T) {
+	for name, newStore := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			var ids []int64
+			for i := 0; i < 4; i++ {
+				voicemail := &PendingVoicemail{To: "+14155550100"}
+				if err := s.Put(voicemail); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, voicemail.ID)
+			}
+			if err := s.MarkDelivered(ids[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ids[2]); err != nil {
+				t.Fatal(err)
+			}
+			voicemails, err := s.Query()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pendingIDs(voicemails); len(got) != 2 || got[0] != ids[0] || got[1] != ids[3] {
+				t.Errorf("Query() = %v, want %v", got, []int64{ids[0], ids[3]})
+			}
+		})
+	}
+}
+
+func TestPendingStoreCount(t *testing.T) {
+	for name, newStore := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			var ids []int64
+			for i := 0; i < 3; i++ {
+				voicemail := &PendingVoicemail{To: "+14155550100"}
+				if err := s.Put(voicemail); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, voicemail.ID)
+			}
+			if err := s.MarkDelivered(ids[0]); err != nil {
+				t.Fatal(err)
+			}
+			if count, err := s.Count(); err != nil || count != 2 {
+				t.Errorf("Count() = %d, %v, want 2", count, err)
+			}
+		})
+	}
+}
+
+func TestPendingStoreMarkDelivered(t *testing.T) {
+	for name, newStore := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			voicemail := &PendingVoicemail{To: "+14155550100", Attempts: 3}
+			if err := s.Put(voicemail); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.MarkDelivered(voicemail.ID); err != nil {
+				t.Fatal(err)
+			}
+			// Delivered voicemails are kept, but no longer pending.
+			got, err := s.Get(voicemail.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Delivered || got.Attempts != 3 {
+				t.Errorf("Get() after MarkDelivered() = %+v, want it delivered and otherwise unchanged", got)
+			}
+			if err := s.MarkDelivered(voicemail.ID + 1000); err != datastore.ErrNoSuchEntity {
+				t.Errorf("MarkDelivered() of a missing voicemail returned %v, want ErrNoSuchEntity", err)
+			}
+		})
+	}
+}
+
+func TestPendingStoreDelete(t *testing.T) {
+	for name, newStore := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			voicemail := &PendingVoicemail{To: "+14155550100"}
+			if err := s.Put(voicemail); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(voicemail.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(voicemail.ID); err != datastore.ErrNoSuchEntity {
+				t.Errorf("Get() after Delete() returned %v, want ErrNoSuchEntity", err)
+			}
+		})
+	}
+}
+
+func TestNewPendingStore(t *testing.T) {
+	if _, err := newPendingStore("memory"); err != nil {
+		t.Errorf(`newPendingStore("memory") failed: %v`, err)
+	}
+	if _, err := newPendingStore("sql"); err == nil {
+		t.Error(`newPendingStore("sql") succeeded, want an error`)
+	}
+}
+
+func TestNextAttempt(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.RetrySchedule = []string{"1m", "5m", "30m"}
+	})
+	tests := []struct {
+		attempts int
+		want     time.Duration
+		ok       bool
+	}{
+		{1, time.Minute, true},
+		{2, 5 * time.Minute, true},
+		{3, 30 * time.Minute, true},
+		{4, 0, false},
+		{10, 0, false},
+	}
+	for _, test := range tests {
+		after, ok := nextAttempt(test.attempts)
+		if ok != test.ok {
+			t.Errorf("nextAttempt(%d) ok = %t, want %t", test.attempts, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if delay := time.Until(after); delay > test.want || delay < test.want-time.Second {
+			t.Errorf("nextAttempt(%d) is in %s, want %s", test.attempts, delay, test.want)
+		}
+	}
+}
+
+func TestNextAttemptWithoutSchedule(t *testing.T) {
+	if after, ok := nextAttempt(100); !ok || !after.IsZero() {
+		t.Errorf("nextAttempt() without a schedule = %v, %t, want the next flush", after, ok)
+	}
+}
+
+func TestRetrySchedule(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.RetrySchedule = []string{"1m", "5m"}
+	})
+	putIdentity(t, "+14155550100", 42)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	})
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	for attempt, want := range []time.Duration{time.Minute, 5 * time.Minute} {
+		flushPendingVoicemail(voicemail)
+		stored, err := memory.Get(voicemail.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Attempts != attempt+1 || stored.DeadLetter {
+			t.Fatalf("After attempt %d the voicemail has %d attempts (dead letter %t)", attempt+1, stored.Attempts, stored.DeadLetter)
+		}
+		if delay := time.Until(stored.DeliverAfter); delay > want || delay < want-time.Second {
+			t.Errorf("After attempt %d the voicemail is due in %s, want %s", attempt+1, delay, want)
+		}
+	}
+	flushPendingVoicemail(voicemail)
+	if stored, _ := memory.Get(voicemail.ID); !stored.DeadLetter {
+		t.Error("Voicemail isn't a dead letter after the last retry in the schedule")
+	}
+}
+
+func TestRetryWithoutAccountKeepsSchedule(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.RetrySchedule = []string{"1m"}
+	})
+	interceptHTTP(t, streamHandler(7))
+	deliverAfter := time.Now().Add(-time.Minute).Truncate(time.Second)
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1", Attempts: 1, DeliverAfter: deliverAfter}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		flushPendingVoicemail(voicemail)
+	}
+	stored, err := memory.Get(voicemail.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Attempts != 1 || !stored.DeliverAfter.Equal(deliverAfter) || stored.DeadLetter {
+		t.Errorf("Retrying for a recipient without an account changed the voicemail to %d attempts, due %s (dead letter %t)", stored.Attempts, stored.DeliverAfter, stored.DeadLetter)
+	}
+}
+
+// useFullQueue caps the pending queue at two voicemails and fills it.
+func useFullQueue(t *testing.T) *memoryPendingStore {
+	t.Helper()
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.MaxPendingQueue = 2
+	})
+	queuePending(t, 2)
+	return memory
+}
+
+func TestQueueFullShedsVoicemail(t *testing.T) {
+	memory := useFullQueue(t)
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"sid": "SM1"}`)
+	})
+	logs := captureLog(t)
+	shed := shedVoicemails.Value()
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE9"}, false)
+	if err != errQueueFull {
+		t.Errorf("deliverVoicemail() = %v, want errQueueFull", err)
+	}
+	if count, _ := memory.Count(); count != 2 {
+		t.Errorf("Pending queue holds %d voicemails, want the 2 it was capped at", count)
+	}
+	if got := shedVoicemails.Value() - shed; got != 1 {
+		t.Errorf("Counted %d shed voicemails, want 1", got)
+	}
+	if sent := fake.RequestsTo("/Messages.json"); len(sent) != 0 {
+		t.Errorf("Texted the recipient %d times about a dropped voicemail, want none", len(sent))
+	}
+	if !strings.Contains(logs.String(), "https://api.twilio.com/recordings/RE9") {
+		t.Errorf("Log = %q, want the dropped recording logged", logs.String())
+	}
+}
+
+func TestQueueBelowCapacity(t *testing.T) {
+	memory := useFullQueue(t)
+	queued, _ := memory.Query()
+	memory.MarkDelivered(queued[0].ID)
+	setConfig(t, func(c *Config) { c.NotifyNoAccountBySMS = true })
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"sid": "SM1"}`)
+	})
+	captureLog(t)
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE9"}, false)
+	if _, ok := err.(*queuedError); !ok {
+		t.Errorf("deliverVoicemail() = %v, want it queued", err)
+	}
+	if sent := fake.RequestsTo("/Messages.json"); len(sent) != 1 {
+		t.Errorf("Texted the recipient %d times, want once", len(sent))
+	}
+}
+
+func TestQueueFullRecordingResponse(t *testing.T) {
+	useFullQueue(t)
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"sid": "SM1"}`)
+	})
+	captureLog(t)
+	rec := postRecordingAction("RE9")
+	if body := rec.Body.String(); body != QueueFullResponse {
+		t.Errorf("Response = %q, want the caller asked to try again later", body)
+	}
+}
+
+func TestQueueFullRequeuesExisting(t *testing.T) {
+	memory := useFullQueue(t)
+	queued, err := memory.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	voicemail := queued[0]
+	voicemail.Attempts++
+	if err := storePendingVoicemail(voicemail); err != nil {
+		t.Errorf("storePendingVoicemail() of a queued voicemail = %v, want it updated", err)
+	}
+}
+
+func TestOrderedBatches(t *testing.T) {
+	now := time.Now()
+	voicemails := []*PendingVoicemail{
+		{ID: 3, From: "+14155550101", To: "+14155550100", CreatedAt: now.Add(-1 * time.Minute)},
+		{ID: 1, From: "+14155550101", To: "+14155550100", CreatedAt: now.Add(-3 * time.Minute)},
+		{ID: 2, From: "+14155550101", To: "+14155550100", CreatedAt: now.Add(-2 * time.Minute), DeliverAfter: now.Add(time.Hour)},
+		{ID: 5, From: "+14155550102", To: "+14155550100", CreatedAt: now.Add(-5 * time.Minute), DeadLetter: true},
+		{ID: 4, From: "+14155550102", To: "+14155550100", CreatedAt: now.Add(-4 * time.Minute)},
+		{ID: 6, From: "+14155550101", To: "+14155550199", CreatedAt: now.Add(-1 * time.Minute), DeliverAfter: now.Add(time.Hour)},
+	}
+	batches := orderedBatches(voicemails, now)
+	// The first pair stops before 2, which isn't due, so 3 can't overtake it.
+	want := [][]int64{{1}, {4}}
+	if len(batches) != len(want) {
+		t.Fatalf("orderedBatches() returned %d batches, want %v", len(batches), want)
+	}
+	for i, batch := range batches {
+		if got := pendingIDs(batch); len(got) != len(want[i]) || got[0] != want[i][0] {
+			t.Errorf("Batch %d is %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+// queueInOrder queues n voicemails between the same pair, each left a minute after
+// the one before, with IDs in the reverse order.
+func queueInOrder(t *testing.T, memory *memoryPendingStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		voicemail := &PendingVoicemail{
+			ID:        int64(100 - i),
+			From:      "+14155550101",
+			To:        "+14155550100",
+			AudioURL:  fmt.Sprintf("https://api.twilio.com/recordings/RE%d", i),
+			CreatedAt: time.Now().Add(time.Duration(i-n) * time.Minute),
+		}
+		if err := memory.Put(voicemail); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func postedAudioURLs(fake *fakeHTTP) (urls []string) {
+	for _, chunk := range fake.RequestsTo("/chunks") {
+		urls = append(urls, chunk.Form().Get("audio_url"))
+	}
+	return
+}
+
+func TestFlushInOrder(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.FlushInOrder, c.FlushWorkers = true, 3
+	})
+	putIdentity(t, "+14155550100", 42)
+	queueInOrder(t, memory, 3)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	captureLog(t)
+	flushPendingQueue()
+	want := []string{"https://api.twilio.com/recordings/RE0", "https://api.twilio.com/recordings/RE1", "https://api.twilio.com/recordings/RE2"}
+	if got := postedAudioURLs(fake); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Delivered %v, want %v", got, want)
+	}
+}
+
+func TestFlushInOrderStopsAtFailure(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.FlushInOrder, c.FlushWorkers = true, 3
+	})
+	putIdentity(t, "+14155550100", 42)
+	queueInOrder(t, memory, 3)
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/chunks") {
+			r.ParseForm()
+			if strings.Contains(r.Form.Get("audio_url"), "RE0") {
+				http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		streamHandler(7, 99)(w, r)
+	})
+	captureLog(t)
+	flushPendingQueue()
+	posted := postedAudioURLs(fake)
+	if len(posted) == 0 {
+		t.Fatal("Nothing was delivered")
+	}
+	for _, audioURL := range posted {
+		if !strings.Contains(audioURL, "RE0") {
+			t.Errorf("Delivered %s before the older RE0", audioURL)
+		}
+	}
+	if count, _ := memory.Count(); count != 3 {
+		t.Errorf("%d voicemails left pending, want all 3", count)
+	}
+}
+
+func TestOrderedBatchesStopAtInFlight(t *testing.T) {
+	now := time.Now()
+	voicemails := []*PendingVoicemail{
+		{ID: 1, From: "+14155550101", To: "+14155550100", CreatedAt: now.Add(-2 * time.Minute), InFlightUntil: now.Add(time.Minute)},
+		{ID: 2, From: "+14155550101", To: "+14155550100", CreatedAt: now.Add(-1 * time.Minute)},
+	}
+	if batches := orderedBatches(voicemails, now); len(batches) != 0 {
+		t.Errorf("orderedBatches() = %v, want 2 held back behind the voicemail in flight", batches)
+	}
+	// Once the lease is over, the delivery is assumed to have died with its instance.
+	voicemails[0].InFlightUntil = now.Add(-time.Second)
+	if batches := orderedBatches(voicemails, now); len(batches) != 1 || len(batches[0]) != 2 {
+		t.Errorf("orderedBatches() = %v, want both after the lease is over", batches)
+	}
+}
+
+// countingPendingStore counts the queries made of the store it wraps.
+type countingPendingStore struct {
+	PendingStore
+	queries int
+}
+
+func (s *countingPendingStore) Query() ([]*PendingVoicemail, error) {
+	s.queries++
+	return s.PendingStore.Query()
+}
+
+func TestCachedPendingStoreMirrorsQueue(t *testing.T) {
+	useDatastore(t)
+	underlying := &countingPendingStore{PendingStore: &datastorePendingStore{client: store}}
+	cached := newCachedPendingStore(underlying, time.Minute)
+	if _, err := cached.Query(); err != nil {
+		t.Fatal(err)
+	}
+	voicemail := &PendingVoicemail{To: "+14155550100"}
+	if err := cached.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	voicemails, err := cached.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingIDs(voicemails); len(got) != 1 || got[0] != voicemail.ID {
+		t.Errorf("Query() = %v, want the voicemail just queued", got)
+	}
+	if underlying.queries != 1 {
+		t.Errorf("Underlying store was queried %d times, want once within the TTL", underlying.queries)
+	}
+	if err := cached.MarkDelivered(voicemail.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cached.voicemails[voicemail.ID]; ok {
+		t.Error("Delivered voicemail is still mirrored")
+	}
+}
+
+func TestCachedPendingStoreMatchesUnderlying(t *testing.T) {
+	useDatastore(t)
+	underlying := &datastorePendingStore{client: store}
+	cached := newCachedPendingStore(underlying, time.Minute)
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		voicemail := &PendingVoicemail{To: "+14155550100", Attempts: i}
+		if err := cached.Put(voicemail); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, voicemail.ID)
+	}
+	if _, err := cached.Query(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cached.MarkDelivered(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cached.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	voicemail, err := cached.Get(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	voicemail.DeadLetter = true
+	if err := cached.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	want, err := underlying.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cached.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Cached Query() = %v, want %v as from Datastore", got, want)
+	}
+	gotCount, _ := cached.Count()
+	wantCount, _ := underlying.Count()
+	if gotCount != wantCount {
+		t.Errorf("Cached Count() = %d, want %d as from Datastore", gotCount, wantCount)
+	}
+}
+
+func TestCachedPendingStoreSeesOtherInstances(t *testing.T) {
+	useDatastore(t)
+	cached := newCachedPendingStore(&datastorePendingStore{client: store}, time.Minute)
+	other := newCachedPendingStore(&datastorePendingStore{client: store}, time.Minute)
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		voicemail := &PendingVoicemail{To: "+14155550100"}
+		if err := cached.Put(voicemail); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, voicemail.ID)
+	}
+	if _, err := cached.Query(); err != nil {
+		t.Fatal(err)
+	}
+	// Another instance delivers, deletes and gives up on voicemails in the mirror.
+	if err := other.MarkDelivered(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	voicemail, err := other.Get(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	voicemail.DeadLetter = true
+	if err := other.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	voicemails, err := cached.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingIDs(voicemails); len(got) != 2 || got[0] != ids[2] || got[1] != ids[3] {
+		t.Fatalf("Query() = %v, want %v", got, ids[2:])
+	}
+	if !voicemails[0].DeadLetter {
+		t.Error("Query() returned the mirrored copy of a voicemail dead-lettered elsewhere")
+	}
+}
+
+func TestCachedPendingStoreFlushSkipsDeliveredElsewhere(t *testing.T) {
+	useDatastore(t)
+	putIdentity(t, "+14155550100", 42)
+	cached := newCachedPendingStore(&datastorePendingStore{client: store}, time.Minute)
+	saved := pendingStore
+	pendingStore = cached
+	t.Cleanup(func() {
+		pendingStore = saved
+	})
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}
+	if err := cached.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cached.Query(); err != nil {
+		t.Fatal(err)
+	}
+	// Another instance's flush delivers it first.
+	if err := (&datastorePendingStore{client: store}).MarkDelivered(voicemail.ID); err != nil {
+		t.Fatal(err)
+	}
+	fake := interceptHTTP(t, streamHandler(7))
+	captureLog(t)
+	flushPendingQueue()
+	if got := postedAudioURLs(fake); len(got) != 0 {
+		t.Errorf("Flush delivered %v again", got)
+	}
+}
+
+// goneStreamAPI answers 404 for chunks added to stream 7, as if it was deleted, and
+// creates stream 8 for new voicemails. Stream 8 is gone too if bothGone is set.
+func goneStreamAPI(bothGone bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/streams/7/chunks") || (bothGone && strings.HasSuffix(r.URL.Path, "/streams/8/chunks")) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		streamHandler(8, 99)(w, r)
+	}
+}
+
+// flushGoneStream flushes a pending voicemail for stream 7 and returns it as stored.
+func flushGoneStream(t *testing.T, mode string, bothGone bool) (*PendingVoicemail, *fakeHTTP) {
+	t.Helper()
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) { c.APINotFound = mode })
+	putIdentity(t, "+14155550100", 42)
+	captureLog(t)
+	fake := interceptHTTP(t, goneStreamAPI(bothGone))
+	voicemail := &PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1", StreamID: 7, StreamAccountID: 42}
+	if err := memory.Put(voicemail); err != nil {
+		t.Fatal(err)
+	}
+	flushPendingVoicemail(voicemail)
+	stored, err := memory.Get(voicemail.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored, fake
+}
+
+func TestAPINotFoundRetried(t *testing.T) {
+	stored, _ := flushGoneStream(t, "retry", false)
+	if stored.DeadLetter || stored.Delivered || stored.Attempts != 1 {
+		t.Errorf("After a 404 the voicemail is %+v, want it retried later", stored)
+	}
+}
+
+func TestAPINotFoundDeadLettered(t *testing.T) {
+	stored, fake := flushGoneStream(t, "dead_letter", false)
+	if !stored.DeadLetter {
+		t.Errorf("After a 404 the voicemail is %+v, want it dead-lettered", stored)
+	}
+	if chunks := fake.RequestsTo("/streams/8"); len(chunks) != 0 {
+		t.Errorf("Dead-lettered voicemail was delivered again: %v", chunks)
+	}
+}
+
+func TestAPINotFoundReresolved(t *testing.T) {
+	stored, fake := flushGoneStream(t, "reresolve", false)
+	if !stored.Delivered || stored.DeadLetter {
+		t.Errorf("After a 404 the voicemail is %+v, want it delivered to a new stream", stored)
+	}
+	if chunks := fake.RequestsTo("/streams/8/chunks"); len(chunks) != 1 {
+		t.Errorf("Voicemail was added to the new stream %d times, want once", len(chunks))
+	}
+}
+
+func TestAPINotFoundReresolvedOnce(t *testing.T) {
+	stored, fake := flushGoneStream(t, "reresolve", true)
+	if !stored.DeadLetter {
+		t.Errorf("After a 404 from the new stream too the voicemail is %+v, want it dead-lettered", stored)
+	}
+	if chunks := fake.RequestsTo("/streams/8/chunks"); len(chunks) != 1 {
+		t.Errorf("Voicemail was added to the new stream %d times, want once", len(chunks))
+	}
+}
+
+func TestAPINotFoundNotRetriedOnNewStream(t *testing.T) {
+	useDatastore(t)
+	setConfig(t, func(c *Config) { c.ChunkRetries = 2 })
+	putIdentity(t, "+14155550100", 42)
+	captureLog(t)
+	fake := interceptHTTP(t, goneStreamAPI(true))
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, true)
+	if !isNotFound(err) {
+		t.Errorf("deliverVoicemail() = %v, want the 404", err)
+	}
+	if chunks := fake.RequestsTo("/streams/8/chunks"); len(chunks) != 1 {
+		t.Errorf("Chunk was posted %d times after a 404, want once", len(chunks))
+	}
+}
+
+func TestAPINotFoundValidated(t *testing.T) {
+	c := config
+	c.APINotFound = "ignore"
+	if err := c.Validate(); err == nil {
+		t.Error(`Validate() accepted APINotFound "ignore"`)
+	}
+}
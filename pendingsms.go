@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// PendingSMS is a text message that couldn't be sent, to be retried on the next
+// flushes. Sent messages are deleted.
+type PendingSMS struct {
+	To      string `datastore:"to"`
+	Kind    string `datastore:"kind,noindex"`
+	Message string `datastore:"message,noindex"`
+	// DeliverAfter holds back the message until the given time (if set).
+	DeliverAfter time.Time `datastore:"deliver_after,noindex"`
+	// DeadLetter is set once sending has been given up on.
+	DeadLetter bool      `datastore:"dead_letter"`
+	Attempts   int       `datastore:"attempts,noindex"`
+	LastError  string    `datastore:"last_error,noindex"`
+	CreatedAt  time.Time `datastore:"created_at"`
+}
+
+// flushPendingSMS retries the pending SMS that are due.
+func flushPendingSMS() {
+	var messages []*PendingSMS
+	keys, err := store.GetAll(ctx, newQuery("PendingSMS").Filter("dead_letter =", false), &messages)
+	if err != nil {
+		log.Printf("Failed to get pending SMS: %v", err)
+		return
+	}
+	sent := 0
+	for i, message := range messages {
+		if message.DeliverAfter.After(time.Now()) {
+			continue
+		}
+		if isDraining() {
+			break
+		}
+		message.Attempts++
+		_, err := sendSMS(message.To, message.Kind, message.Message)
+		if err == nil {
+			sent++
+			if err := retryContention(func() error { return store.Delete(ctx, keys[i]) }); err != nil {
+				log.Printf("Failed to delete sent SMS %d: %v", keys[i].ID, err)
+			}
+			continue
+		}
+		log.Printf("Failed to send pending SMS %d to %s (attempt %d): %v", keys[i].ID, message.To, message.Attempts, err)
+		message.LastError = err.Error()
+		after, ok := nextAttempt(message.Attempts)
+		if !ok || (after.IsZero() && message.Attempts >= MaxPendingSMSAttempts) {
+			log.Printf("Giving up on pending SMS %d to %s after %d attempts", keys[i].ID, message.To, message.Attempts)
+			message.DeadLetter = true
+		}
+		message.DeliverAfter = after
+		if _, err := store.Put(ctx, keys[i], message); err != nil {
+			log.Printf("Failed to update pending SMS %d: %v", keys[i].ID, err)
+		}
+	}
+	if len(messages) > 0 {
+		log.Printf("Sent %d of %d pending SMS", sent, len(messages))
+	}
+}
+
+// queueSMS stores a message that couldn't be sent, to retry it on the next flushes.
+func queueSMS(to, kind, message string, sendErr error) {
+	pending := PendingSMS{
+		To:        to,
+		Kind:      kind,
+		Message:   message,
+		Attempts:  1,
+		LastError: sendErr.Error(),
+		CreatedAt: time.Now(),
+	}
+	pending.DeliverAfter, _ = nextAttempt(1)
+	key, err := store.Put(ctx, incompleteKey("PendingSMS"), &pending)
+	if err != nil {
+		log.Printf("Failed to store pending SMS to %s: %v", to, err)
+		return
+	}
+	log.Printf("Stored pending SMS %d to %s", key.ID, to)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func useRetrySMS(t *testing.T, update func(c *Config)) {
+	t.Helper()
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.RetrySMS = true
+		c.NotifyNoAccountBySMS = true
+		update(c)
+	})
+	captureLog(t)
+}
+
+// twilioSMS serves the Twilio Messages API, failing if fail is set.
+func twilioSMS(fail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"code": 20500, "message": "Internal Server Error", "status": 500}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"sid": "SM1"}`)
+	}
+}
+
+func storedSMS(t *testing.T) []*PendingSMS {
+	t.Helper()
+	var messages []*PendingSMS
+	if _, err := store.GetAll(ctx, newQuery("PendingSMS"), &messages); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func putPendingSMS(t *testing.T, message PendingSMS) {
+	t.Helper()
+	if _, err := store.Put(ctx, incompleteKey("PendingSMS"), &message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedSMSQueued(t *testing.T) {
+	useRetrySMS(t, func(c *Config) {})
+	interceptHTTP(t, twilioSMS(true))
+	notifyNoAccount(PendingVoicemail{ID: 1, From: "+14155550101", To: "+14155550100"})
+	messages := storedSMS(t)
+	if len(messages) != 1 {
+		t.Fatalf("%d SMS are pending, want 1", len(messages))
+	}
+	if m := messages[0]; m.To != "+14155550100" || m.Kind != "no_account" || m.Message == "" || m.Attempts != 1 || m.LastError == "" {
+		t.Errorf("Pending SMS is %+v, want the failed no-account text", m)
+	}
+}
+
+func TestFailedSMSNotQueuedByDefault(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) { c.NotifyNoAccountBySMS = true })
+	captureLog(t)
+	interceptHTTP(t, twilioSMS(true))
+	notifyNoAccount(PendingVoicemail{ID: 1, From: "+14155550101", To: "+14155550100"})
+	if messages := storedSMS(t); len(messages) != 0 {
+		t.Errorf("%d SMS are pending without RetrySMS, want none", len(messages))
+	}
+}
+
+func TestPendingSMSRetried(t *testing.T) {
+	useRetrySMS(t, func(c *Config) {})
+	putPendingSMS(t, PendingSMS{To: "+14155550100", Kind: "no_account", Message: "You have a voicemail", Attempts: 1})
+	fake := interceptHTTP(t, twilioSMS(false))
+	flushPendingQueue()
+	sent := fake.RequestsTo("/Messages.json")
+	if len(sent) != 1 || sent[0].Form().Get("To") != "+14155550100" || sent[0].Form().Get("Body") != "You have a voicemail" {
+		t.Fatalf("Flush sent %v, want the pending SMS", sent)
+	}
+	if messages := storedSMS(t); len(messages) != 0 {
+		t.Errorf("%d SMS are pending after being sent, want none", len(messages))
+	}
+}
+
+func TestPendingSMSNotDue(t *testing.T) {
+	useRetrySMS(t, func(c *Config) {})
+	putPendingSMS(t, PendingSMS{To: "+14155550100", Message: "You have a voicemail", Attempts: 1, DeliverAfter: time.Now().Add(time.Hour)})
+	fake := interceptHTTP(t, twilioSMS(false))
+	flushPendingSMS()
+	if sent := fake.RequestsTo("/Messages.json"); len(sent) != 0 {
+		t.Errorf("Sent %d SMS before they were due", len(sent))
+	}
+}
+
+func TestPendingSMSRetrySchedule(t *testing.T) {
+	useRetrySMS(t, func(c *Config) {
+		c.RetrySchedule = []string{"1m", "5m"}
+	})
+	interceptHTTP(t, twilioSMS(true))
+	notifyNoAccount(PendingVoicemail{ID: 1, From: "+14155550101", To: "+14155550100"})
+	messages := storedSMS(t)
+	if len(messages) != 1 {
+		t.Fatalf("%d SMS are pending, want 1", len(messages))
+	}
+	if delay := time.Until(messages[0].DeliverAfter); delay > time.Minute || delay < time.Minute-time.Second {
+		t.Errorf("Failed SMS is due in %s, want 1m", delay)
+	}
+	// Make it due for each retry.
+	due := func() {
+		var messages []*PendingSMS
+		keys, err := store.GetAll(ctx, newQuery("PendingSMS"), &messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[0].DeliverAfter = time.Time{}
+		if _, err := store.Put(ctx, keys[0], messages[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due()
+	flushPendingSMS()
+	messages = storedSMS(t)
+	if m := messages[0]; m.Attempts != 2 || m.DeadLetter {
+		t.Fatalf("After a retry the SMS has %d attempts (dead letter %t), want 2", m.Attempts, m.DeadLetter)
+	}
+	if delay := time.Until(messages[0].DeliverAfter); delay > 5*time.Minute || delay < 5*time.Minute-time.Second {
+		t.Errorf("After a retry the SMS is due in %s, want 5m", delay)
+	}
+	due()
+	flushPendingSMS()
+	if m := storedSMS(t)[0]; m.Attempts != 3 || !m.DeadLetter {
+		t.Errorf("After the last retry the SMS has %d attempts (dead letter %t), want it given up on", m.Attempts, m.DeadLetter)
+	}
+}
+
+func TestPendingSMSDeadLetterWithoutSchedule(t *testing.T) {
+	useRetrySMS(t, func(c *Config) {})
+	putPendingSMS(t, PendingSMS{To: "+14155550100", Message: "You have a voicemail", Attempts: MaxPendingSMSAttempts - 1})
+	fake := interceptHTTP(t, twilioSMS(true))
+	flushPendingSMS()
+	if m := storedSMS(t)[0]; m.Attempts != MaxPendingSMSAttempts || !m.DeadLetter {
+		t.Errorf("SMS has %d attempts (dead letter %t), want it given up on after %d", m.Attempts, m.DeadLetter, MaxPendingSMSAttempts)
+	}
+	// Dead letters aren't retried.
+	flushPendingSMS()
+	if sent := fake.RequestsTo("/Messages.json"); len(sent) != 1 {
+		t.Errorf("Tried sending %d times, want dead letters left alone", len(sent))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// provisionAccount asks the Roger API to create an account for the identity (which
+// invites them to Roger), and returns the new account's ID.
+func provisionAccount(backend Backend, identity string) (accountId int64, err error) {
+	if config.LocalDev {
+		log.Printf("Local dev: not provisioning an account for %s", identity)
+		return 0, fmt.Errorf("provisioning is disabled in local dev mode")
+	}
+	ref, err := url.Parse(config.ProvisionPath)
+	if err != nil {
+		return 0, err
+	}
+	fields := url.Values{"identifier": {identity}}
+	req, err := http.NewRequest("POST", backend.apiURL.ResolveReference(ref).String(), strings.NewReader(fields.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", backend.AccessToken))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return 0, fmt.Errorf("%s returned %s", req.URL.Path, resp.Status)
+	}
+	var account struct {
+		Id int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return 0, fmt.Errorf("%s returned invalid JSON: %v", req.URL.Path, err)
+	}
+	if account.Id == 0 {
+		return 0, fmt.Errorf("%s didn't return an account ID", req.URL.Path)
+	}
+	return account.Id, nil
+}
+
+// shouldProvision reports whether an account may be created for the recipient.
+func shouldProvision(to string) bool {
+	return config.ProvisionAccounts && matchesNumber(to, config.ProvisionNumbers)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// provisionAPI responds like the Roger API, creating account 43 when asked to.
+func provisionAPI(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/accounts") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"id": 43}`)
+			return
+		}
+		streamHandler(7, 99)(w, r)
+	}
+}
+
+func useProvisioning(t *testing.T, status int) (*memoryPendingStore, *fakeHTTP) {
+	t.Helper()
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.ProvisionAccounts = true
+		c.ProvisionNumbers = []string{"+1415*"}
+		c.VoicemailText = ""
+	})
+	fake := interceptHTTP(t, provisionAPI(status))
+	captureLog(t)
+	return memory, fake
+}
+
+func TestProvisionThenDeliver(t *testing.T) {
+	memory, fake := useProvisioning(t, http.StatusCreated)
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, false)
+	if err != nil {
+		t.Fatalf("deliverVoicemail() = %v, want it delivered to the new account", err)
+	}
+	provisioned := fake.RequestsTo("/accounts")
+	if len(provisioned) != 1 || provisioned[0].Method != "POST" || provisioned[0].Form().Get("identifier") != "+14155550100" {
+		t.Fatalf("Provisioning requests %v, want one for the recipient", provisioned)
+	}
+	if auth := provisioned[0].Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer ") {
+		t.Errorf("Provisioned with Authorization %q, want the backend's token", auth)
+	}
+	streams := fake.RequestsTo("/streams")
+	if len(streams) == 0 || streams[0].URL.Query().Get("on_behalf_of") != "43" {
+		t.Errorf("Voicemail wasn't delivered on behalf of the new account: %v", streams)
+	}
+	if count, _ := memory.Count(); count != 0 {
+		t.Errorf("%d voicemails queued, want none", count)
+	}
+}
+
+func TestProvisionOnlyAllowlisted(t *testing.T) {
+	memory, fake := useProvisioning(t, http.StatusCreated)
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+16505550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, false)
+	if _, ok := err.(*queuedError); !ok {
+		t.Errorf("deliverVoicemail() = %v, want it queued", err)
+	}
+	if provisioned := fake.RequestsTo("/accounts"); len(provisioned) != 0 {
+		t.Errorf("Provisioned an account for a number not in ProvisionNumbers: %v", provisioned)
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails queued, want 1", count)
+	}
+}
+
+func TestProvisionFailureQueues(t *testing.T) {
+	memory, fake := useProvisioning(t, http.StatusInternalServerError)
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, false)
+	if _, ok := err.(*queuedError); !ok {
+		t.Errorf("deliverVoicemail() = %v, want it queued", err)
+	}
+	if streams := fake.RequestsTo("/streams"); len(streams) != 0 {
+		t.Errorf("Delivered without an account: %v", streams)
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails queued, want 1", count)
+	}
+}
+
+func TestProvisionNotForExistingAccounts(t *testing.T) {
+	_, fake := useProvisioning(t, http.StatusCreated)
+	putIdentity(t, "+14155550100", 42)
+	if err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if provisioned := fake.RequestsTo("/accounts"); len(provisioned) != 0 {
+		t.Errorf("Provisioned an account for a recipient who has one: %v", provisioned)
+	}
+}
+
+func TestNoProvisioningByDefault(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.ProvisionNumbers = []string{"+1415*"}
+		c.VoicemailText = ""
+	})
+	fake := interceptHTTP(t, provisionAPI(http.StatusCreated))
+	captureLog(t)
+	deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1"}, false)
+	if provisioned := fake.RequestsTo("/accounts"); len(provisioned) != 0 {
+		t.Errorf("Provisioned an account without ProvisionAccounts: %v", provisioned)
+	}
+}
+
+func TestProvisionAccountMissingID(t *testing.T) {
+	interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	_, err := provisionAccount(Backend{AccessToken: "token", apiURL: apiURL}, "+14155550100")
+	if err == nil || !strings.Contains(err.Error(), "didn't return an account ID") {
+		t.Errorf("provisionAccount() = %v, want the missing ID reported", err)
+	}
+}
+
+func TestProvisionWithoutNumbersWarns(t *testing.T) {
+	c := config
+	c.ProvisionAccounts = true
+	warnings := strings.Join(c.Warnings(), "\n")
+	if !strings.Contains(warnings, "ProvisionNumbers is empty") {
+		t.Errorf("Warnings() = %q, want the empty allowlist flagged", warnings)
+	}
+}
+
+func TestMatchesNumber(t *testing.T) {
+	list := []string{"+14155550100", "+1650*"}
+	tests := map[string]bool{
+		"+14155550100": true,
+		"+14155550101": false,
+		"+16505550100": true,
+		"+1650":        true,
+		"+16515550100": false,
+	}
+	for number, want := range tests {
+		if got := matchesNumber(number, list); got != want {
+			t.Errorf("matchesNumber(%q) = %t, want %t", number, got, want)
+		}
+	}
+}
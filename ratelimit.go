@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that paces events to a steady rate, allowing short
+// bursts up to the bucket size.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	tokens   float64
+	last     time.Time
+	// Nothing is allowed until this time (e.g. when told to back off by a server).
+	pausedUntil time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		burst:    burst,
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// Allow takes a token if one is available right away, and reports whether it did.
+func (l *rateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.refill(now)
+	if l.tokens < 1 || now.Before(l.pausedUntil) {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Wait blocks until an event is allowed.
+func (l *rateLimiter) Wait() {
+	time.Sleep(l.reserve())
+}
+
+// PauseFor stops any events from happening for the given duration.
+func (l *rateLimiter) PauseFor(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.refill(now)
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens * float64(l.interval))
+	}
+	if paused := l.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+	return wait
+}
+
+// refill adds the tokens earned since the last event. Must be called with mu held.
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date,
+// returning zero if it's missing, invalid or in the past.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	return positive(time.Until(date))
+}
+
+// parseRateLimitReset reads an X-RateLimit-Reset header, which is either a Unix time
+// or (for small values) a number of seconds, returning zero if it's missing or invalid.
+func parseRateLimitReset(value string) time.Duration {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	// Anything before 2001 must be relative.
+	if seconds < 1e9 {
+		return time.Duration(seconds) * time.Second
+	}
+	return positive(time.Until(time.Unix(seconds, 0)))
+}
+
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitPaces(t *testing.T) {
+	limiter := newRateLimiter(50, 1)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		limiter.Wait()
+	}
+	// The first event uses the burst, and each of the others waits 20ms.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("6 events at 50 per second took %s, want about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterAllowBurst(t *testing.T) {
+	limiter := newRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("Allow() refused event %d of a burst of 3", i+1)
+		}
+	}
+	if limiter.Allow() {
+		t.Error("Allow() allowed an event beyond the burst")
+	}
+}
+
+func TestRateLimiterPauseFor(t *testing.T) {
+	limiter := newRateLimiter(1000, 10)
+	limiter.PauseFor(50 * time.Millisecond)
+	if limiter.Allow() {
+		t.Error("Allow() allowed an event while paused")
+	}
+	start := time.Now()
+	limiter.Wait()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Wait() returned after %s while paused for 50ms", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"0":                             0,
+		"Mon, 02 Jan 2006 15:04:05 GMT": 0,
+	}
+	for value, want := range tests {
+		if got := parseRetryAfter(value); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", value, got, want)
+		}
+	}
+	future := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 50*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %s, want about a minute", future, got)
+	}
+}
+
+func TestParseRateLimitReset(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     0,
+		"30":   30 * time.Second,
+		"-5":   0,
+		"soon": 0,
+		// Unix times in the past.
+		"1500000000": 0,
+	}
+	for value, want := range tests {
+		if got := parseRateLimitReset(value); got != want {
+			t.Errorf("parseRateLimitReset(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+// smsTimes serves Twilio's Messages API, recording when each message was sent. The
+// first limited messages get a 429 with the Retry-After.
+type smsTimes struct {
+	mu         sync.Mutex
+	sent       []time.Time
+	limited    int
+	retryAfter string
+}
+
+func (s *smsTimes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limited > 0 {
+		s.limited--
+		w.Header().Set("Retry-After", s.retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"code": 20429, "message": "Too Many Requests", "status": 429}`)
+		return
+	}
+	s.sent = append(s.sent, time.Now())
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, `{"sid": "SM1"}`)
+}
+
+func useSMSLimiter(t *testing.T, limiter *rateLimiter) {
+	saved := smsLimiter
+	smsLimiter = limiter
+	t.Cleanup(func() {
+		smsLimiter = saved
+	})
+}
+
+func TestSendSMSPaced(t *testing.T) {
+	useDatastore(t)
+	useSMSLimiter(t, newRateLimiter(20, 1))
+	twilio := new(smsTimes)
+	interceptHTTP(t, twilio.ServeHTTP)
+	for i := 0; i < 4; i++ {
+		if _, err := sendSMS("+14155550100", "test", "Hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(twilio.sent) != 4 {
+		t.Fatalf("Twilio got %d messages, want 4", len(twilio.sent))
+	}
+	for i := 1; i < len(twilio.sent); i++ {
+		// Allow for some timer slack.
+		if gap := twilio.sent[i].Sub(twilio.sent[i-1]); gap < 40*time.Millisecond {
+			t.Errorf("Message %d was sent %s after the previous one, want 50ms at 20 per second", i+1, gap)
+		}
+	}
+}
+
+func TestSendSMSRespectsRetryAfter(t *testing.T) {
+	useDatastore(t)
+	limiter := newRateLimiter(1000, 10)
+	useSMSLimiter(t, limiter)
+	twilio := &smsTimes{limited: 1, retryAfter: "1"}
+	interceptHTTP(t, twilio.ServeHTTP)
+	start := time.Now()
+	if _, err := sendSMS("+14155550100", "test", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if len(twilio.sent) != 1 || twilio.sent[0].Sub(start) < 900*time.Millisecond {
+		t.Errorf("Message was sent at %v after a 429, want 1s after %v", twilio.sent, start)
+	}
+	// The pause applies to the limiter as a whole, not just the one message.
+	if limiter.pausedUntil.Before(start.Add(time.Second)) {
+		t.Errorf("Limiter is paused until %v, want 1s after %v", limiter.pausedUntil, start)
+	}
+}
+
+// streamTimes serves the Roger API's chunks endpoint, recording when each request
+// came in. The first limited requests get a 429 with the headers.
+type streamTimes struct {
+	mu       sync.Mutex
+	requests []time.Time
+	limited  int
+	header   http.Header
+}
+
+func (s *streamTimes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, time.Now())
+	if s.limited > 0 {
+		s.limited--
+		for key, values := range s.header {
+			w.Header()[key] = values
+		}
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+	streamHandler(7)(w, r)
+}
+
+// postLimitedStream posts a chunk to a stream that rate limits the first request
+// with the headers, and returns the wait before the retry.
+func postLimitedStream(t *testing.T, header http.Header) time.Duration {
+	t.Helper()
+	api := &streamTimes{limited: 1, header: header}
+	interceptHTTP(t, api.ServeHTTP)
+	captureLog(t)
+	if _, err := postStream(Backend{AccessToken: "token", apiURL: apiURL}, 42, 7, url.Values{"audio_url": {"https://api.twilio.com/recordings/RE1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.requests) != 2 {
+		t.Fatalf("Roger API got %d requests, want a retry", len(api.requests))
+	}
+	return api.requests[1].Sub(api.requests[0])
+}
+
+func TestPostStreamRetryAfterSeconds(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAPIRetryWaitSeconds = 5 })
+	wait := postLimitedStream(t, http.Header{"Retry-After": {"1"}})
+	if wait < 900*time.Millisecond || wait > 2*time.Second {
+		t.Errorf("Retried after %s, want 1s", wait)
+	}
+}
+
+func TestPostStreamRetryAfterDate(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAPIRetryWaitSeconds = 5 })
+	// HTTP dates only have whole seconds, so this asks for a wait of 1-2 seconds.
+	date := time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+	wait := postLimitedStream(t, http.Header{"Retry-After": {date}})
+	if wait < 900*time.Millisecond || wait > 2500*time.Millisecond {
+		t.Errorf("Retried after %s, want 1-2s for Retry-After %s", wait, date)
+	}
+}
+
+func TestPostStreamRateLimitReset(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAPIRetryWaitSeconds = 5 })
+	wait := postLimitedStream(t, http.Header{"X-Ratelimit-Reset": {"1"}})
+	if wait < 900*time.Millisecond || wait > 2*time.Second {
+		t.Errorf("Retried after %s, want 1s", wait)
+	}
+}
+
+func TestPostStreamRetryWaitCapped(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAPIRetryWaitSeconds = 1 })
+	wait := postLimitedStream(t, http.Header{"Retry-After": {"60"}})
+	if wait > 2*time.Second {
+		t.Errorf("Retried after %s, want at most MaxAPIRetryWaitSeconds", wait)
+	}
+}
+
+func TestPostStreamRetriesDisabled(t *testing.T) {
+	setConfig(t, func(c *Config) { c.MaxAPIRetryWaitSeconds = 0 })
+	api := &streamTimes{limited: 1, header: http.Header{"Retry-After": {"1"}}}
+	interceptHTTP(t, api.ServeHTTP)
+	if _, err := postStream(Backend{AccessToken: "token", apiURL: apiURL}, 42, 7, url.Values{}); err == nil {
+		t.Error("postStream() succeeded, want the rate limit error")
+	}
+	if len(api.requests) != 1 {
+		t.Errorf("Roger API got %d requests, want no retries", len(api.requests))
+	}
+}
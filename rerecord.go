@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var confirmTemplate = template.Must(template.New("confirm").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+	<Gather numDigits="1" timeout="5" action="{{xml .}}">
+		<Say>To send your message, press 1. To record it again, press 2.</Say>
+	</Gather>
+	<Redirect>{{xml .}}</Redirect>
+</Response>`))
+
+// UnconfirmedRecording holds a recording until the caller chooses to send it or
+// record it again. Keyed by CallSid.
+type UnconfirmedRecording struct {
+	// Form is the encoded Twilio form of the recording.
+	Form      string    `datastore:"form,noindex"`
+	CreatedAt time.Time `datastore:"created_at"`
+}
+
+// rerecordResponse handles the recording callbacks of a call when AllowRerecord is
+// enabled. Instead of delivering a new recording, it's held back and the caller is
+// asked whether to send it. Returns false if the request should be handled as a
+// plain recording, i.e. if the caller hung up before they could be asked. The caller's
+// answer comes back to the request URL, keeping its query (e.g. the extension).
+func rerecordResponse(requestURL *url.URL, form url.Values, outcome *string) ([]byte, bool) {
+	sid := form.Get("CallSid")
+	if sid == "" {
+		return nil, false
+	}
+	if form.Get("confirm") == "" {
+		if form.Get("RecordingUrl") == "" || form.Get("CallStatus") == "completed" {
+			return nil, false
+		}
+		recording := UnconfirmedRecording{Form: form.Encode(), CreatedAt: time.Now()}
+		if _, err := store.Put(ctx, nameKey("UnconfirmedRecording", sid), &recording); err != nil {
+			// Deliver it now rather than risk losing it.
+			log.Printf("Failed to store unconfirmed recording for %s: %v", sid, err)
+			return nil, false
+		}
+		var buf bytes.Buffer
+		if err := confirmTemplate.Execute(&buf, addQuery(requestURL.RequestURI(), "confirm", "1")); err != nil {
+			log.Printf("Failed to render confirm response for %s: %v", sid, err)
+			takeUnconfirmedRecording(sid)
+			return nil, false
+		}
+		*outcome = "confirming"
+		return buf.Bytes(), true
+	}
+	recording, err := takeUnconfirmedRecording(sid)
+	if err != nil {
+		log.Printf("Failed to get unconfirmed recording for %s: %v", sid, err)
+		*outcome = "failed"
+		return []byte(ThankYouResponse), true
+	}
+	if recording == nil {
+		// Already delivered by the status callback.
+		*outcome = "duplicate"
+		return []byte(ThankYouResponse), true
+	}
+	if form.Get("Digits") == "2" {
+		log.Printf("Caller %s is recording their message again", form.Get(config.FromField))
+		*outcome = "rerecord"
+		return answerResponse(requestURL.Path, form), true
+	}
+	// Send the recording for any other key, or if the caller didn't press one.
+	recordingForm, err := url.ParseQuery(recording.Form)
+	if err != nil {
+		log.Printf("Failed to parse unconfirmed recording for %s: %v", sid, err)
+		*outcome = "failed"
+		return []byte(ThankYouResponse), true
+	}
+	return receiveRecording(recordingForm, outcome), true
+}
+
+// deliverUnconfirmedRecording delivers the recording held for a call, if any. Used
+// when the caller hangs up instead of confirming.
+func deliverUnconfirmedRecording(callSid string) {
+	recording, err := takeUnconfirmedRecording(callSid)
+	if err != nil {
+		log.Printf("Failed to get unconfirmed recording for %s: %v", callSid, err)
+		return
+	}
+	if recording == nil {
+		return
+	}
+	form, err := url.ParseQuery(recording.Form)
+	if err != nil {
+		log.Printf("Failed to parse unconfirmed recording for %s: %v", callSid, err)
+		return
+	}
+	outcome := "unknown"
+	receiveRecording(form, &outcome)
+	log.Printf("Delivered unconfirmed recording for %s: %s", callSid, outcome)
+}
+
+// takeUnconfirmedRecording removes and returns the recording held for a call, or nil
+// if there isn't one.
+func takeUnconfirmedRecording(callSid string) (recording *UnconfirmedRecording, err error) {
+	key := nameKey("UnconfirmedRecording", callSid)
+	err = runInTransaction(store, func(tx *datastore.Transaction) error {
+		recording = new(UnconfirmedRecording)
+		err := tx.Get(key, recording)
+		if err == datastore.ErrNoSuchEntity {
+			recording = nil
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	return
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func useRerecord(t *testing.T) *fakeHTTP {
+	t.Helper()
+	useDatastore(t)
+	setConfig(t, func(c *Config) {
+		c.AllowRerecord = true
+	})
+	putIdentity(t, "+14155550100", 42)
+	captureLog(t)
+	return interceptHTTP(t, streamHandler(7, 99))
+}
+
+// postRecorded posts a finished recording of the call, as Twilio does when the caller
+// presses # or stops speaking.
+func postRecorded(path, recordingSid string) *httptest.ResponseRecorder {
+	return postForm(callHandler, path, url.Values{
+		"CallSid":       {"CA1"},
+		"CallStatus":    {"in-progress"},
+		"From":          {"+14155550101"},
+		"ForwardedFrom": {"+14155550100"},
+		"RecordingUrl":  {"https://api.twilio.com/recordings/" + recordingSid},
+		"RecordingSid":  {recordingSid},
+	})
+}
+
+// postConfirm posts the caller's choice after a recording.
+func postConfirm(digits string) *httptest.ResponseRecorder {
+	return postForm(callHandler, "/v1/call?confirm=1", url.Values{
+		"CallSid":       {"CA1"},
+		"CallStatus":    {"in-progress"},
+		"From":          {"+14155550101"},
+		"ForwardedFrom": {"+14155550100"},
+		"Digits":        {digits},
+	})
+}
+
+func deliveredAudioURLs(fake *fakeHTTP) (urls []string) {
+	for _, req := range fake.RequestsTo("/chunks") {
+		urls = append(urls, req.Form().Get("audio_url"))
+	}
+	return
+}
+
+func TestRerecordAsksToConfirm(t *testing.T) {
+	fake := useRerecord(t)
+	rec := postRecorded("/v1/call", "RE1")
+	if body := rec.Body.String(); !strings.Contains(body, "<Gather") || !strings.Contains(body, "press 2") {
+		t.Errorf("Recording got %s, want the caller asked to confirm", body)
+	}
+	if urls := deliveredAudioURLs(fake); len(urls) != 0 {
+		t.Errorf("Delivered %v before the caller confirmed", urls)
+	}
+}
+
+func TestRerecordSend(t *testing.T) {
+	fake := useRerecord(t)
+	postRecorded("/v1/call", "RE1")
+	postConfirm("1")
+	urls := deliveredAudioURLs(fake)
+	if len(urls) != 1 || !strings.Contains(urls[0], "RE1") {
+		t.Errorf("Delivered %v, want RE1 once", urls)
+	}
+}
+
+func TestRerecordSendWithoutKey(t *testing.T) {
+	fake := useRerecord(t)
+	postRecorded("/v1/call", "RE1")
+	postConfirm("")
+	if urls := deliveredAudioURLs(fake); len(urls) != 1 {
+		t.Errorf("Delivered %v without a key press, want RE1", urls)
+	}
+}
+
+func TestRerecordAgain(t *testing.T) {
+	fake := useRerecord(t)
+	postRecorded("/v1/call", "RE1")
+	rec := postConfirm("2")
+	if body := rec.Body.String(); !strings.Contains(body, "<Record") {
+		t.Errorf("Choosing to record again got %s, want <Record>", body)
+	}
+	if urls := deliveredAudioURLs(fake); len(urls) != 0 {
+		t.Fatalf("Delivered %v after the caller chose to record again", urls)
+	}
+	postRecorded("/v1/call", "RE2")
+	postConfirm("1")
+	urls := deliveredAudioURLs(fake)
+	if len(urls) != 1 || !strings.Contains(urls[0], "RE2") {
+		t.Errorf("Delivered %v, want only the final recording RE2", urls)
+	}
+}
+
+func TestRerecordHangupDelivers(t *testing.T) {
+	fake := useRerecord(t)
+	postRecorded("/v1/call", "RE1")
+	postForm(callStatusHandler, "/v1/call-status", url.Values{"CallSid": {"CA1"}, "CallStatus": {"completed"}})
+	urls := deliveredAudioURLs(fake)
+	if len(urls) != 1 || !strings.Contains(urls[0], "RE1") {
+		t.Errorf("Delivered %v after the caller hung up, want RE1", urls)
+	}
+	// The confirmation can't deliver it a second time.
+	if rec := postConfirm("1"); rec.Code != http.StatusOK {
+		t.Errorf("Late confirmation got %d", rec.Code)
+	}
+	if urls := deliveredAudioURLs(fake); len(urls) != 1 {
+		t.Errorf("Delivered %v, want RE1 once", urls)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// Set once shutdown begins. Accessed atomically.
+	draining int32
+	// Work that runs after its request is done: flushes started by /v1/flush, and
+	// deliveries that ran past the response budget.
+	background sync.WaitGroup
+)
+
+// isDraining reports whether the service is shutting down and shouldn't take on new
+// calls or deliveries.
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// serve runs the server until it's interrupted or terminated, then shuts it down.
+func serve(server *http.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, draining...", sig)
+		shutdown(server)
+		close(stopped)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	log.Printf("Server stopped")
+	return nil
+}
+
+// shutdown stops taking new calls and gives requests in flight up to
+// ShutdownGraceSeconds to finish, then gives work in the background as long again.
+// Event streams are closed right away, since they'd never finish by themselves.
+func shutdown(server *http.Server) {
+	atomic.StoreInt32(&draining, 1)
+	closeEventStreams()
+	grace := time.Duration(config.ShutdownGraceSeconds) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still in flight after %s: %v", grace, err)
+	}
+	backgroundCtx, cancelBackground := context.WithTimeout(context.Background(), grace)
+	defer cancelBackground()
+	if !waitForBackground(backgroundCtx) {
+		log.Printf("Background work still running after %s", grace)
+	}
+}
+
+// waitForBackground waits for work in the background to finish. Flushes stop taking
+// on more deliveries once draining. It reports whether it finished before ctx was done.
+func waitForBackground(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useDraining makes the service act as if shutdown has begun.
+func useDraining(t *testing.T) {
+	atomic.StoreInt32(&draining, 1)
+	t.Cleanup(func() {
+		atomic.StoreInt32(&draining, 0)
+	})
+}
+
+func TestCallWhileDraining(t *testing.T) {
+	useDraining(t)
+	captureLog(t)
+	rec := getCall(url.Values{"To": {"+14155550100"}, "From": {"+14155550101"}})
+	if body := rec.Body.String(); body != DrainingResponse {
+		t.Errorf("Call while draining got %q, want the draining response", body)
+	}
+}
+
+func TestCallBeforeDraining(t *testing.T) {
+	useDatastore(t)
+	captureLog(t)
+	rec := getCall(url.Values{"To": {"+14155550100"}, "From": {"+14155550101"}})
+	if strings.Contains(rec.Body.String(), "try again shortly") {
+		t.Errorf("Call before shutdown got the draining response: %s", rec.Body)
+	}
+}
+
+func TestReplayWhileDraining(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.AdminToken = testAdminToken
+	})
+	useDraining(t)
+	fake := interceptHTTP(t, streamHandler(7))
+	rec := adminRequest(replayHandler, "POST", "/v1/replay", replayForm("RE1", "+14155550101", "+14155550100"))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Replay while draining returned %d, want 503", rec.Code)
+	}
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("Replay while draining made %d requests", len(requests))
+	}
+}
+
+func TestFlushWhileDraining(t *testing.T) {
+	useDatastore(t)
+	memory := usePendingStore(t)
+	putIdentity(t, "+14155550100", 42)
+	fake := interceptHTTP(t, streamHandler(7, 99))
+	queuePending(t, 3)
+	useDraining(t)
+	logs := captureLog(t)
+	flushPendingQueue()
+	if requests := fake.RequestsTo("/chunks"); len(requests) != 0 {
+		t.Errorf("Flush while draining delivered %d voicemails", len(requests))
+	}
+	if count, _ := memory.Count(); count != 3 {
+		t.Errorf("%d voicemails are pending after a flush while draining, want 3", count)
+	}
+	if !strings.Contains(logs.String(), "Shutting down, leaving") {
+		t.Errorf("Log = %q, want the voicemails left for later", logs.String())
+	}
+}
+
+func TestShutdownWithSubscriberDrainsFlush(t *testing.T) {
+	fake, unblock := useBlockedFlush(t)
+	setConfig(t, func(c *Config) { c.ShutdownGraceSeconds = 1 })
+	logs := captureLog(t)
+	t.Cleanup(func() {
+		atomic.StoreInt32(&draining, 0)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: requireAdmin(eventsHandler)}
+	go server.Serve(listener)
+	req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+	if rec := adminRequest(flushHandler, "POST", "/v1/flush", ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("Flush returned %d: %s", rec.Code, rec.Body)
+	}
+	for deadline := time.Now().Add(time.Second); len(fake.Requests()) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Flush didn't start delivering")
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(server)
+		close(stopped)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Events stream stayed open after shutdown began")
+	}
+	// The flush finishes after the requests in flight are done.
+	unblock()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown() didn't return")
+	}
+	if chunks := fake.RequestsTo("/chunks"); len(chunks) != 1 {
+		t.Errorf("Flush delivered %d voicemails before shutdown, want 1", len(chunks))
+	}
+	if strings.Contains(logs.String(), "still running") || strings.Contains(logs.String(), "still in flight") {
+		t.Errorf("Log = %q, want shutdown to wait for the flush", logs.String())
+	}
+}
+
+func TestEventsRejectedWhileDraining(t *testing.T) {
+	setConfig(t, func(c *Config) { c.AdminToken = testAdminToken })
+	useDraining(t)
+	if rec := adminRequest(eventsHandler, "GET", "/v1/events", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /v1/events while draining returned %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// slackEscaper escapes the characters Slack treats as markup in message text.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// postVoicemailToSlack posts a voicemail for a recipient without a Roger account to
+// their SlackWebhooks channel. Returns false if the recipient has no channel.
+func postVoicemailToSlack(voicemail PendingVoicemail) (posted bool, err error) {
+	webhookURL, ok := config.SlackWebhooks[voicemail.To]
+	if !ok {
+		return false, nil
+	}
+	caller := voicemail.From
+	if voicemail.CallerName != "" {
+		caller = fmt.Sprintf("%s (%s)", slackEscaper.Replace(voicemail.CallerName), voicemail.From)
+	}
+	message := fmt.Sprintf("New voicemail for %s from %s", voicemail.To, caller)
+	if voicemail.Duration > 0 {
+		message += fmt.Sprintf(", %ds", voicemail.Duration)
+	}
+	if voicemail.AudioURL != "" {
+		message += fmt.Sprintf(": <%s|Listen>", voicemail.AudioURL)
+	} else if voicemail.Text != "" {
+		message += ": " + slackEscaper.Replace(voicemail.Text)
+	}
+	if config.LocalDev {
+		log.Printf("Local dev: not posting to Slack: %q", message)
+		return true, nil
+	}
+	if err := postSlack(webhookURL, message); err != nil {
+		return false, err
+	}
+	return true, nil
+}
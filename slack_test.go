@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testSlackWebhook = "https://hooks.slack.com/services/T1/B1/voicemail"
+
+// useSlack routes voicemails for +14155550100 to a stubbed Slack webhook, which
+// responds with the given status. Returns the pending store and the texts posted.
+func useSlack(t *testing.T, status int, update func(c *Config)) (*memoryPendingStore, func() []string) {
+	t.Helper()
+	useDatastore(t)
+	memory := usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.SlackWebhooks = map[string]string{"+14155550100": testSlackWebhook}
+		update(c)
+	})
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "hooks.slack.com" {
+			w.WriteHeader(status)
+			return
+		}
+		new(smsTimes).ServeHTTP(w, r)
+	})
+	captureLog(t)
+	posted := func() (texts []string) {
+		for _, req := range fake.RequestsTo("/services/") {
+			var body struct{ Text string }
+			if err := json.Unmarshal(req.Body, &body); err != nil {
+				t.Fatalf("Invalid Slack message %q: %v", req.Body, err)
+			}
+			texts = append(texts, body.Text)
+		}
+		return
+	}
+	return memory, posted
+}
+
+func TestPostVoicemailToSlack(t *testing.T) {
+	memory, posted := useSlack(t, http.StatusOK, func(c *Config) {})
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", CallerName: "Jane <Doe>", Duration: 12, AudioURL: "https://api.twilio.com/recordings/RE1.mp3"}, false)
+	if err != nil {
+		t.Errorf("deliverVoicemail() = %v, want it delivered to Slack", err)
+	}
+	want := "New voicemail for +14155550100 from Jane &lt;Doe&gt; (+14155550101), 12s: <https://api.twilio.com/recordings/RE1.mp3|Listen>"
+	if texts := posted(); len(texts) != 1 || texts[0] != want {
+		t.Errorf("Posted %q to Slack, want %q", texts, want)
+	}
+	if count, _ := memory.Count(); count != 0 {
+		t.Errorf("%d voicemails queued, want none without SlackAlsoQueue", count)
+	}
+}
+
+func TestPostTranscriptionToSlack(t *testing.T) {
+	_, posted := useSlack(t, http.StatusOK, func(c *Config) {})
+	deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", Text: "Call me back & soon"}, false)
+	if texts := posted(); len(texts) != 1 || !strings.HasSuffix(texts[0], ": Call me back &amp; soon") {
+		t.Errorf("Posted %q to Slack, want the escaped transcription", texts)
+	}
+}
+
+func TestSlackAlsoQueue(t *testing.T) {
+	memory, posted := useSlack(t, http.StatusOK, func(c *Config) { c.SlackAlsoQueue = true })
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1.mp3"}, false)
+	if _, ok := err.(*queuedError); !ok {
+		t.Errorf("deliverVoicemail() = %v, want it queued as well", err)
+	}
+	if texts := posted(); len(texts) != 1 {
+		t.Errorf("Posted %d messages to Slack, want 1", len(texts))
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails queued, want 1", count)
+	}
+}
+
+func TestSlackFailureQueues(t *testing.T) {
+	memory, _ := useSlack(t, http.StatusInternalServerError, func(c *Config) {})
+	err := deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550100", AudioURL: "https://api.twilio.com/recordings/RE1.mp3"}, false)
+	if _, ok := err.(*queuedError); !ok {
+		t.Errorf("deliverVoicemail() = %v, want it queued when Slack fails", err)
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails queued, want 1", count)
+	}
+}
+
+func TestSlackOnlyForMappedRecipients(t *testing.T) {
+	memory, posted := useSlack(t, http.StatusOK, func(c *Config) {})
+	deliverVoicemail(PendingVoicemail{From: "+14155550101", To: "+14155550199", AudioURL: "https://api.twilio.com/recordings/RE1.mp3"}, false)
+	if texts := posted(); len(texts) != 0 {
+		t.Errorf("Posted %q to Slack for a recipient without a channel", texts)
+	}
+	if count, _ := memory.Count(); count != 1 {
+		t.Errorf("%d voicemails queued, want 1", count)
+	}
+}
+
+func TestSlackWebhooksRedacted(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.SlackWebhooks = map[string]string{"+14155550100": testSlackWebhook}
+	})
+	if webhook := config.Redacted().SlackWebhooks["+14155550100"]; webhook == testSlackWebhook {
+		t.Error("Redacted() kept the Slack webhook URL")
+	}
+	if config.SlackWebhooks["+14155550100"] != testSlackWebhook {
+		t.Error("Redacted() changed the config's Slack webhooks")
+	}
+}
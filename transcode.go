@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transcodingEnabled reports whether recordings should be transcoded before delivery.
+func transcodingEnabled() bool {
+	return len(config.TranscodeCommand) > 0 || config.TranscodeURL != ""
+}
+
+// postTranscodedAudio transcodes the downloaded recording and uploads the result as a
+// single chunk in the stream.
+func postTranscodedAudio(backend Backend, accountId, streamId int64, source string, extra url.Values) error {
+	dir, err := ioutil.TempDir("", "voicemail")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "transcoded"+config.TranscodeExtension)
+	if len(config.TranscodeCommand) > 0 {
+		err = transcodeWithCommand(source, output)
+	} else {
+		err = transcodeWithService(source, output)
+	}
+	if err != nil {
+		return err
+	}
+	return postAudioFile(backend, accountId, streamId, output, extra)
+}
+
+// transcodeWithCommand runs TranscodeCommand, replacing "{input}" and "{output}" in
+// its arguments with the file names. The command is killed if it takes longer than
+// TranscodeTimeoutSeconds.
+func transcodeWithCommand(input, output string) error {
+	replacer := strings.NewReplacer("{input}", input, "{output}", output)
+	args := make([]string, len(config.TranscodeCommand))
+	for i, arg := range config.TranscodeCommand {
+		args[i] = replacer.Replace(arg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.TranscodeTimeoutSeconds)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s timed out after %ds", args[0], config.TranscodeTimeoutSeconds)
+		}
+		return fmt.Errorf("%s failed: %v (%s)", args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// transcodeWithService posts the audio to TranscodeURL and saves the response body.
+func transcodeWithService(input, output string) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	resp, err := httpClient.Post(config.TranscodeURL, audioContentType(input), in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("transcoding service returned %s", resp.Status)
+	}
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, resp.Body)
+	if err == nil && n == 0 {
+		err = fmt.Errorf("transcoding service returned no audio")
+	}
+	return err
+}
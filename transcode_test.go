@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// transcodeAPI serves the recording, a stub transcoding service that reverses the
+// audio it's sent, and stream 7 of the Roger API.
+func transcodeAPI(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Host == "transcoder.example.com":
+		audio, _ := ioutil.ReadAll(r.Body)
+		for i, j := 0, len(audio)-1; i < j; i, j = i+1, j-1 {
+			audio[i], audio[j] = audio[j], audio[i]
+		}
+		w.Write(audio)
+	case r.Method == "GET":
+		w.Write([]byte("original"))
+	default:
+		streamHandler(7)(w, r)
+	}
+}
+
+// postedAudio returns the audio file uploaded in the chunk, and its Content-Type.
+func postedAudio(t *testing.T, chunk sentRequest) (audio, contentType string) {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(chunk.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Chunk wasn't uploaded as a file: %v", err)
+	}
+	form, err := multipart.NewReader(bytes.NewReader(chunk.Body), params["boundary"]).ReadForm(1 << 20)
+	if err != nil || len(form.File["audio"]) != 1 {
+		t.Fatalf("Chunk has no audio file (%v)", err)
+	}
+	file, err := form.File["audio"][0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), form.File["audio"][0].Header.Get("Content-Type")
+}
+
+func postTranscoded(t *testing.T, update func(c *Config)) []sentRequest {
+	t.Helper()
+	setConfig(t, update)
+	fake := interceptHTTP(t, transcodeAPI)
+	captureLog(t)
+	err := postRecording(t, "https://api.twilio.com/recordings/RE1.mp3", url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake.RequestsTo("/streams/7/chunks")
+}
+
+func requireShell(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+}
+
+func TestTranscodeWithService(t *testing.T) {
+	chunks := postTranscoded(t, func(c *Config) {
+		c.TranscodeURL = "https://transcoder.example.com/opus"
+	})
+	if len(chunks) != 1 {
+		t.Fatalf("Posted %d chunks, want 1", len(chunks))
+	}
+	if audio, contentType := postedAudio(t, chunks[0]); audio != "lanigiro" || contentType != "audio/ogg" {
+		t.Errorf("Posted %q as %s, want the transcoded audio as audio/ogg", audio, contentType)
+	}
+}
+
+func TestTranscodeWithCommand(t *testing.T) {
+	requireShell(t)
+	chunks := postTranscoded(t, func(c *Config) {
+		c.TranscodeCommand = []string{"sh", "-c", `tr a-z A-Z < "$0" > "$1"`, "{input}", "{output}"}
+	})
+	if len(chunks) != 1 {
+		t.Fatalf("Posted %d chunks, want 1", len(chunks))
+	}
+	if audio, _ := postedAudio(t, chunks[0]); audio != "ORIGINAL" {
+		t.Errorf("Posted %q, want the transcoded audio", audio)
+	}
+}
+
+func TestTranscodeFailureFallsBack(t *testing.T) {
+	requireShell(t)
+	chunks := postTranscoded(t, func(c *Config) {
+		c.TranscodeCommand = []string{"sh", "-c", "exit 1"}
+	})
+	if len(chunks) != 1 || chunks[0].Form().Get("audio_url") != "https://api.twilio.com/recordings/RE1.mp3" {
+		t.Errorf("Posted %v, want the original recording by URL", chunks)
+	}
+}
+
+func TestTranscodeServiceFailureFallsBack(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.TranscodeURL = "https://transcoder.example.com/opus"
+	})
+	fake := interceptHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "transcoder.example.com" {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		transcodeAPI(w, r)
+	})
+	logs := captureLog(t)
+	if err := postRecording(t, "https://api.twilio.com/recordings/RE1.mp3", url.Values{}); err != nil {
+		t.Fatal(err)
+	}
+	chunks := fake.RequestsTo("/streams/7/chunks")
+	if len(chunks) != 1 || chunks[0].Form().Get("audio_url") != "https://api.twilio.com/recordings/RE1.mp3" {
+		t.Errorf("Posted %v, want the original recording by URL", chunks)
+	}
+	if !strings.Contains(logs.String(), "503") {
+		t.Errorf("Log = %q, want the transcoding failure logged", logs.String())
+	}
+}
+
+func TestTranscodeCommandTimeout(t *testing.T) {
+	requireShell(t)
+	setConfig(t, func(c *Config) {
+		c.TranscodeCommand = []string{"sleep", "10"}
+		c.TranscodeTimeoutSeconds = 1
+	})
+	err := transcodeWithCommand(t.TempDir()+"/source.mp3", t.TempDir()+"/transcoded.opus")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("transcodeWithCommand() = %v, want a timeout", err)
+	}
+}
+
+func TestTranscodeValidated(t *testing.T) {
+	tests := []func(c *Config){
+		func(c *Config) {
+			c.TranscodeCommand, c.TranscodeURL = []string{"true"}, "https://transcoder.example.com/"
+		},
+		func(c *Config) { c.TranscodeURL, c.TranscodeExtension = "https://transcoder.example.com/", ".xyz" },
+		func(c *Config) { c.TranscodeCommand, c.TranscodeTimeoutSeconds = []string{"true"}, 0 },
+	}
+	for i, update := range tests {
+		c := config
+		update(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() accepted transcoding config %d", i)
+		}
+	}
+}
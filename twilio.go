@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// requireTwilio wraps a webhook handler so that it only accepts requests signed by
+// Twilio. Validation is skipped if no Twilio auth token is configured.
+func requireTwilio(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.LogTwilioLatency {
+			logTwilioLatency(r, time.Now())
+		}
+		if config.TwilioAuthToken == "" || config.LocalDev {
+			handler(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			log.Printf("Failed to parse body: %v", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		expected := twilioSignature(config.TwilioAuthToken, webhookURL(r), r.PostForm)
+		if !hmac.Equal([]byte(r.Header.Get("X-Twilio-Signature")), []byte(expected)) {
+			log.Printf("Rejected %s %s with invalid Twilio signature", r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// logTwilioLatency logs and records how long ago Twilio sent the request, from the
+// Timestamp parameter of status callbacks. Other webhooks don't have one.
+func logTwilioLatency(r *http.Request, receivedAt time.Time) {
+	if err := r.ParseForm(); err != nil {
+		return
+	}
+	latency, ok := twilioLatency(r.Form, receivedAt)
+	if !ok {
+		return
+	}
+	log.Printf("Twilio sent %s %s %s ago", r.Method, r.URL.Path, latency)
+	twilioLatencies.Observe(latency.Seconds())
+}
+
+// twilioLatency returns the time between the request's Timestamp parameter and when
+// we received it. Timestamps only have second precision, so this is coarse.
+func twilioLatency(form url.Values, receivedAt time.Time) (time.Duration, bool) {
+	raw := form.Get("Timestamp")
+	if raw == "" {
+		return 0, false
+	}
+	sent, err := time.Parse(time.RFC1123Z, raw)
+	if err != nil {
+		log.Printf("Failed to parse Twilio timestamp %q: %v", raw, err)
+		return 0, false
+	}
+	return receivedAt.Sub(sent), true
+}
+
+// twilioSignature computes the X-Twilio-Signature value for a request, which is the
+// HMAC-SHA1 of the full URL followed by the sorted POST parameters.
+func twilioSignature(authToken, fullURL string, params map[string][]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(fullURL))
+	for _, key := range keys {
+		for _, value := range params[key] {
+			mac.Write([]byte(key))
+			mac.Write([]byte(value))
+		}
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isTwilioURL reports whether the URL is on the Twilio REST API, including its
+// regional hosts such as api.dublin.ie1.twilio.com.
+func isTwilioURL(u *url.URL) bool {
+	host := u.Hostname()
+	return u.Scheme == "https" && (host == "api.twilio.com" || strings.HasPrefix(host, "api.") && strings.HasSuffix(host, ".twilio.com"))
+}
+
+// webhookURL reconstructs the URL Twilio used to reach us.
+func webhookURL(r *http.Request) string {
+	if config.PublicURL != "" {
+		return config.PublicURL + r.URL.RequestURI()
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// warmUp makes the requests that calls will make, before we start taking calls, so
+// that the first caller doesn't wait for connections to be set up. Failures are only
+// logged, since calls can still be handled without a warm connection.
+func warmUp() {
+	start := time.Now()
+	if _, err := pendingStore.Count(); err != nil {
+		log.Printf("Warm-up: failed to count pending voicemails: %v", err)
+	}
+	if _, err := getIdentity("warmup"); err != nil {
+		log.Printf("Warm-up: failed to look up an identity: %v", err)
+	}
+	backends := []Backend{backendFor("")}
+	for _, backend := range config.Backends {
+		backends = append(backends, backend)
+	}
+	for _, backend := range backends {
+		if config.LocalDev {
+			break
+		}
+		// Any response will do, it's the connection we're after.
+		resp, err := httpClient.Head(backend.apiURL.String())
+		if err != nil {
+			log.Printf("Warm-up: failed to reach %s: %v", backend.apiURL, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+	log.Printf("Warmed up in %s", time.Since(start))
+}
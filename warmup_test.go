@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWarmUp(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) {
+		c.Backends = map[string]Backend{"+44": {APIBaseURL: "https://api.example.co.uk/v1/", AccessToken: "token"}}
+	})
+	fake := interceptHTTP(t, streamHandler(7))
+	logs := captureLog(t)
+	// main only starts listening once this returns, so everything has to be done by then.
+	warmUp()
+	hosts := make(map[string]bool)
+	for _, req := range fake.Requests() {
+		if req.Method != "HEAD" {
+			t.Errorf("Warm-up made a %s request to %s, want only HEAD", req.Method, req.URL)
+		}
+		hosts[req.URL.Host] = true
+	}
+	if !hosts["api.rogertalk.com"] || !hosts["api.example.co.uk"] {
+		t.Errorf("Warm-up connected to %v, want every Roger API backend", hosts)
+	}
+	if strings.Contains(logs.String(), "Warm-up: failed") || !strings.Contains(logs.String(), "Warmed up in") {
+		t.Errorf("Log = %q, want a successful warm-up", logs.String())
+	}
+}
+
+func TestWarmUpFailuresLogged(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	fake := interceptHTTP(t, streamHandler(7))
+	logs := captureLog(t)
+	failDatastore(t)
+	warmUp()
+	if !strings.Contains(logs.String(), "Warm-up: failed to look up an identity") {
+		t.Errorf("Log = %q, want the Datastore failure logged", logs.String())
+	}
+	// The Roger API is still warmed up.
+	if requests := fake.Requests(); len(requests) == 0 {
+		t.Error("Warm-up gave up after the Datastore failure")
+	}
+}
+
+func TestWarmUpLocalDev(t *testing.T) {
+	useDatastore(t)
+	usePendingStore(t)
+	setConfig(t, func(c *Config) { c.LocalDev = true })
+	fake := interceptHTTP(t, streamHandler(7))
+	captureLog(t)
+	warmUp()
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("Warm-up in local dev made %d requests", len(requests))
+	}
+}